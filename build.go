@@ -2,6 +2,7 @@ package prospect
 
 import (
 	"compress/gzip"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -66,14 +67,23 @@ func Build(file string, run RunFunc, accept AcceptFunc) error {
 
 func (b Builder) Store(d Data) error {
 	d = b.Context.update(d)
+	d = withProvenance(d)
 	return b.Archive.Store(d)
 }
 
 func (b Builder) CreateFile(d Data, buf []byte) (Link, error) {
 	d = b.Context.update(d)
+	d = withProvenance(d)
 	return b.Archive.CreateFile(d, buf)
 }
 
+func withProvenance(d Data) Data {
+	if d.Archive.provenance {
+		d.Parameters = append(d.Parameters, d.Archive.Provenance(d)...)
+	}
+	return d
+}
+
 func (b Builder) GetMime(d Data) Data {
 	m := b.Mimes.Get(filepath.Ext(d.File))
 	if m.isZero() {
@@ -89,13 +99,23 @@ func (b Builder) GetMime(d Data) Data {
 }
 
 func (b Builder) ExecuteCommands(d Data) ([]Link, error) {
-	var ks []Link
+	if len(b.Commands) == 0 {
+		return nil, nil
+	}
+	dir, err := d.ResolveErr()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", d.File, err)
+	}
+	var (
+		ks   []Link
+		link = CreateLink(filepath.Join(dir, filepath.Base(d.File)), d.Type)
+	)
 	for _, c := range b.Commands {
 		x, buf, err := c.Exec(d)
 		if err != nil || len(buf) == 0 {
 			continue
 		}
-		x.Links = append(x.Links, CreateLinkFrom(d))
+		x.Links = append(x.Links, link)
 		k, err := b.CreateFile(x, buf)
 		if err != nil {
 			continue
@@ -113,6 +133,21 @@ func Load(file string) (Builder, error) {
 	if err := toml.DecodeFile(file, &b); err != nil {
 		return b, err
 	}
+	for i, d := range b.Data {
+		if len(d.Components) > 0 {
+			p, err := NewPatternFromComponents(d.Components)
+			if err != nil {
+				return b, err
+			}
+			b.Data[i].Archive = p
+		}
+		for _, o := range d.Options() {
+			o(&b.Data[i].Archive)
+		}
+		if err := RequireFragments(b.Data[i].Archive.Resolver, d.Require...); err != nil {
+			return b, fmt.Errorf("file #%d: %w", i+1, err)
+		}
+	}
 	if r, err := os.Open(b.Include); err == nil {
 		defer r.Close()
 		c := struct {
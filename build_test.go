@@ -0,0 +1,282 @@
+package prospect
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuilderStore(t *testing.T) {
+	data := []struct {
+		Pattern    string
+		Parameters []Parameter
+		Want       string
+		Err        error
+	}{
+		{
+			Pattern:    "{source}/{meta:run!required}",
+			Parameters: []Parameter{{Name: "run", Value: "R1"}},
+			Want:       "Src/R1/file.dat",
+		},
+		{
+			Pattern: "{source}/{meta:run!required}",
+			Err:     ErrEmpty,
+		},
+		{
+			Pattern: "{source}/{meta:run}",
+			Err:     ErrEmpty,
+		},
+		{
+			Pattern: "{source}/{meta:run?}",
+			Want:    "Src/file.dat",
+		},
+	}
+	for _, d := range data {
+		p, err := NewPattern(d.Pattern)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Pattern, err)
+			continue
+		}
+		var (
+			dir  = t.TempDir()
+			file = filepath.Join(dir, "file.dat")
+			b    Builder
+		)
+		if err := ioutil.WriteFile(file, []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		b.DataDir = filepath.Join(dir, "data")
+		b.MetaDir = filepath.Join(dir, "meta")
+
+		dat := Data{
+			File:       file,
+			Source:     "src",
+			Parameters: d.Parameters,
+			Archive:    p,
+		}
+		err = b.Store(dat)
+		if d.Err != nil {
+			if !errors.Is(err, d.Err) {
+				t.Errorf("%s: expected error %v, got %v", d.Pattern, d.Err, err)
+			}
+			if _, err := os.Stat(b.DataDir); err == nil {
+				t.Errorf("%s: file stored in the archive", d.Pattern)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Pattern, err)
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(b.DataDir, d.Want)); err != nil {
+			t.Errorf("%s: file not stored: %s", d.Pattern, err)
+		}
+	}
+}
+
+func TestWithProvenance(t *testing.T) {
+	dat := Data{
+		Source:     "src",
+		Type:       "data",
+		Parameters: []Parameter{{Name: "run", Value: "R1"}},
+	}
+	data := []struct {
+		Options []PatternOption
+		Want    map[string]string
+	}{
+		{},
+		{
+			Options: []PatternOption{WithProvenance()},
+			Want: map[string]string{
+				archPattern:                   "path(fragment(source)/meta(run)/fragment(type))",
+				fmt.Sprintf(archComponent, 1): "fragment(source)",
+				fmt.Sprintf(archValue, 1):     "Src",
+				fmt.Sprintf(archComponent, 2): "meta(run)",
+				fmt.Sprintf(archValue, 2):     "R1",
+				fmt.Sprintf(archComponent, 3): "fragment(type)",
+				fmt.Sprintf(archValue, 3):     "Data",
+			},
+		},
+	}
+	for _, d := range data {
+		p, err := NewPattern("{source}/{meta:run}/{type}", d.Options...)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		dat.Archive = p
+		got := withProvenance(dat)
+		if len(got.Parameters) != len(dat.Parameters)+len(d.Want) {
+			t.Errorf("%d options: expected %d parameters, got %v", len(d.Options), len(dat.Parameters)+len(d.Want), got.Parameters)
+			continue
+		}
+		for _, x := range got.Parameters[len(dat.Parameters):] {
+			if v, ok := d.Want[x.Name]; !ok || v != x.Value {
+				t.Errorf("%s: unexpected value %q", x.Name, x.Value)
+			}
+		}
+	}
+}
+
+func TestLoadLookups(t *testing.T) {
+	const config = `
+datadir = "data"
+
+[lookup.type]
+image = "pictures"
+
+[[file]]
+type = "image"
+archive = "{lookup:type}"
+`
+	file := filepath.Join(t.TempDir(), "config.toml")
+	if err := ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := Load(file)
+	if err != nil {
+		t.Fatalf("fail to load configuration: %s", err)
+	}
+	if len(b.Data) != 1 {
+		t.Fatalf("expected 1 file section, got %d", len(b.Data))
+	}
+	d := b.Update(b.Data[0])
+	if got := d.Resolve(); got != "pictures" {
+		t.Errorf("values mismatched! want pictures, got %s", got)
+	}
+}
+
+func TestLoadPatternOptions(t *testing.T) {
+	data := []struct {
+		Options string
+		Data    Data
+		Want    string
+		Err     error
+	}{
+		{
+			Data: Data{Source: "Run One", Type: "image", File: "/tmp/File.png"},
+			Want: "RunOne/Image/File.png",
+		},
+		{
+			Options: "lowercase = true\n",
+			Data:    Data{Source: "Run One", Type: "image", File: "/tmp/File.png"},
+			Want:    "runone/image/File.png",
+		},
+		{
+			Options: "url-safe = true\n",
+			Data:    Data{Source: "Run#1", Type: "image", File: "/tmp/File.png"},
+			Want:    "Run%231/Image/File.png",
+		},
+		{
+			Options: "fold = true\n",
+			Data:    Data{Source: "Été", Type: "image", File: "/tmp/File.png"},
+			Want:    "Ete/Image/File.png",
+		},
+		{
+			Options: "provenance = true\n",
+			Data:    Data{Source: "src", Type: "image", File: "/tmp/File.png"},
+			Want:    "Src/Image/File.png",
+		},
+		{
+			Options: "max-length = 10\n",
+			Data:    Data{Source: "Run One", Type: "image", File: "/tmp/File.png"},
+			Err:     ErrTooLong,
+		},
+		{
+			Options: "max-component = 4\ntruncate = true\n",
+			Data:    Data{Source: "Run One", Type: "image", File: "/tmp/File.png"},
+			Want:    "RunO/Imag/File.png",
+		},
+	}
+	for _, d := range data {
+		config := "[[file]]\narchive = \"{source}/{type}\"\n" + d.Options
+		file := filepath.Join(t.TempDir(), "config.toml")
+		if err := ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		b, err := Load(file)
+		if err != nil {
+			t.Errorf("%q: fail to load configuration: %s", d.Options, err)
+			continue
+		}
+		if len(b.Data) != 1 {
+			t.Errorf("%q: expected 1 file section, got %d", d.Options, len(b.Data))
+			continue
+		}
+		if want := strings.Contains(d.Options, "provenance"); b.Data[0].Archive.provenance != want {
+			t.Errorf("%q: provenance mismatched! want %t, got %t", d.Options, want, b.Data[0].Archive.provenance)
+		}
+		d.Data.Archive = b.Data[0].Archive
+		got, err := d.Data.ResolveErr()
+		if d.Err != nil {
+			if !errors.Is(err, d.Err) {
+				t.Errorf("%q: expected error %v, got %v", d.Options, d.Err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", d.Options, err)
+			continue
+		}
+		if got = filepath.Join(got, filepath.Base(d.Data.File)); got != d.Want {
+			t.Errorf("%q: paths mismatched! want %s, got %s", d.Options, d.Want, got)
+		}
+	}
+}
+
+func TestLoadRequire(t *testing.T) {
+	data := []struct {
+		Section string
+		Invalid bool
+	}{
+		{Section: "archive = \"{source}/{year}\"\nrequire = [\"source\", \"time\"]\n"},
+		{Section: "archive = \"{source}/{doy}\"\n"},
+		{Section: "archive = \"{source}/{type}\"\nrequire = [\"source\", \"time\"]\n", Invalid: true},
+		{Section: "archive = \"{type}\"\nrequire = [\"source\"]\n", Invalid: true},
+	}
+	for _, d := range data {
+		file := filepath.Join(t.TempDir(), "config.toml")
+		if err := ioutil.WriteFile(file, []byte("[[file]]\n"+d.Section), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := Load(file)
+		if d.Invalid != (err != nil) {
+			t.Errorf("%q: unexpected result: %v", d.Section, err)
+		}
+	}
+}
+
+func TestLoadComponents(t *testing.T) {
+	const config = `
+[[file]]
+archive = "ignored"
+
+[[file.archive-path]]
+literal = "archive"
+
+[[file.archive-path]]
+fragment = "source"
+
+[[file.archive-path]]
+fragment = "model||'unknown'"
+`
+	file := filepath.Join(t.TempDir(), "config.toml")
+	if err := ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := Load(file)
+	if err != nil {
+		t.Fatalf("fail to load configuration: %s", err)
+	}
+	if len(b.Data) != 1 {
+		t.Fatalf("expected 1 file section, got %d", len(b.Data))
+	}
+	d := b.Data[0]
+	d.Source = "src"
+	if got := d.Resolve(); got != "archive/Src/unknown" {
+		t.Errorf("values mismatched! want archive/Src/unknown, got %s", got)
+	}
+}
@@ -0,0 +1,169 @@
+package prospect
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Canonical gives a representation of the resolver tree of p where the
+// elements that do not change the resolved paths are removed: empty
+// directories, adjacent literals, case of the fragment names and their
+// synonyms.
+func (p Pattern) Canonical() string {
+	if p.Resolver == nil {
+		return ""
+	}
+	return canonical(p.Resolver).String()
+}
+
+// Equal reports whether p and other always resolve to the same paths. Functions
+// given with WithTransform are not taken into account.
+func (p Pattern) Equal(other Pattern) bool {
+	if p.lower != other.lower || p.fold != other.fold || p.strip != other.strip || p.mimeExt != other.mimeExt || p.maxLength != other.maxLength || p.truncate != other.truncate || p.urlSafe != other.urlSafe || p.maxName != other.maxName || p.truncName != other.truncName {
+		return false
+	}
+	return p.Canonical() == other.Canonical()
+}
+
+var synonyms = map[string]string{
+	levelMinLong: levelMinShort,
+	levelSecLong: levelSecShort,
+	levelFormat:  levelMime,
+}
+
+func canonical(r Resolver) Resolver {
+	switch r := r.(type) {
+	case path:
+		var rs []Resolver
+		for _, r := range r.rs {
+			r = canonical(r)
+			if i, ok := r.(literal); ok && i == "" {
+				continue
+			}
+			rs = append(rs, r)
+		}
+		return path{rs: rs}
+	case compound:
+		return canonicalCompound(r)
+	case chain:
+		rs := make([]Resolver, len(r.rs))
+		for i := range r.rs {
+			rs[i] = canonical(r.rs[i])
+		}
+		if len(rs) == 1 {
+			return rs[0]
+		}
+		return chain{rs: rs}
+	case optional:
+		r.Resolver = canonical(r.Resolver)
+		return r
+	case modifier:
+		r.Resolver = canonical(r.Resolver)
+		return r
+	case fragment:
+		name := strings.ToLower(r.name)
+		if n, ok := synonyms[name]; ok {
+			name = n
+		}
+		return fragment{name: name, first: r.first}
+	case table:
+		r.field.name = strings.ToLower(r.field.name)
+		return r
+	case join:
+		rs := make([]Resolver, len(r.rs))
+		for i := range r.rs {
+			rs[i] = canonical(r.rs[i])
+		}
+		r.rs = rs
+		return r
+	case ordinal:
+		r.field.name = strings.ToLower(r.field.name)
+		return r
+	case msgdate:
+		r.field = canonical(r.field).(fragment)
+		return r
+	case datepath:
+		r.name = strings.ToLower(r.name)
+		return r
+	default:
+		return r
+	}
+}
+
+func canonicalCompound(c compound) Resolver {
+	var (
+		rs  []Resolver
+		buf strings.Builder
+	)
+	flush := func() {
+		if buf.Len() > 0 {
+			rs = append(rs, literal(buf.String()))
+			buf.Reset()
+		}
+	}
+	var walk func(compound)
+	walk = func(c compound) {
+		for _, r := range c.rs {
+			switch r := canonical(r).(type) {
+			case literal:
+				buf.WriteString(string(r))
+			case compound:
+				walk(r)
+			default:
+				flush()
+				rs = append(rs, r)
+			}
+		}
+	}
+	walk(c)
+	flush()
+
+	switch len(rs) {
+	case 0:
+		return literal("")
+	case 1:
+		return rs[0]
+	default:
+		return compound{rs: rs}
+	}
+}
+
+// LintPattern parses str and reports the suspicious constructs found in the
+// pattern: adjacent directories that always resolve to the same value. Repeated
+// literals are considered as intentional and are not reported.
+func LintPattern(str string) ([]string, error) {
+	r, err := ParseResolver(str)
+	if err != nil {
+		return nil, err
+	}
+	p, ok := canonical(r).(path)
+	if !ok {
+		return nil, nil
+	}
+	var msgs []string
+	for i := 1; i < len(p.rs); i++ {
+		prev, curr := p.rs[i-1], p.rs[i]
+		if isLiteral(curr) || prev.String() != curr.String() {
+			continue
+		}
+		msgs = append(msgs, fmt.Sprintf("directories %d and %d always have the same value (%s)", i, i+1, curr))
+	}
+	return msgs, nil
+}
+
+// isLiteral reports whether r is, or is only made of, literals.
+func isLiteral(r Resolver) bool {
+	switch r := r.(type) {
+	case literal:
+		return true
+	case compound:
+		for _, r := range r.rs {
+			if !isLiteral(r) {
+				return false
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,94 @@
+package prospect
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPatternEqual(t *testing.T) {
+	data := []struct {
+		Left    string
+		Right   string
+		Options []PatternOption
+		Equal   bool
+	}{
+		{Left: "{source}/{type}", Right: "{source}/{type}", Equal: true},
+		{Left: "{source}/{type}", Right: "{SOURCE}/{Type}", Equal: true},
+		{Left: "{source}//{type}", Right: "{source}/{type}", Equal: true},
+		{Left: "{year}/{minute}", Right: "{year}/{min}", Equal: true},
+		{Left: "{year}/{second}", Right: "{year}/{sec}", Equal: true},
+		{Left: "{source}/{format}", Right: "{source}/{mime}", Equal: true},
+		{Left: "run_{year}", Right: "run_{year}", Equal: true},
+		{Left: "{msgdate:year}/{msgdate:minute}", Right: "{msgdate:YEAR}/{msgdate:min}", Equal: true},
+		{Left: "{msgdate:year}", Right: "{year}"},
+		{Left: "{source}/{type}", Right: "{type}/{source}"},
+		{Left: "{source}/{type}", Right: "{source}/{type}/{year}"},
+		{Left: "{source}/{type}", Right: "{source}_{type}"},
+		{Left: "{source}/{model}", Right: "{source}/{model?}"},
+		{Left: "{source}", Right: "{source!required}"},
+		{Left: "{year}", Right: "{year}", Options: []PatternOption{WithLowercase()}},
+	}
+	for _, d := range data {
+		left, err := NewPattern(d.Left)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Left, err)
+			continue
+		}
+		right, err := NewPattern(d.Right, d.Options...)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Right, err)
+			continue
+		}
+		if got := left.Equal(right); got != d.Equal {
+			t.Errorf("%s == %s: want %t, got %t (%s - %s)", d.Left, d.Right, d.Equal, got, left.Canonical(), right.Canonical())
+		}
+		if got := right.Equal(left); got != d.Equal {
+			t.Errorf("%s == %s: comparison should be symmetric", d.Right, d.Left)
+		}
+	}
+	var p Pattern
+	if got := p.Canonical(); got != "" {
+		t.Errorf("empty pattern: canonical form should be empty, got %s", got)
+	}
+}
+
+func TestLintPattern(t *testing.T) {
+	data := []struct {
+		Pattern string
+		Want    []string
+		Invalid bool
+	}{
+		{Pattern: "{source}/{type}"},
+		{Pattern: "{source}/{source}", Want: []string{"directories 1 and 2"}},
+		{Pattern: "{source}/{SOURCE}", Want: []string{"directories 1 and 2"}},
+		{Pattern: "{year}/{minute}/{min}", Want: []string{"directories 2 and 3"}},
+		{Pattern: "{source}/{type}/{source}"},
+		{Pattern: "{type}/{type}/{type}", Want: []string{"directories 1 and 2", "directories 2 and 3"}},
+		{Pattern: "data/data/{type}"},
+		{Pattern: "run_a/run_a"},
+		{Pattern: "{source}", Want: nil},
+		{Pattern: "{source", Invalid: true},
+	}
+	for _, d := range data {
+		msgs, err := LintPattern(d.Pattern)
+		if d.Invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error", d.Pattern)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Pattern, err)
+			continue
+		}
+		if len(msgs) != len(d.Want) {
+			t.Errorf("%s: messages mismatched! want %d, got %d (%s)", d.Pattern, len(d.Want), len(msgs), msgs)
+			continue
+		}
+		for i := range msgs {
+			if !strings.HasPrefix(msgs[i], d.Want[i]) {
+				t.Errorf("%s: message mismatched! want %s, got %s", d.Pattern, d.Want[i], msgs[i])
+			}
+		}
+	}
+}
@@ -41,9 +41,14 @@ func (t *Tracer) Summarize() {
 }
 
 func (t *Tracer) Done(file string, d prospect.Data) {
+	dir, err := d.ResolveErr()
+	if err != nil {
+		t.Error(file, err)
+		return
+	}
 	var (
 		elapsed = time.Since(t.now)
-		archive = filepath.Join(d.Resolve(), filepath.Base(d.File))
+		archive = filepath.Join(dir, filepath.Base(d.File))
 	)
 	t.size += float64(d.Size)
 	t.Trace("done processing %s -> %s (%d, %s)", file, archive, d.Size, elapsed)
@@ -0,0 +1,49 @@
+package prospect
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// Containers gives the records of the directories of the resolved paths of a
+// run. Each directory is given only once.
+type Containers struct {
+	seen map[string]struct{}
+}
+
+func NewContainers() *Containers {
+	return &Containers{
+		seen: make(map[string]struct{}),
+	}
+}
+
+// Records gives the records of the directories of file, from the top most one,
+// that have not been given yet.
+func (c *Containers) Records(file string) []FileInfo {
+	var (
+		dir   = filepath.ToSlash(filepath.Dir(filepath.Clean(file)))
+		parts = strings.Split(strings.Trim(dir, "/"), "/")
+		infos []FileInfo
+		curr  string
+	)
+	if dir == "." || dir == "/" {
+		return nil
+	}
+	if strings.HasPrefix(dir, "/") {
+		curr = "/"
+	}
+	for _, p := range parts {
+		curr = filepath.Join(curr, p)
+		if _, ok := c.seen[curr]; ok {
+			continue
+		}
+		c.seen[curr] = struct{}{}
+		infos = append(infos, FileInfo{
+			File:      curr,
+			Type:      TypeDirectory,
+			Mime:      MimeDir,
+			Container: true,
+		})
+	}
+	return infos
+}
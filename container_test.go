@@ -0,0 +1,35 @@
+package prospect
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContainers(t *testing.T) {
+	data := []struct {
+		File string
+		Want string
+	}{
+		{File: "data/2021/127/file.dat", Want: "data,data/2021,data/2021/127"},
+		{File: "data/2021/127/other.dat"},
+		{File: "data/2021/128/file.dat", Want: "data/2021/128"},
+		{File: "data//2022/./001/file.dat", Want: "data/2022,data/2022/001"},
+		{File: "/archive/file.dat", Want: "/archive"},
+		{File: "/archive/sub/file.dat", Want: "/archive/sub"},
+		{File: "file.dat"},
+		{File: "/file.dat"},
+	}
+	c := NewContainers()
+	for _, d := range data {
+		var files []string
+		for _, fi := range c.Records(d.File) {
+			if !fi.Container || fi.Type != TypeDirectory || fi.Mime != MimeDir {
+				t.Errorf("%s: %s: not a directory record: %+v", d.File, fi.File, fi)
+			}
+			files = append(files, fi.File)
+		}
+		if got := strings.Join(files, ","); got != d.Want {
+			t.Errorf("%s: directories mismatched! want %s, got %s", d.File, d.Want, got)
+		}
+	}
+}
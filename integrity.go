@@ -0,0 +1,145 @@
+package prospect
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	EncodingHex    = "hex"
+	EncodingBase64 = "base64"
+	EncodingBase32 = "base32"
+)
+
+// Integrity records the digest of a file with the algorithm used to compute it
+// and the encoding to use to represent it.
+type Integrity struct {
+	Algorithm string
+	Encoding  string
+	Value     []byte
+	// Prefix is the number of bytes hashed when only the beginning of the
+	// file has been used to compute the digest. It is zero for the digest of
+	// the whole file.
+	Prefix int64
+}
+
+func NewIntegrity(alg string, sum []byte) Integrity {
+	return Integrity{
+		Algorithm: alg,
+		Encoding:  EncodingHex,
+		Value:     sum,
+	}
+}
+
+// ParseIntegrity parses a string in the form given by Integrity.String. The
+// encoding of the digest is detected from its value and the size of the
+// digest of the algorithm.
+func ParseIntegrity(str string) (Integrity, error) {
+	var i Integrity
+	x := strings.IndexByte(str, '-')
+	if x <= 0 {
+		return i, fmt.Errorf("%s: missing algorithm", str)
+	}
+	alg := str[:x]
+	if x := strings.IndexByte(alg, '@'); x >= 0 {
+		n, err := strconv.ParseInt(alg[x+1:], 10, 64)
+		if err != nil || n <= 0 {
+			return i, fmt.Errorf("%s: invalid prefix", str)
+		}
+		alg, i.Prefix = alg[:x], n
+	}
+	i.Algorithm = strings.ToUpper(alg)
+	enc, sum, err := decodeDigest(i.Algorithm, str[x+1:])
+	if err != nil {
+		return i, fmt.Errorf("%s: %w", str, err)
+	}
+	i.Encoding = enc
+	i.Value = sum
+	return i, nil
+}
+
+// decodeDigest decodes str trying hex, base32 and base64 in this order. The
+// first encoding giving a value of the size expected for alg is used.
+func decodeDigest(alg, str string) (string, []byte, error) {
+	size := digestSize(alg)
+	for _, enc := range []string{EncodingHex, EncodingBase32, EncodingBase64} {
+		var (
+			sum []byte
+			err error
+		)
+		switch enc {
+		case EncodingHex:
+			sum, err = hex.DecodeString(str)
+		case EncodingBase32:
+			sum, err = base32.StdEncoding.DecodeString(str)
+		case EncodingBase64:
+			sum, err = base64.StdEncoding.DecodeString(str)
+		}
+		if err == nil && len(sum) > 0 && (size == 0 || len(sum) == size) {
+			return enc, sum, nil
+		}
+	}
+	return "", nil, fmt.Errorf("invalid digest")
+}
+
+// digestSize gives the size in bytes of the digest of alg or zero if alg is
+// not known.
+func digestSize(alg string) int {
+	switch alg {
+	case MD5:
+		return md5.Size
+	case SHA:
+		return sha256.Size
+	default:
+		return 0
+	}
+}
+
+func (i Integrity) IsZero() bool {
+	return len(i.Value) == 0
+}
+
+// IsPartial reports whether the digest has been computed over the beginning of
+// the file only.
+func (i Integrity) IsPartial() bool {
+	return i.Prefix > 0
+}
+
+// Digest gives the value of the digest in the encoding of i.
+func (i Integrity) Digest() string {
+	return encodeDigest(i.Encoding, i.Value)
+}
+
+// encodeDigest encodes sum with the given encoding. hex is used if the
+// encoding is not set or unknown.
+func encodeDigest(enc string, sum []byte) string {
+	switch strings.ToLower(enc) {
+	case EncodingBase64:
+		return base64.StdEncoding.EncodeToString(sum)
+	case EncodingBase32:
+		return base32.StdEncoding.EncodeToString(sum)
+	default:
+		return hex.EncodeToString(sum)
+	}
+}
+
+// String gives the canonical form of i: the name of the algorithm in lower
+// case followed by a dash and the digest in the encoding of i (eg:
+// sha256-xxx). The number of bytes of a partial digest follows the algorithm
+// (eg: sha256@1000000-xxx) so that it can not be confused with a full digest.
+func (i Integrity) String() string {
+	if i.IsZero() {
+		return ""
+	}
+	alg := strings.ToLower(i.Algorithm)
+	if i.IsPartial() {
+		alg = fmt.Sprintf("%s@%d", alg, i.Prefix)
+	}
+	return fmt.Sprintf("%s-%s", alg, i.Digest())
+}
@@ -0,0 +1,209 @@
+package prospect
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestIntegrityRoundTrip(t *testing.T) {
+	var (
+		sha = sha256.Sum256([]byte("content"))
+		sum = md5.Sum([]byte("content"))
+	)
+	data := []struct {
+		Integrity Integrity
+		Want      string
+	}{
+		{
+			Integrity: Integrity{Algorithm: SHA, Encoding: EncodingHex, Value: sha[:]},
+			Want:      "sha256-" + hex.EncodeToString(sha[:]),
+		},
+		{
+			Integrity: Integrity{Algorithm: SHA, Encoding: EncodingBase64, Value: sha[:]},
+			Want:      "sha256-" + base64.StdEncoding.EncodeToString(sha[:]),
+		},
+		{
+			Integrity: Integrity{Algorithm: SHA, Encoding: EncodingBase32, Value: sha[:]},
+			Want:      "sha256-" + base32.StdEncoding.EncodeToString(sha[:]),
+		},
+		{
+			Integrity: Integrity{Algorithm: MD5, Encoding: EncodingHex, Value: sum[:]},
+			Want:      "md5-" + hex.EncodeToString(sum[:]),
+		},
+		{
+			Integrity: Integrity{Algorithm: MD5, Encoding: EncodingBase64, Value: sum[:]},
+			Want:      "md5-" + base64.StdEncoding.EncodeToString(sum[:]),
+		},
+		{
+			Integrity: Integrity{Algorithm: SHA, Encoding: EncodingBase64, Value: sha[:], Prefix: 1024},
+			Want:      "sha256@1024-" + base64.StdEncoding.EncodeToString(sha[:]),
+		},
+		{
+			Integrity: Integrity{Algorithm: MD5, Encoding: EncodingBase32, Value: sum[:], Prefix: 10},
+			Want:      "md5@10-" + base32.StdEncoding.EncodeToString(sum[:]),
+		},
+	}
+	for _, d := range data {
+		str := d.Integrity.String()
+		if str != d.Want {
+			t.Errorf("%s: strings mismatched! want %s, got %s", d.Integrity.Encoding, d.Want, str)
+			continue
+		}
+		got, err := ParseIntegrity(str)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", str, err)
+			continue
+		}
+		if got.Algorithm != d.Integrity.Algorithm || got.Encoding != d.Integrity.Encoding || got.Prefix != d.Integrity.Prefix {
+			t.Errorf("%s: integrity mismatched! want %+v, got %+v", str, d.Integrity, got)
+		}
+		if !bytes.Equal(got.Value, d.Integrity.Value) {
+			t.Errorf("%s: digests mismatched", str)
+		}
+	}
+	for _, str := range []string{"", "sha256", "-abcd", "sha256-", "sha256-abcd", "sha256@x-" + hex.EncodeToString(sha[:])} {
+		if _, err := ParseIntegrity(str); err == nil {
+			t.Errorf("%s: expected an error", str)
+		}
+	}
+}
+
+func TestConfigDigest(t *testing.T) {
+	const content = "the content of the file"
+	data := []struct {
+		Config Config
+		Want   string
+	}{
+		{
+			Config: Config{},
+			Want:   hex.EncodeToString(sha256Sum(content)),
+		},
+		{
+			Config: Config{Encoding: EncodingBase64},
+			Want:   base64.StdEncoding.EncodeToString(sha256Sum(content)),
+		},
+		{
+			Config: Config{Integrity: "md5", Encoding: EncodingBase32},
+			Want:   base32.StdEncoding.EncodeToString(md5Sum(content)),
+		},
+	}
+	for _, d := range data {
+		i, err := d.Config.Digest(strings.NewReader(content))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Config.Encoding, err)
+			continue
+		}
+		if got := i.Digest(); got != d.Want {
+			t.Errorf("%s: digests mismatched! want %s, got %s", d.Config.Encoding, d.Want, got)
+		}
+		if got, want := i.String(), strings.ToLower(d.Config.Algorithm())+"-"+d.Want; got != want {
+			t.Errorf("%s: strings mismatched! want %s, got %s", d.Config.Encoding, want, got)
+		}
+
+		w := d.Config.NewDigester()
+		for _, c := range []byte(content) {
+			w.Write([]byte{c})
+		}
+		if got := w.Integrity().Digest(); got != d.Want {
+			t.Errorf("%s: digester mismatched! want %s, got %s", d.Config.Encoding, d.Want, got)
+		}
+	}
+}
+
+func sha256Sum(str string) []byte {
+	s := sha256.Sum256([]byte(str))
+	return s[:]
+}
+
+func md5Sum(str string) []byte {
+	s := md5.Sum([]byte(str))
+	return s[:]
+}
+
+func TestConfigDigestPrefix(t *testing.T) {
+	const prefix = 8
+	data := []struct {
+		Content string
+		Partial bool
+	}{
+		{Content: "abc"},
+		{Content: "abcdefgh"},
+		{Content: "abcdefghi", Partial: true},
+		{Content: strings.Repeat("abcdefgh", 100), Partial: true},
+	}
+	cfg := Config{HashPrefix: prefix}
+	for _, d := range data {
+		want := d.Content
+		if len(want) > prefix {
+			want = want[:prefix]
+		}
+		i, err := cfg.Digest(strings.NewReader(d.Content))
+		if err != nil {
+			t.Errorf("%d bytes: unexpected error: %s", len(d.Content), err)
+			continue
+		}
+		w := cfg.NewDigester()
+		w.Write([]byte(d.Content))
+		for _, got := range []Integrity{i, w.Integrity()} {
+			if got.IsPartial() != d.Partial {
+				t.Errorf("%d bytes: partial mismatched! want %t, got %t", len(d.Content), d.Partial, got.IsPartial())
+			}
+			if !bytes.Equal(got.Value, sha256Sum(want)) {
+				t.Errorf("%d bytes: digest should be computed over %q", len(d.Content), want)
+			}
+		}
+		full, _ := Config{}.Digest(strings.NewReader(d.Content))
+		if equal := full.String() == i.String(); equal == d.Partial {
+			t.Errorf("%d bytes: partial and full digests should only be equal for short content", len(d.Content))
+		}
+	}
+}
+
+func TestIntegrity(t *testing.T) {
+	sha := sha256Sum("content")
+	data := []struct {
+		Integrity Integrity
+		Zero      bool
+		String    string
+	}{
+		{Integrity: Integrity{}, Zero: true},
+		{Integrity: Integrity{Algorithm: SHA, Encoding: EncodingHex}, Zero: true},
+		{Integrity: NewIntegrity(SHA, sha), String: "sha256-" + hex.EncodeToString(sha)},
+		{Integrity: Integrity{Algorithm: "SHA256", Value: sha}, String: "sha256-" + hex.EncodeToString(sha)},
+		{Integrity: Integrity{Algorithm: SHA, Encoding: "unknown", Value: sha}, String: "sha256-" + hex.EncodeToString(sha)},
+		{Integrity: Integrity{Algorithm: SHA, Encoding: "BASE64", Value: sha}, String: "sha256-" + base64.StdEncoding.EncodeToString(sha)},
+		{Integrity: Integrity{Algorithm: "crc32", Value: []byte{1, 2, 3, 4}}, String: "crc32-01020304"},
+	}
+	for _, d := range data {
+		if got := d.Integrity.IsZero(); got != d.Zero {
+			t.Errorf("%+v: zero mismatched! want %t, got %t", d.Integrity, d.Zero, got)
+		}
+		if got := d.Integrity.String(); got != d.String {
+			t.Errorf("%+v: strings mismatched! want %s, got %s", d.Integrity, d.String, got)
+		}
+	}
+	for str, alg := range map[string]string{
+		"sha256-" + hex.EncodeToString(sha):            SHA,
+		"SHA256-" + hex.EncodeToString(sha):            SHA,
+		"md5-" + hex.EncodeToString(md5Sum("content")): MD5,
+		"crc32-01020304":                               "CRC32",
+	} {
+		i, err := ParseIntegrity(str)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", str, err)
+			continue
+		}
+		if i.Algorithm != alg || i.Encoding != EncodingHex {
+			t.Errorf("%s: integrity mismatched! got %+v", str, i)
+		}
+	}
+	if _, err := ParseIntegrity("md5-" + hex.EncodeToString(sha)); err == nil {
+		t.Errorf("a digest longer than the one of the algorithm should be rejected")
+	}
+}
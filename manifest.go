@@ -0,0 +1,255 @@
+package prospect
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	FieldFile       = "file"
+	FieldType       = "type"
+	FieldMime       = "mime"
+	FieldModel      = "model"
+	FieldOrigin     = "origin"
+	FieldLevel      = "level"
+	FieldIntegrity  = "integrity"
+	FieldSize       = "size"
+	FieldAcqTime    = "acqtime"
+	FieldModTime    = "modtime"
+	FieldMsgTime    = "msgtime"
+	FieldParameters = "parameters"
+	FieldLinks      = "links"
+)
+
+// ManifestWriter writes records as JSON objects, one per line. The names of
+// the fields can be changed to match the schema expected by the consumers of
+// the manifest.
+type ManifestWriter struct {
+	encoder *json.Encoder
+	names   map[string]string
+}
+
+// NewManifestWriter creates a ManifestWriter writing to w. names maps the
+// default name of the fields (see the Field constants) to the names to write.
+// Fields not found in names keep their default name.
+func NewManifestWriter(w io.Writer, names map[string]string) (*ManifestWriter, error) {
+	fields, err := fieldNames(names)
+	if err != nil {
+		return nil, err
+	}
+	mw := ManifestWriter{
+		encoder: json.NewEncoder(w),
+		names:   fields,
+	}
+	return &mw, nil
+}
+
+// fieldNames gives the name of each field of a manifest: its default name or
+// the one given by names.
+func fieldNames(names map[string]string) (map[string]string, error) {
+	var (
+		set    = make(map[string]struct{})
+		fields = make(map[string]string)
+	)
+	for _, f := range []string{FieldFile, FieldType, FieldMime, FieldModel, FieldOrigin, FieldLevel, FieldIntegrity, FieldSize, FieldAcqTime, FieldModTime, FieldMsgTime, FieldParameters, FieldLinks} {
+		fields[f] = f
+	}
+	for k, v := range names {
+		if _, ok := fields[k]; !ok {
+			return nil, fmt.Errorf("%s: unknown field", k)
+		}
+		if v == "" {
+			return nil, fmt.Errorf("%s: empty name", k)
+		}
+		fields[k] = v
+	}
+	for _, v := range fields {
+		if _, ok := set[v]; ok {
+			return nil, fmt.Errorf("%s: name used for multiple fields", v)
+		}
+		set[v] = struct{}{}
+	}
+	return fields, nil
+}
+
+func (mw *ManifestWriter) Write(fi FileInfo) error {
+	type param struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	type link struct {
+		File string `json:"file"`
+		Role string `json:"role,omitempty"`
+	}
+	var (
+		params = make([]param, 0, len(fi.Parameters))
+		links  = make([]link, 0, len(fi.Links))
+	)
+	for _, p := range fi.Parameters {
+		params = append(params, param{Name: p.Name, Value: p.Value})
+	}
+	for _, k := range fi.Links {
+		links = append(links, link{File: k.File, Role: k.Role})
+	}
+	rec := map[string]interface{}{
+		mw.names[FieldFile]:       fi.File,
+		mw.names[FieldType]:       fi.Type,
+		mw.names[FieldMime]:       fi.Mime,
+		mw.names[FieldLevel]:      fi.Level,
+		mw.names[FieldSize]:       fi.Size,
+		mw.names[FieldAcqTime]:    fi.AcqTime.Format(time.RFC3339),
+		mw.names[FieldModTime]:    fi.ModTime.Format(time.RFC3339),
+		mw.names[FieldParameters]: params,
+		mw.names[FieldLinks]:      links,
+	}
+	if !fi.Integrity.IsZero() {
+		rec[mw.names[FieldIntegrity]] = fi.Integrity.String()
+	}
+	// the fields only known for some files are left out when they are not set
+	if fi.Model != "" {
+		rec[mw.names[FieldModel]] = fi.Model
+	}
+	if fi.Origin != "" {
+		rec[mw.names[FieldOrigin]] = fi.Origin
+	}
+	if !fi.MsgTime.IsZero() {
+		rec[mw.names[FieldMsgTime]] = fi.MsgTime.Format(time.RFC3339)
+	}
+	return mw.encoder.Encode(rec)
+}
+
+// ExtSidecar is the extension of the sidecar file of a record.
+const ExtSidecar = ".meta"
+
+// WriteSidecar writes fi, as a JSON object in the form written by a
+// ManifestWriter, in the sidecar file of file: a file having the same name
+// followed by ExtSidecar.
+func WriteSidecar(file string, fi FileInfo, names map[string]string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	w, err := os.Create(file + ExtSidecar)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	mw, err := NewManifestWriter(w, names)
+	if err != nil {
+		return err
+	}
+	if err := mw.Write(fi); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// ManifestReader reads the records written by a ManifestWriter.
+type ManifestReader struct {
+	decoder *json.Decoder
+	names   map[string]string
+}
+
+// NewManifestReader creates a ManifestReader reading from r. names should be
+// the same as the one given to the ManifestWriter that wrote the manifest.
+func NewManifestReader(r io.Reader, names map[string]string) (*ManifestReader, error) {
+	fields, err := fieldNames(names)
+	if err != nil {
+		return nil, err
+	}
+	mr := ManifestReader{
+		decoder: json.NewDecoder(r),
+		names:   fields,
+	}
+	return &mr, nil
+}
+
+// Read gives the next record of the manifest. It returns io.EOF when all the
+// records have been read.
+func (mr *ManifestReader) Read() (FileInfo, error) {
+	type param struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+	type link struct {
+		File string `json:"file"`
+		Role string `json:"role"`
+	}
+	var (
+		fi  FileInfo
+		rec map[string]json.RawMessage
+	)
+	if err := mr.decoder.Decode(&rec); err != nil {
+		return fi, err
+	}
+	var (
+		params []param
+		links  []link
+		acq    string
+		mod    string
+		msg    string
+		sum    string
+	)
+	for _, f := range []struct {
+		Name  string
+		Value interface{}
+	}{
+		{Name: FieldFile, Value: &fi.File},
+		{Name: FieldType, Value: &fi.Type},
+		{Name: FieldMime, Value: &fi.Mime},
+		{Name: FieldModel, Value: &fi.Model},
+		{Name: FieldOrigin, Value: &fi.Origin},
+		{Name: FieldLevel, Value: &fi.Level},
+		{Name: FieldSize, Value: &fi.Size},
+		{Name: FieldAcqTime, Value: &acq},
+		{Name: FieldModTime, Value: &mod},
+		{Name: FieldMsgTime, Value: &msg},
+		{Name: FieldIntegrity, Value: &sum},
+		{Name: FieldParameters, Value: &params},
+		{Name: FieldLinks, Value: &links},
+	} {
+		raw, ok := rec[mr.names[f.Name]]
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal(raw, f.Value); err != nil {
+			return fi, fmt.Errorf("%s: %w", f.Name, err)
+		}
+	}
+	var err error
+	if fi.AcqTime, err = parseManifestTime(acq); err != nil {
+		return fi, fmt.Errorf("%s: %w", FieldAcqTime, err)
+	}
+	if fi.ModTime, err = parseManifestTime(mod); err != nil {
+		return fi, fmt.Errorf("%s: %w", FieldModTime, err)
+	}
+	if fi.MsgTime, err = parseManifestTime(msg); err != nil {
+		return fi, fmt.Errorf("%s: %w", FieldMsgTime, err)
+	}
+	if sum = strings.TrimSpace(sum); sum != "" {
+		if fi.Integrity, err = ParseIntegrity(sum); err != nil {
+			return fi, fmt.Errorf("%s: %w", FieldIntegrity, err)
+		}
+	}
+	for _, p := range params {
+		fi.Parameters = append(fi.Parameters, Parameter{Name: p.Name, Value: p.Value})
+	}
+	for _, k := range links {
+		fi.Links = append(fi.Links, Link{File: k.File, Role: k.Role})
+	}
+	return fi, nil
+}
+
+// parseManifestTime parses a time written by a ManifestWriter. An empty string
+// gives the zero time.
+func parseManifestTime(str string) (time.Time, error) {
+	if str == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, str)
+}
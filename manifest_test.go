@@ -0,0 +1,169 @@
+package prospect
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestManifestFields(t *testing.T) {
+	fi := FileInfo{
+		File:       "/data/file.csv",
+		Type:       "data",
+		Mime:       MimeCsv,
+		Level:      1,
+		Size:       10,
+		Integrity:  Integrity{Algorithm: SHA, Encoding: EncodingBase64, Value: sha256Sum("content")},
+		AcqTime:    time.Date(2021, 5, 7, 10, 0, 0, 0, time.UTC),
+		ModTime:    time.Date(2021, 5, 8, 10, 0, 0, 0, time.UTC),
+		Parameters: []Parameter{{Name: "run", Value: "R1"}},
+		Links:      []Link{{File: "/data/other.csv", Role: RoleDuplicate}},
+	}
+	data := []struct {
+		Names   map[string]string
+		Keys    string
+		Invalid bool
+	}{
+		{
+			Keys: "acqtime,file,integrity,level,links,mime,modtime,parameters,size,type",
+		},
+		{
+			Names: map[string]string{FieldIntegrity: "checksum", FieldFile: "path"},
+			Keys:  "acqtime,checksum,level,links,mime,modtime,parameters,path,size,type",
+		},
+		{
+			Names: map[string]string{FieldIntegrity: "digest", FieldSize: "bytes", FieldAcqTime: "time"},
+			Keys:  "bytes,digest,file,level,links,mime,modtime,parameters,time,type",
+		},
+		{Names: map[string]string{"checksum": "sum"}, Invalid: true},
+		{Names: map[string]string{FieldIntegrity: ""}, Invalid: true},
+		{Names: map[string]string{FieldIntegrity: FieldFile}, Invalid: true},
+		{Names: map[string]string{FieldIntegrity: "sum", FieldSize: "sum"}, Invalid: true},
+	}
+	for _, d := range data {
+		var buf bytes.Buffer
+		mw, err := NewManifestWriter(&buf, d.Names)
+		if d.Invalid {
+			if err == nil {
+				t.Errorf("%v: expected an error", d.Names)
+			}
+			if _, err := NewManifestReader(&buf, d.Names); err == nil {
+				t.Errorf("%v: reader: expected an error", d.Names)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: unexpected error: %s", d.Names, err)
+			continue
+		}
+		if err := mw.Write(fi); err != nil {
+			t.Errorf("%v: fail to write record: %s", d.Names, err)
+			continue
+		}
+		var (
+			rec  map[string]json.RawMessage
+			keys []string
+		)
+		if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+			t.Errorf("%v: invalid record: %s", d.Names, err)
+			continue
+		}
+		for k := range rec {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		if got := strings.Join(keys, ","); got != d.Keys {
+			t.Errorf("%v: fields mismatched! want %s, got %s", d.Names, d.Keys, got)
+		}
+
+		mr, _ := NewManifestReader(&buf, d.Names)
+		got, err := mr.Read()
+		if err != nil {
+			t.Errorf("%v: fail to read record: %s", d.Names, err)
+			continue
+		}
+		if got.File != fi.File || got.Size != fi.Size || got.Integrity.String() != fi.Integrity.String() || !got.AcqTime.Equal(fi.AcqTime) {
+			t.Errorf("%v: records mismatched! want %+v, got %+v", d.Names, fi, got)
+		}
+		if len(got.Parameters) != 1 || len(got.Links) != 1 || got.Links[0] != fi.Links[0] {
+			t.Errorf("%v: parameters and links mismatched! got %+v - %+v", d.Names, got.Parameters, got.Links)
+		}
+		if _, err := mr.Read(); err != io.EOF {
+			t.Errorf("%v: expected end of manifest, got %v", d.Names, err)
+		}
+	}
+}
+
+func TestManifestOptionalFields(t *testing.T) {
+	var (
+		when = time.Date(2021, 5, 7, 10, 0, 0, 0, time.UTC)
+		full = FileInfo{
+			File:    "/data/file.csv",
+			Model:   "FM",
+			Origin:  "/incoming/file.csv",
+			AcqTime: when,
+			ModTime: when,
+			MsgTime: time.Date(2021, 5, 6, 8, 0, 0, 0, time.UTC),
+		}
+	)
+	data := []struct {
+		Info  FileInfo
+		Names map[string]string
+		Keys  []string
+	}{
+		{
+			Info: FileInfo{File: "/data/file.csv", AcqTime: when, ModTime: when},
+		},
+		{
+			Info: full,
+			Keys: []string{FieldModel, FieldOrigin, FieldMsgTime},
+		},
+		{
+			Info:  full,
+			Names: map[string]string{FieldModel: "instrument", FieldOrigin: "source", FieldMsgTime: "received"},
+			Keys:  []string{"instrument", "source", "received"},
+		},
+	}
+	for _, d := range data {
+		var buf bytes.Buffer
+		mw, err := NewManifestWriter(&buf, d.Names)
+		if err != nil {
+			t.Fatalf("%v: unexpected error: %s", d.Names, err)
+		}
+		if err := mw.Write(d.Info); err != nil {
+			t.Errorf("%v: fail to write record: %s", d.Names, err)
+			continue
+		}
+		var rec map[string]json.RawMessage
+		if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+			t.Errorf("%v: invalid record: %s", d.Names, err)
+			continue
+		}
+		for _, k := range d.Keys {
+			if _, ok := rec[k]; !ok {
+				t.Errorf("%v: missing field %s", d.Names, k)
+			}
+		}
+		if len(d.Keys) == 0 {
+			for _, k := range []string{FieldModel, FieldOrigin, FieldMsgTime} {
+				if _, ok := rec[k]; ok {
+					t.Errorf("%v: unset field %s written", d.Names, k)
+				}
+			}
+		}
+
+		mr, _ := NewManifestReader(&buf, d.Names)
+		got, err := mr.Read()
+		if err != nil {
+			t.Errorf("%v: fail to read record: %s", d.Names, err)
+			continue
+		}
+		if got.Model != d.Info.Model || got.Origin != d.Info.Origin || !got.MsgTime.Equal(d.Info.MsgTime) {
+			t.Errorf("%v: records mismatched! want %+v, got %+v", d.Names, d.Info, got)
+		}
+	}
+}
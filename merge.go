@@ -0,0 +1,70 @@
+package prospect
+
+// RoleDuplicate is the role of the link to the file of a record merged into
+// another one.
+const RoleDuplicate = "duplicate"
+
+// Merger merges the records having the same integrity: the first record found
+// for a given content is kept and receives the links and the parameters of the
+// following ones, and a link to their files. Records without integrity, or
+// with a partial one, are never merged.
+type Merger struct {
+	index map[string]int
+	infos []FileInfo
+}
+
+func NewMerger() *Merger {
+	return &Merger{
+		index: make(map[string]int),
+	}
+}
+
+// Merge adds fi to the records of m. It reports whether fi has been merged
+// into a record already known.
+func (m *Merger) Merge(fi FileInfo) bool {
+	if fi.Integrity.IsZero() || fi.Integrity.IsPartial() {
+		m.infos = append(m.infos, fi)
+		return false
+	}
+	key := fi.Integrity.String()
+	x, ok := m.index[key]
+	if !ok {
+		m.index[key] = len(m.infos)
+		m.infos = append(m.infos, fi)
+		return false
+	}
+	m.infos[x] = mergeInfo(m.infos[x], fi)
+	return true
+}
+
+// Infos gives the merged records in the order they have been first seen.
+func (m *Merger) Infos() []FileInfo {
+	return m.infos
+}
+
+func mergeInfo(fi, other FileInfo) FileInfo {
+	links := make(map[Link]struct{})
+	for _, k := range fi.Links {
+		links[k] = struct{}{}
+	}
+	dup := Link{File: other.File, Role: RoleDuplicate}
+	for _, k := range append([]Link{dup}, other.Links...) {
+		if _, ok := links[k]; ok || k.File == fi.File {
+			continue
+		}
+		links[k] = struct{}{}
+		fi.Links = append(fi.Links, k)
+	}
+	params := make(map[Parameter]struct{})
+	for _, p := range fi.Parameters {
+		params[p] = struct{}{}
+	}
+	for _, p := range other.Parameters {
+		if _, ok := params[p]; ok {
+			continue
+		}
+		params[p] = struct{}{}
+		fi.Parameters = append(fi.Parameters, p)
+	}
+	return fi
+}
@@ -0,0 +1,69 @@
+package prospect
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMerger(t *testing.T) {
+	var (
+		full    = Integrity{Algorithm: SHA, Encoding: EncodingHex, Value: sha256Sum("content")}
+		other   = Integrity{Algorithm: SHA, Encoding: EncodingHex, Value: sha256Sum("other")}
+		partial = Integrity{Algorithm: SHA, Encoding: EncodingHex, Value: sha256Sum("content"), Prefix: 4}
+	)
+	data := []struct {
+		Name  string
+		Infos []FileInfo
+		Want  []string
+		Links map[string]string
+	}{
+		{
+			Name: "same content",
+			Infos: []FileInfo{
+				{File: "a", Integrity: full},
+				{File: "b", Integrity: other},
+				{File: "c", Integrity: full, Links: []Link{{File: "x", Role: "thread"}}},
+			},
+			Want:  []string{"a", "b"},
+			Links: map[string]string{"a": "c:duplicate,x:thread"},
+		},
+		{
+			Name: "no integrity",
+			Infos: []FileInfo{
+				{File: "a"},
+				{File: "b"},
+			},
+			Want: []string{"a", "b"},
+		},
+		{
+			Name: "partial integrity",
+			Infos: []FileInfo{
+				{File: "a", Integrity: partial},
+				{File: "b", Integrity: partial},
+				{File: "c", Integrity: full},
+			},
+			Want: []string{"a", "b", "c"},
+		},
+	}
+	for _, d := range data {
+		mg := NewMerger()
+		for _, fi := range d.Infos {
+			mg.Merge(fi)
+		}
+		var files []string
+		for _, fi := range mg.Infos() {
+			files = append(files, fi.File)
+
+			var links []string
+			for _, k := range fi.Links {
+				links = append(links, k.File+":"+k.Role)
+			}
+			if got := strings.Join(links, ","); got != d.Links[fi.File] {
+				t.Errorf("%s: %s: links mismatched! want %s, got %s", d.Name, fi.File, d.Links[fi.File], got)
+			}
+		}
+		if got := strings.Join(files, ","); got != strings.Join(d.Want, ",") {
+			t.Errorf("%s: records mismatched! want %s, got %s", d.Name, d.Want, got)
+		}
+	}
+}
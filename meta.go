@@ -1,6 +1,7 @@
 package prospect
 
 import (
+	"bufio"
 	"crypto/md5"
 	"crypto/sha256"
 	"encoding/xml"
@@ -8,9 +9,12 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -27,6 +31,7 @@ const (
 	MimePng   = "image/png"
 	MimeCsv   = "text/csv"
 	MimeGz    = "application/gzip"
+	MimeDir   = "inode/directory"
 
 	TypeCommand    = "command output"
 	TypeImage      = "image"
@@ -35,6 +40,7 @@ const (
 	TypeData       = "data"
 	TypeICN        = "inter console note"
 	TypeParamTable = "parameters table"
+	TypeDirectory  = "directory"
 
 	TypePTH = "Medium Rate Telemetry"
 	TypePDH = "Processed Data"
@@ -42,11 +48,11 @@ const (
 )
 
 const (
-	ptrRef   = "ptr.%d.href"
-	ptrRole  = "ptr.%d.role"
-	fileSize = "file.size"
-	fileMD5  = "file.md5"
+	ptrRef  = "ptr.%d.href"
+	ptrRole = "ptr.%d.role"
+	fileMD5 = "file.md5"
 
+	FileSize     = "file.size"
 	FileDuration = "file.duration"
 	FileRecord   = "file.numrec"
 	FileInvalid  = "file.invalid"
@@ -164,6 +170,9 @@ type Link struct {
 	Role string
 }
 
+// CreateLinkFrom gives a link to the location of d in the archive. The link
+// only refers to the base name of d if its location can not be resolved, the
+// error being reported when d itself is stored.
 func CreateLinkFrom(d Data) Link {
 	file := filepath.Join(d.Resolve(), filepath.Base(d.File))
 	return CreateLink(file, d.Type)
@@ -183,7 +192,11 @@ type Archive struct {
 
 func (a Archive) CreateFile(d Data, buf []byte) (Link, error) {
 	var k Link
-	d.File = filepath.Join(d.Resolve(), filepath.Base(d.File))
+	dir, err := d.ResolveErr()
+	if err != nil {
+		return k, fmt.Errorf("%s: %w", d.File, err)
+	}
+	d.File = filepath.Join(dir, filepath.Base(d.File))
 	if err := a.storeFile(d, buf); err != nil {
 		return k, err
 	}
@@ -193,7 +206,11 @@ func (a Archive) CreateFile(d Data, buf []byte) (Link, error) {
 }
 
 func (a Archive) Store(d Data) error {
-	file := filepath.Join(d.Resolve(), filepath.Base(d.File))
+	dir, err := d.ResolveErr()
+	if err != nil {
+		return fmt.Errorf("%s: %w", d.File, err)
+	}
+	file := filepath.Join(dir, filepath.Base(d.File))
 	if err := a.storeLink(d, file); err != nil {
 		return err
 	}
@@ -255,7 +272,100 @@ type Context struct {
 	Increments []Increment `toml:"increment"`
 	Metadata   []Parameter
 
-	RelativeRoot string `toml:"relative-root"`
+	RelativeRoot string            `toml:"relative-root"`
+	Aliases      map[string]string `toml:"source-alias"`
+	LevelZero    string            `toml:"level-zero"`
+	Lookups      Lookups           `toml:"lookup"`
+	ModelFamily  Regexp            `toml:"model-family"`
+	FiscalStart  int               `toml:"fiscal-start"`
+	Epoch        time.Time         `toml:"epoch"`
+	Batch        string            `toml:"batch"`
+	Mission      string            `toml:"mission"`
+	Version      string            `toml:"version"`
+}
+
+// Regexp is a regular expression that can be decoded from a string.
+type Regexp struct {
+	*regexp.Regexp
+}
+
+func (r *Regexp) Set(str string) error {
+	x, err := regexp.Compile(str)
+	if err == nil {
+		r.Regexp = x
+	}
+	return err
+}
+
+// Lookups are the tables of the lookup element indexed by their name. The
+// tables are not typed so that they can be decoded from the [lookup.<name>]
+// tables of a configuration file: a table is either a map[string]string or a
+// map of values formatted with fmt.
+type Lookups map[string]interface{}
+
+// Table gives the table registered under name (or under name in lower case)
+// or nil if there is none.
+func (ls Lookups) Table(name string) map[string]string {
+	t, ok := ls[name]
+	if !ok {
+		t = ls[strings.ToLower(name)]
+	}
+	var vs map[string]interface{}
+	switch t := t.(type) {
+	case map[string]string:
+		return t
+	case Lookups:
+		vs = t
+	case map[string]interface{}:
+		vs = t
+	default:
+		return nil
+	}
+	table := make(map[string]string, len(vs))
+	for k, v := range vs {
+		table[k] = fmt.Sprintf("%v", v)
+	}
+	return table
+}
+
+// Size is a number of bytes that can be decoded from a human readable string
+// like 10KB or 1MiB. KB, MB and GB are multiple of 1000; KiB, MiB and GiB of
+// 1024. A number without unit is a number of bytes.
+type Size int64
+
+func (s *Size) Set(str string) error {
+	var (
+		x    = strings.IndexFunc(str, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+		unit string
+	)
+	if x >= 0 {
+		str, unit = str[:x], strings.TrimSpace(str[x:])
+	}
+	n, err := strconv.ParseFloat(str, 64)
+	if err != nil {
+		return err
+	}
+	var mul float64
+	switch strings.ToUpper(unit) {
+	case "", "B":
+		mul = 1
+	case "K", "KB":
+		mul = 1e3
+	case "M", "MB":
+		mul = 1e6
+	case "G", "GB":
+		mul = 1e9
+	case "KIB":
+		mul = 1 << 10
+	case "MIB":
+		mul = 1 << 20
+	case "GIB":
+		mul = 1 << 30
+	default:
+		return fmt.Errorf("%s: unknown unit", unit)
+	}
+	*s = Size(n * mul)
+	return nil
 }
 
 func (c Context) Update(d Data) Data {
@@ -271,6 +381,33 @@ func (c Context) Update(d Data) Data {
 	if d.Owner == "" {
 		d.Owner = c.Owner
 	}
+	if d.Aliases == nil {
+		d.Aliases = c.Aliases
+	}
+	if d.LevelZero == "" {
+		d.LevelZero = c.LevelZero
+	}
+	if d.Lookups == nil {
+		d.Lookups = c.Lookups
+	}
+	if d.ModelFamily.Regexp == nil {
+		d.ModelFamily = c.ModelFamily
+	}
+	if d.FiscalStart == 0 {
+		d.FiscalStart = c.FiscalStart
+	}
+	if d.Epoch.IsZero() {
+		d.Epoch = c.Epoch
+	}
+	if d.Batch == "" {
+		d.Batch = c.Batch
+	}
+	if d.Mission == "" {
+		d.Mission = c.Mission
+	}
+	if d.Version == "" {
+		d.Version = c.Version
+	}
 	d.Parameters = append(d.Parameters, c.Metadata...)
 	d.relativeRoot = c.RelativeRoot
 	return c.update(d)
@@ -303,14 +440,29 @@ type Data struct {
 	File       string
 	ModTime    time.Time
 	AcqTime    time.Time
+	MsgTime    time.Time `toml:"-"`
+	Origin     string    `toml:"-"`
 	Archive    Pattern
+	Components []Component `toml:"archive-path"`
+	Require    []string    `toml:"require"`
+	PatternOptions
 
 	Mimes    MimeSet `toml:"mimetype"`
 	TimeFunc `toml:"timefunc"`
 	Link     string
-
-	Parameters []Parameter `toml:"metadata"`
-	Links      []Link      `toml:"links"`
+	Sniff    bool `toml:"sniff-mime"`
+
+	Parameters  []Parameter       `toml:"metadata"`
+	Links       []Link            `toml:"links"`
+	Aliases     map[string]string `toml:"source-alias"`
+	LevelZero   string            `toml:"level-zero"`
+	Lookups     Lookups           `toml:"lookup"`
+	ModelFamily Regexp            `toml:"model-family"`
+	FiscalStart int               `toml:"fiscal-start"`
+	Epoch       time.Time         `toml:"epoch"`
+	Batch       string            `toml:"batch"`
+	Mission     string            `toml:"mission"`
+	Version     string            `toml:"version"`
 
 	Size         int64
 	MD5          string
@@ -334,7 +486,14 @@ func ReadFile(d *Data, file string) error {
 			d.Mime = m.Mime
 		}
 	}
-	if err = ReadFrom(d, r); err != nil {
+	if d.Mime == "" && d.Sniff {
+		rs := bufio.NewReader(r)
+		d.Mime = sniffMime(rs)
+		err = ReadFrom(d, rs)
+	} else {
+		err = ReadFrom(d, r)
+	}
+	if err != nil {
 		return err
 	}
 	if d.AcqTime.IsZero() {
@@ -350,6 +509,19 @@ func ReadFile(d *Data, file string) error {
 	return nil
 }
 
+// sniffMime detects the mime type of the content of r without consuming it.
+// The parameters of the mime type are discarded.
+func sniffMime(r *bufio.Reader) string {
+	buf, _ := r.Peek(sniffLen)
+	mime := http.DetectContentType(buf)
+	if x := strings.IndexByte(mime, ';'); x >= 0 {
+		mime = mime[:x]
+	}
+	return mime
+}
+
+const sniffLen = 512
+
 func ReadFrom(d *Data, r io.Reader) error {
 	var (
 		sumSHA = sha256.New()
@@ -398,11 +570,21 @@ func (d *Data) Register(name string, value interface{}) {
 	d.Parameters = append(d.Parameters, p)
 }
 
+// Resolve gives the directory of d in the archive. An empty pattern gives the
+// root of the archive. A pattern that can not be resolved gives an empty
+// string: ResolveErr should be used to get the location of a file to store.
 func (d Data) Resolve() string {
-	if d.Archive.Resolver == nil {
-		return ""
+	dir, _ := d.ResolveErr()
+	return dir
+}
+
+// ResolveErr gives the directory of d in the archive or the reason why it can
+// not be resolved (see Pattern.ResolveErr).
+func (d Data) ResolveErr() (string, error) {
+	if d.Archive.IsEmpty() {
+		return "", nil
 	}
-	return d.Archive.Resolve(d)
+	return d.Archive.ResolveErr(d)
 }
 
 func (d Data) Accept(file string) bool {
@@ -462,7 +644,7 @@ func (d Data) MarshalXML(e *xml.Encoder, s xml.StartElement) error {
 		}
 	}
 	if d.Size > 0 {
-		d.Parameters = append(d.Parameters, MakeParameter(fileSize, d.Size))
+		d.Parameters = append(d.Parameters, MakeParameter(FileSize, d.Size))
 	}
 	if d.MD5 != "" {
 		d.Parameters = append(d.Parameters, MakeParameter(fileMD5, d.MD5))
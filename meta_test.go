@@ -0,0 +1,153 @@
+package prospect
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/midbel/toml"
+)
+
+func TestArchiveCreateFile(t *testing.T) {
+	data := []struct {
+		Pattern string
+		Model   string
+		Want    string
+		Err     error
+	}{
+		{Pattern: "{source}/{model}/{year}", Model: "FM", Want: "Src/FM/2021/file.dat"},
+		{Pattern: "{source}/{model}/{year}", Err: ErrEmpty},
+		{Pattern: "{source}/{model?}/{year}", Want: "Src/2021/file.dat"},
+		{Pattern: "{source}/{model!required}", Err: ErrEmpty},
+		{Pattern: "", Want: "file.dat"},
+	}
+	for _, d := range data {
+		p, err := NewPattern(d.Pattern)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Pattern, err)
+			continue
+		}
+		var (
+			dir = t.TempDir()
+			a   = Archive{
+				DataDir: filepath.Join(dir, "data"),
+				MetaDir: filepath.Join(dir, "meta"),
+			}
+			dat = Data{
+				File:    "/tmp/file.dat",
+				Source:  "src",
+				Model:   d.Model,
+				AcqTime: time.Date(2021, 5, 3, 0, 0, 0, 0, time.UTC),
+				Archive: p,
+			}
+		)
+		k, err := a.CreateFile(dat, []byte("content"))
+		if d.Err != nil {
+			if !errors.Is(err, d.Err) {
+				t.Errorf("%s: expected error %v, got %v", d.Pattern, d.Err, err)
+			}
+			if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) > 0 {
+				t.Errorf("%s: unexpected files written: %s", d.Pattern, files)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Pattern, err)
+			continue
+		}
+		if k.File != d.Want {
+			t.Errorf("%s: paths mismatched! want %s, got %s", d.Pattern, d.Want, k.File)
+		}
+		if _, err := os.Stat(filepath.Join(a.DataDir, d.Want)); err != nil {
+			t.Errorf("%s: file not written: %s", d.Pattern, err)
+		}
+		if _, err := os.Stat(filepath.Join(a.MetaDir, d.Want+".xml")); err != nil {
+			t.Errorf("%s: metadata not written: %s", d.Pattern, err)
+		}
+	}
+}
+
+func TestReadFileSniff(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		png  = filepath.Join(dir, "image")
+		csv  = filepath.Join(dir, "data.csv")
+		body = []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	)
+	if err := os.WriteFile(png, body, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(csv, body, 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPattern("{format?}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []struct {
+		File   string
+		Sniff  bool
+		Mimes  MimeSet
+		Mime   string
+		Format string
+	}{
+		{File: png},
+		{File: png, Sniff: true, Mime: "image/png", Format: "Png"},
+		{File: csv, Sniff: true, Mimes: MimeSet{{Extensions: []string{".csv"}, Mime: "text/csv"}}, Mime: "text/csv", Format: "Csv"},
+	}
+	for _, d := range data {
+		dat := Data{Sniff: d.Sniff, Mimes: d.Mimes}
+		if err := ReadFile(&dat, d.File); err != nil {
+			t.Errorf("%s: unexpected error: %s", d.File, err)
+			continue
+		}
+		if dat.Mime != d.Mime {
+			t.Errorf("%s (sniff: %t): mime types mismatched! want %q, got %q", d.File, d.Sniff, d.Mime, dat.Mime)
+		}
+		if got := p.Resolve(dat); got != d.Format {
+			t.Errorf("%s (sniff: %t): formats mismatched! want %q, got %q", d.File, d.Sniff, d.Format, got)
+		}
+		if want := int64(len(body)); dat.Size != want {
+			t.Errorf("%s: sizes mismatched! want %d, got %d", d.File, want, dat.Size)
+		}
+	}
+}
+
+func TestDecodeLookups(t *testing.T) {
+	const config = `
+[lookup.type]
+document = "docs"
+image    = "pictures"
+
+[lookup.source]
+hrd = "high-rate"
+`
+	var c Context
+	if err := toml.Decode(strings.NewReader(config), &c); err != nil {
+		t.Fatalf("fail to decode lookup tables: %s", err)
+	}
+	data := []struct {
+		Pattern string
+		Data    Data
+		Want    string
+	}{
+		{Pattern: "{lookup:type}", Data: Data{Type: "image"}, Want: "pictures"},
+		{Pattern: "{lookup:type}", Data: Data{Type: "Document"}, Want: "docs"},
+		{Pattern: "{lookup:type}", Data: Data{Type: "video"}, Want: ""},
+		{Pattern: "{lookup:type||'other'}", Data: Data{Type: "video"}, Want: "other"},
+		{Pattern: "{lookup:source}_{lookup:type}", Data: Data{Type: "image", Source: "HRD"}, Want: "high-rate_pictures"},
+	}
+	for _, d := range data {
+		p, err := NewPattern(d.Pattern)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Pattern, err)
+			continue
+		}
+		if got := p.Resolve(c.Update(d.Data)); got != d.Want {
+			t.Errorf("%s: values mismatched! want %q, got %q", d.Pattern, d.Want, got)
+		}
+	}
+}
@@ -0,0 +1,540 @@
+package prospect
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrDone = errors.New("done")
+	ErrSkip = errors.New("skip")
+)
+
+const MD5 = "MD5"
+
+// SkipError is returned by a Module to skip a record for a given reason. It
+// matches ErrSkip with errors.Is.
+type SkipError struct {
+	Reason string
+}
+
+func Skip(reason string) error {
+	return SkipError{Reason: reason}
+}
+
+func (e SkipError) Error() string {
+	return fmt.Sprintf("%s: %s", ErrSkip, e.Reason)
+}
+
+func (e SkipError) Is(err error) bool {
+	return err == ErrSkip
+}
+
+type Module interface {
+	Process() (FileInfo, error)
+	fmt.Stringer
+}
+
+// BatchModule is implemented by the modules that can return multiple related
+// records at once. Drivers should prefer ProcessBatch over Process when it is
+// available.
+type BatchModule interface {
+	Module
+	ProcessBatch() ([]FileInfo, error)
+}
+
+// ProgressModule is implemented by the modules that can report how much of
+// their input they have already processed. The unit of done and total is
+// chosen by the module (bytes, messages,...); total is zero when it is unknown.
+type ProgressModule interface {
+	Module
+	SetProgress(func(done, total int64))
+}
+
+// WatermarkModule is implemented by the modules that only process the files
+// modified after a given time. Watermark gives the latest modification time of
+// the files already processed so that the caller can pass it to the next run.
+type WatermarkModule interface {
+	Module
+	Watermark() time.Time
+}
+
+// Run gives to sink the records returned by m until m is done. ProcessBatch is
+// used if m is a BatchModule. Skipped records are discarded while any other
+// error, including the ones returned by sink, stops Run.
+func Run(m Module, sink func(FileInfo) error) error {
+	r := Runner{FailFast: true}
+	return r.Run(m, sink)
+}
+
+// Runner gives to a sink the records returned by a module. With FailFast, the
+// first error that is neither ErrDone nor ErrSkip stops the run. Otherwise the
+// errors are reported to Logger and counted, and the run goes on with the next
+// record. Skipped records are counted in both modes.
+//
+// With Sidecar, a sidecar file (see WriteSidecar) is written for each record
+// accepted by the sink next to its location in the archive: the directory given
+// by Archive under Root. The sidecar is written next to the file of the record
+// if Archive is empty. A record whose location can not be resolved is an
+// error.
+type Runner struct {
+	FailFast bool
+	Logger   Logger
+
+	Merge   bool
+	Sidecar bool
+	Root    string
+	Archive Pattern
+	Fields  map[string]string
+
+	// Summary, if set, tallies the records stored, the records skipped and
+	// the errors of the run.
+	Summary *Summary
+
+	errors  int
+	skipped int
+}
+
+// NewRunner creates a Runner with the fail-fast, merge, sidecar, archive and
+// fields options and the Logger of cfg.
+func NewRunner(cfg Config) *Runner {
+	return &Runner{
+		FailFast: cfg.FailFast,
+		Logger:   cfg.Log(),
+		Merge:    cfg.Merge,
+		Sidecar:  cfg.Sidecar,
+		Root:     cfg.DataDir,
+		Archive:  cfg.Archive,
+		Fields:   cfg.Fields,
+		Summary:  NewSummary(),
+	}
+}
+
+// Errors gives the number of errors that did not stop the run.
+func (r *Runner) Errors() int {
+	return r.errors
+}
+
+// Skipped gives the number of records skipped by the module.
+func (r *Runner) Skipped() int {
+	return r.skipped
+}
+
+// Run gives to sink the records returned by m until m is done. ProcessBatch is
+// used if m is a BatchModule: the records returned with an error are given to
+// sink before the error is handled. If Merge is set, the records are merged
+// (see Merger) and given to sink once the run is over.
+func (r *Runner) Run(m Module, sink func(FileInfo) error) error {
+	if !r.Merge {
+		return r.run(m, func(fi FileInfo) error {
+			return r.store(fi, sink)
+		})
+	}
+	mg := NewMerger()
+	err := r.run(m, func(fi FileInfo) error {
+		mg.Merge(fi)
+		return nil
+	})
+	for _, fi := range mg.Infos() {
+		if e := r.store(fi, sink); e != nil {
+			if err == nil {
+				err = e
+			}
+			break
+		}
+	}
+	return err
+}
+
+func (r *Runner) run(m Module, put func(FileInfo) error) error {
+	next := func() ([]FileInfo, error) {
+		fi, err := m.Process()
+		if err != nil {
+			return nil, err
+		}
+		return []FileInfo{fi}, nil
+	}
+	if b, ok := m.(BatchModule); ok {
+		next = b.ProcessBatch
+	}
+	for {
+		infos, err := next()
+		for _, fi := range infos {
+			if err := put(fi); err != nil {
+				return err
+			}
+		}
+		if err != nil {
+			r.update(FileInfo{}, err)
+		}
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrDone):
+			return nil
+		case errors.Is(err, ErrSkip):
+			r.skipped++
+		default:
+			if err = r.fail(fmt.Errorf("%s: %w", m, err)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// store gives fi to sink and writes its sidecar. The error is only returned if
+// it should stop the run.
+func (r *Runner) store(fi FileInfo, sink func(FileInfo) error) error {
+	err := sink(fi)
+	if err == nil && r.Sidecar {
+		var file string
+		if file, err = r.location(fi); err == nil {
+			err = WriteSidecar(file, fi, r.Fields)
+		}
+	}
+	r.update(fi, err)
+	if err != nil {
+		return r.fail(err)
+	}
+	return nil
+}
+
+func (r *Runner) update(fi FileInfo, err error) {
+	if r.Summary != nil {
+		r.Summary.Update(fi, err)
+	}
+}
+
+// location gives the location of fi in the archive.
+func (r *Runner) location(fi FileInfo) (string, error) {
+	if r.Archive.IsEmpty() {
+		return fi.File, nil
+	}
+	dir, err := r.Archive.ResolveErr(DataFromFileInfo(fi))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", fi.File, err)
+	}
+	return filepath.Join(r.Root, dir, filepath.Base(fi.File)), nil
+}
+
+func (r *Runner) fail(err error) error {
+	if r.FailFast {
+		return err
+	}
+	r.errors++
+	if r.Logger != nil {
+		r.Logger.Error("record not processed", "error", err)
+	}
+	return nil
+}
+
+type Factory func(Config) (Module, error)
+
+var (
+	modmu   sync.Mutex
+	modules = make(map[string]Factory)
+)
+
+// Register makes a module available under the given name. It panics if
+// factory is nil or if a module is already registered with the same name.
+func Register(name string, factory Factory) {
+	modmu.Lock()
+	defer modmu.Unlock()
+
+	if factory == nil {
+		panic("prospect: nil factory for module " + name)
+	}
+	if _, ok := modules[name]; ok {
+		panic("prospect: module " + name + " already registered")
+	}
+	modules[name] = factory
+}
+
+// NewModule creates the module registered under the given name. Its calls to
+// Process are limited by the RateLimit of cfg.
+func NewModule(name string, cfg Config) (Module, error) {
+	modmu.Lock()
+	factory, ok := modules[name]
+	modmu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%s: unknown module", name)
+	}
+	m, err := factory(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.RateLimit.Limit(m), nil
+}
+
+// Logger receives the events reported by the modules while they process their
+// input. args are pairs of keys and values. A *slog.Logger can be used as is.
+type Logger interface {
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+type discard struct{}
+
+func (discard) Info(string, ...interface{})  {}
+func (discard) Warn(string, ...interface{})  {}
+func (discard) Error(string, ...interface{}) {}
+
+type Config struct {
+	Module    string
+	Location  string
+	Config    string
+	Type      string
+	Level     int
+	Integrity string
+	Encoding  string
+	// Fields renames the fields of the records written by a ManifestWriter.
+	Fields map[string]string
+	// Merge asks the drivers to register only once the records having the
+	// same content (see Merger and Runner).
+	Merge bool
+	// Logger, if set, receives the events reported by the module.
+	Logger Logger `toml:"-"`
+	// BatchID identifies the run. It defaults to DefaultBatchID.
+	BatchID string `toml:"batch"`
+	// RateLimit limits the number of records a module can process per
+	// second (see RateLimit.Limit).
+	RateLimit RateLimit `toml:"rate-limit"`
+	// Mission is the name of the mission or of the spacecraft the records
+	// belong to.
+	Mission string
+	// Version is the version of the processing that has produced the
+	// records (eg: v3).
+	Version string
+	// FailFast asks the drivers to stop at the first error instead of
+	// reporting it and going on with the next record (see Runner).
+	FailFast bool `toml:"fail-fast"`
+	// HashPrefix, if set, limits the digests computed by Digest and
+	// NewDigester to the given number of bytes at the beginning of the files.
+	HashPrefix Size `toml:"hash-prefix"`
+	// Sidecar asks the drivers to write the metadata of each record next to
+	// its file (see Runner).
+	Sidecar bool
+	// Archive gives the location of the records in the archive whose
+	// directory is DataDir (see Runner).
+	Archive Pattern
+	DataDir string
+	// Timezone is the zone of the times read by the modules that do not have
+	// zone information (see ParseTime). It defaults to UTC.
+	Timezone Location `toml:"assume-timezone"`
+}
+
+// DefaultBatchID is the identifier of the current run when none is given: the
+// time, in UTC, when the program has started followed by a random suffix since
+// several runs can start within the same second.
+var DefaultBatchID = newBatchID()
+
+func newBatchID() string {
+	var (
+		now = time.Now().UTC()
+		buf = make([]byte, 4)
+	)
+	if _, err := rand.Read(buf); err != nil {
+		binary.BigEndian.PutUint32(buf, uint32(now.Nanosecond()))
+	}
+	return now.Format("20060102T150405") + "-" + hex.EncodeToString(buf)
+}
+
+// Batch gives the identifier of the run.
+func (c Config) Batch() string {
+	if c.BatchID == "" {
+		return DefaultBatchID
+	}
+	return c.BatchID
+}
+
+// Log gives the Logger of c or a Logger discarding all events if it is not
+// set.
+func (c Config) Log() Logger {
+	if c.Logger == nil {
+		return discard{}
+	}
+	return c.Logger
+}
+
+// Algorithm gives the name of the algorithm of the hash returned by Hash.
+func (c Config) Algorithm() string {
+	if strings.ToUpper(c.Integrity) == MD5 {
+		return MD5
+	}
+	return SHA
+}
+
+// ParseTime parses str with layout in the configured time zone if str has no
+// zone information.
+func (c Config) ParseTime(layout, str string) (time.Time, error) {
+	return ParseTime(layout, str, c.Timezone.Location)
+}
+
+// ParseTimeAny parses str with the first of layouts matching it (see
+// ParseTime). TimeLayouts are used if no layout is given.
+func (c Config) ParseTimeAny(str string, layouts ...string) (time.Time, error) {
+	if len(layouts) == 0 {
+		layouts = TimeLayouts
+	}
+	var (
+		when time.Time
+		err  error
+	)
+	for _, layout := range layouts {
+		if when, err = c.ParseTime(layout, str); err == nil {
+			break
+		}
+	}
+	return when, err
+}
+
+// Digest computes the digest of r with the configured algorithm and encoding.
+// Only the first HashPrefix bytes of r are hashed if it is set: the digest is
+// then marked as partial if r is longer.
+func (c Config) Digest(r io.Reader) (Integrity, error) {
+	var (
+		d   = c.NewDigester()
+		err error
+	)
+	if c.HashPrefix > 0 {
+		// one more byte is read to know if r is longer than the prefix
+		_, err = io.CopyN(d, r, int64(c.HashPrefix)+1)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+	} else {
+		_, err = io.Copy(d, r)
+	}
+	if err != nil {
+		return Integrity{}, err
+	}
+	return d.Integrity(), nil
+}
+
+// NewDigester creates a Digester with the configured algorithm, encoding and
+// hash prefix.
+func (c Config) NewDigester() *Digester {
+	return &Digester{
+		hash:      c.Hash(),
+		algorithm: c.Algorithm(),
+		encoding:  c.Encoding,
+		prefix:    int64(c.HashPrefix),
+	}
+}
+
+// Digester computes the digest of the bytes written to it. It can be used
+// with an io.MultiWriter to compute the digest of a file while it is written.
+// If prefix is set, only the first prefix bytes are hashed but all the bytes
+// written are accepted.
+type Digester struct {
+	hash      hash.Hash
+	algorithm string
+	encoding  string
+	prefix    int64
+	written   int64
+}
+
+func (d *Digester) Write(b []byte) (int, error) {
+	n := len(b)
+	if d.prefix > 0 {
+		if d.written >= d.prefix {
+			d.written += int64(n)
+			return n, nil
+		}
+		if max := d.prefix - d.written; int64(len(b)) > max {
+			b = b[:max]
+		}
+	}
+	d.written += int64(n)
+	d.hash.Write(b)
+	return n, nil
+}
+
+// Reset discards the bytes written so that the Digester can be used for
+// another file.
+func (d *Digester) Reset() {
+	d.hash.Reset()
+	d.written = 0
+}
+
+// Integrity gives the digest of the bytes written. It is marked as partial if
+// more bytes than the prefix have been written.
+func (d *Digester) Integrity() Integrity {
+	i := NewIntegrity(d.algorithm, d.hash.Sum(nil))
+	if d.encoding != "" {
+		i.Encoding = d.encoding
+	}
+	if d.prefix > 0 && d.written > d.prefix {
+		i.Prefix = d.prefix
+	}
+	return i
+}
+
+func (c Config) Hash() hash.Hash {
+	switch strings.ToUpper(c.Integrity) {
+	case MD5:
+		return md5.New()
+	default:
+		return sha256.New()
+	}
+}
+
+type FileInfo struct {
+	File      string
+	Type      string
+	Mime      string
+	Model     string
+	Level     int
+	Integrity Integrity
+	Size      int64
+	AcqTime   time.Time
+	ModTime   time.Time
+	MsgTime   time.Time // date of the message a file has been extracted from
+	Origin    string    // original location (path or URL) of the file
+
+	Parameters []Parameter
+	Links      []Link
+
+	// Container is set for the records describing a directory.
+	Container bool
+}
+
+// DataFromFileInfo gives the Data describing the same file as fi so that it can
+// be used to resolve a Pattern. The fields that are not known by a FileInfo
+// (source, owner,...) are left empty and can be given by a Context.
+func DataFromFileInfo(fi FileInfo) Data {
+	d := Data{
+		File:    fi.File,
+		Type:    fi.Type,
+		Mime:    fi.Mime,
+		Model:   fi.Model,
+		Level:   fi.Level,
+		Size:    fi.Size,
+		AcqTime: fi.AcqTime,
+		ModTime: fi.ModTime,
+		MsgTime: fi.MsgTime,
+		Origin:  fi.Origin,
+	}
+	if !fi.Integrity.IsZero() {
+		d.Integrity = fi.Integrity.Algorithm
+		d.Sum = hex.EncodeToString(fi.Integrity.Value)
+		if strings.ToUpper(d.Integrity) == MD5 {
+			d.MD5 = d.Sum
+		}
+	}
+	d.Parameters = append(d.Parameters, fi.Parameters...)
+	d.Links = append(d.Links, fi.Links...)
+	return d
+}
@@ -0,0 +1,579 @@
+package prospect
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// result is one of the results returned by a scripted module.
+type result struct {
+	Files []string
+	Infos []FileInfo
+	Err   error
+}
+
+// script is a module returning a predefined sequence of results.
+type script struct {
+	results []result
+}
+
+func (s *script) String() string {
+	return "script"
+}
+
+func (s *script) Process() (FileInfo, error) {
+	infos, err := s.ProcessBatch()
+	if len(infos) == 0 {
+		return FileInfo{}, err
+	}
+	return infos[0], err
+}
+
+func (s *script) ProcessBatch() ([]FileInfo, error) {
+	if len(s.results) == 0 {
+		return nil, ErrDone
+	}
+	r := s.results[0]
+	s.results = s.results[1:]
+
+	infos := append([]FileInfo{}, r.Infos...)
+	for _, f := range r.Files {
+		infos = append(infos, FileInfo{File: f})
+	}
+	return infos, r.Err
+}
+
+func TestRunnerRun(t *testing.T) {
+	errFail := errors.New("fail")
+
+	results := []result{
+		{Files: []string{"a", "b"}},
+		{Err: Skip("empty")},
+		{Files: []string{"c"}, Err: errFail},
+		{Err: errFail},
+		{Files: []string{"d"}},
+	}
+	data := []struct {
+		FailFast bool
+		Files    string
+		Errors   int
+		Skipped  int
+		Err      error
+	}{
+		{FailFast: true, Files: "a,b,c", Skipped: 1, Err: errFail},
+		{FailFast: false, Files: "a,b,c,d", Errors: 2, Skipped: 1},
+	}
+	for _, d := range data {
+		var (
+			files []string
+			s     = script{results: append([]result{}, results...)}
+			r     = Runner{FailFast: d.FailFast}
+		)
+		err := r.Run(&s, func(fi FileInfo) error {
+			files = append(files, fi.File)
+			return nil
+		})
+		if !errors.Is(err, d.Err) {
+			t.Errorf("fail-fast(%t): expected error %v, got %v", d.FailFast, d.Err, err)
+		}
+		if got := strings.Join(files, ","); got != d.Files {
+			t.Errorf("fail-fast(%t): records mismatched! want %s, got %s", d.FailFast, d.Files, got)
+		}
+		if r.Errors() != d.Errors {
+			t.Errorf("fail-fast(%t): errors mismatched! want %d, got %d", d.FailFast, d.Errors, r.Errors())
+		}
+		if r.Skipped() != d.Skipped {
+			t.Errorf("fail-fast(%t): skipped mismatched! want %d, got %d", d.FailFast, d.Skipped, r.Skipped())
+		}
+	}
+}
+
+func TestRunnerSummary(t *testing.T) {
+	errFail := errors.New("fail")
+	data := []struct {
+		Name    string
+		Results []result
+		Sink    error
+		Want    Summary
+	}{
+		{
+			Name: "processed",
+			Results: []result{
+				{Infos: []FileInfo{{File: "a", Type: "data", Size: 10}, {File: "b", Type: "image", Size: 5, Level: 1}}},
+			},
+			Want: Summary{
+				Processed: 2,
+				Bytes:     15,
+				Types:     map[string]int{"data": 1, "image": 1},
+				Levels:    map[int]int{0: 1, 1: 1},
+			},
+		},
+		{
+			Name: "skipped and failed",
+			Results: []result{
+				{Err: Skip("empty")},
+				{Err: ErrSkip},
+				{Infos: []FileInfo{{File: "a", Type: "data", Size: 10}}, Err: errFail},
+			},
+			Want: Summary{
+				Processed: 1,
+				Bytes:     10,
+				Skipped:   map[string]int{"empty": 1, reasonUnknown: 1},
+				Errors:    1,
+				Types:     map[string]int{"data": 1},
+				Levels:    map[int]int{0: 1},
+			},
+		},
+		{
+			Name: "sink error",
+			Results: []result{
+				{Infos: []FileInfo{{File: "a", Type: "data", Size: 10}}},
+			},
+			Sink: errFail,
+			Want: Summary{Errors: 1},
+		},
+	}
+	for _, d := range data {
+		var (
+			s = script{results: d.Results}
+			r = NewRunner(Config{})
+		)
+		r.Run(&s, func(FileInfo) error { return d.Sink })
+
+		got := r.Summary
+		if got.Processed != d.Want.Processed || got.Errors != d.Want.Errors || got.Bytes != d.Want.Bytes {
+			t.Errorf("%s: summary mismatched! want %+v, got %+v", d.Name, d.Want, *got)
+		}
+		// fmt prints the maps sorted by keys
+		for _, c := range []struct {
+			Want, Got interface{}
+		}{
+			{Want: d.Want.Skipped, Got: got.Skipped},
+			{Want: d.Want.Types, Got: got.Types},
+			{Want: d.Want.Levels, Got: got.Levels},
+		} {
+			if fmt.Sprint(c.Want) != fmt.Sprint(c.Got) {
+				t.Errorf("%s: summary mismatched! want %v, got %v", d.Name, c.Want, c.Got)
+			}
+		}
+	}
+}
+
+func TestRunnerMerge(t *testing.T) {
+	var (
+		full    = Integrity{Algorithm: SHA, Encoding: EncodingHex, Value: sha256Sum("content")}
+		errFail = errors.New("fail")
+	)
+	data := []struct {
+		Merge    bool
+		FailFast bool
+		Files    string
+		Err      error
+	}{
+		{Merge: false, Files: "a,b,c"},
+		{Merge: true, Files: "a,c"},
+		{Merge: true, FailFast: true, Files: "a,c", Err: errFail},
+	}
+	for _, d := range data {
+		var (
+			files []string
+			s     = script{results: []result{
+				{Infos: []FileInfo{{File: "a", Integrity: full}, {File: "b", Integrity: full}}},
+				{Files: []string{"c"}, Err: errFail},
+			}}
+			r = NewRunner(Config{Merge: d.Merge, FailFast: d.FailFast})
+		)
+		err := r.Run(&s, func(fi FileInfo) error {
+			files = append(files, fi.File)
+			return nil
+		})
+		if !errors.Is(err, d.Err) {
+			t.Errorf("merge(%t): expected error %v, got %v", d.Merge, d.Err, err)
+		}
+		if got := strings.Join(files, ","); got != d.Files {
+			t.Errorf("merge(%t): records mismatched! want %s, got %s", d.Merge, d.Files, got)
+		}
+	}
+}
+
+func TestRunnerSinkError(t *testing.T) {
+	for _, failfast := range []bool{true, false} {
+		var (
+			s = script{results: []result{{Files: []string{"a", "b", "c"}}}}
+			r = Runner{FailFast: failfast}
+			n int
+		)
+		err := r.Run(&s, func(fi FileInfo) error {
+			if fi.File == "b" {
+				return fmt.Errorf("%s: not stored", fi.File)
+			}
+			n++
+			return nil
+		})
+		switch {
+		case failfast && (err == nil || n != 1):
+			t.Errorf("fail-fast: run should stop at the first sink error (%d records, %v)", n, err)
+		case !failfast && (err != nil || n != 2 || r.Errors() != 1):
+			t.Errorf("run should go on after a sink error (%d records, %d errors, %v)", n, r.Errors(), err)
+		}
+	}
+}
+
+func TestRunnerSidecar(t *testing.T) {
+	archive, err := NewPattern("{type}/{year}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		when = time.Date(2021, 1, 4, 10, 0, 0, 0, time.UTC)
+		file = filepath.Join(t.TempDir(), "maildir", "data.csv")
+	)
+	data := []struct {
+		Type string
+		Want string
+		Err  error
+	}{
+		{Type: "data", Want: filepath.Join("Data", "2021", "data.csv"+ExtSidecar)},
+		{Type: "", Err: ErrEmpty},
+	}
+	for _, d := range data {
+		var (
+			root = t.TempDir()
+			fi   = FileInfo{
+				File:    file,
+				Type:    d.Type,
+				Mime:    MimeCsv,
+				Size:    10,
+				AcqTime: when,
+				ModTime: when,
+			}
+			s = script{results: []result{{Infos: []FileInfo{fi}}}}
+			r = NewRunner(Config{
+				FailFast: true,
+				Sidecar:  true,
+				DataDir:  root,
+				Archive:  archive,
+			})
+		)
+		err := r.Run(&s, func(FileInfo) error { return nil })
+		if d.Err != nil {
+			if !errors.Is(err, d.Err) {
+				t.Errorf("%q: expected error %v, got %v", d.Type, d.Err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", d.Type, err)
+			continue
+		}
+		if _, err := os.Stat(file + ExtSidecar); err == nil {
+			t.Errorf("%q: sidecar written next to the original file", d.Type)
+		}
+		f, err := os.Open(filepath.Join(root, d.Want))
+		if err != nil {
+			t.Errorf("%q: sidecar not written at the location of the record: %s", d.Type, err)
+			continue
+		}
+		mr, _ := NewManifestReader(f, nil)
+		got, err := mr.Read()
+		f.Close()
+		if err != nil {
+			t.Errorf("%q: fail to read sidecar: %s", d.Type, err)
+			continue
+		}
+		if got.File != fi.File || got.Type != fi.Type || got.Size != fi.Size || !got.AcqTime.Equal(fi.AcqTime) {
+			t.Errorf("%q: records mismatched! want %+v, got %+v", d.Type, fi, got)
+		}
+	}
+}
+
+func TestDataFromFileInfo(t *testing.T) {
+	var (
+		when = time.Date(2021, 5, 7, 10, 0, 0, 0, time.UTC)
+		sha  = sha256Sum("content")
+		sum  = md5Sum("content")
+	)
+	data := []struct {
+		Info    FileInfo
+		Pattern string
+		Want    string
+		Sum     string
+		MD5     string
+	}{
+		{
+			Info:    FileInfo{File: "/data/a/file.csv", Type: "data", Mime: MimeCsv, Model: "fm", Level: 1, AcqTime: when},
+			Pattern: "{model}/{type}/{level}/{year}/{doy}/{parent}",
+			Want:    "Fm/Data/1/2021/127/a",
+		},
+		{
+			Info:    FileInfo{File: "file.dat", Integrity: Integrity{Algorithm: SHA, Encoding: EncodingBase64, Value: sha}},
+			Pattern: "{fanout:2}",
+			Want:    hex.EncodeToString(sha)[:2] + "/" + hex.EncodeToString(sha)[2:],
+			Sum:     hex.EncodeToString(sha),
+		},
+		{
+			Info:    FileInfo{File: "file.dat", Integrity: Integrity{Algorithm: MD5, Encoding: EncodingHex, Value: sum}},
+			Pattern: "{fanout:4}",
+			Want:    hex.EncodeToString(sum)[:4] + "/" + hex.EncodeToString(sum)[4:],
+			Sum:     hex.EncodeToString(sum),
+			MD5:     hex.EncodeToString(sum),
+		},
+		{
+			Info:    FileInfo{File: "file.dat", Parameters: []Parameter{{Name: "run", Value: "R1"}}, MsgTime: when},
+			Pattern: "{meta:run}/{msgdate:year}",
+			Want:    "R1/2021",
+		},
+	}
+	for _, d := range data {
+		dat := DataFromFileInfo(d.Info)
+		if dat.File != d.Info.File || dat.Size != d.Info.Size || dat.Sum != d.Sum || dat.MD5 != d.MD5 {
+			t.Errorf("%s: data mismatched! got %+v", d.Info.File, dat)
+		}
+		p, err := NewPattern(d.Pattern)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Pattern, err)
+			continue
+		}
+		if got := p.Resolve(dat); got != d.Want {
+			t.Errorf("%s: paths mismatched! want %s, got %s", d.Pattern, d.Want, got)
+		}
+	}
+	fi := FileInfo{Parameters: []Parameter{{Name: "run", Value: "R1"}}}
+	DataFromFileInfo(fi).Parameters[0].Value = "R2"
+	if fi.Parameters[0].Value != "R1" {
+		t.Errorf("parameters of the FileInfo should not be shared")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	errFactory := errors.New("factory")
+	t.Cleanup(func() {
+		modmu.Lock()
+		defer modmu.Unlock()
+		for n := range modules {
+			if strings.HasPrefix(n, "test.") {
+				delete(modules, n)
+			}
+		}
+	})
+	Register("test.script", func(cfg Config) (Module, error) {
+		return &script{results: []result{{Files: []string{cfg.Mission}}}}, nil
+	})
+	Register("test.fail", func(Config) (Module, error) {
+		return nil, errFactory
+	})
+
+	data := []struct {
+		Name    string
+		Config  Config
+		Err     error
+		Invalid bool
+		Limit   bool
+	}{
+		{Name: "test.script", Config: Config{Mission: "a"}},
+		{Name: "test.script", Config: Config{Mission: "a", RateLimit: RateLimit{Rate: 1000}}, Limit: true},
+		{Name: "test.fail", Err: errFactory, Invalid: true},
+		{Name: "test.unknown", Invalid: true},
+	}
+	for _, d := range data {
+		m, err := NewModule(d.Name, d.Config)
+		if d.Invalid {
+			if err == nil || (d.Err != nil && !errors.Is(err, d.Err)) {
+				t.Errorf("%s: expected error %v, got %v", d.Name, d.Err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Name, err)
+			continue
+		}
+		if _, ok := m.(*script); ok == d.Limit {
+			t.Errorf("%s: rate limit mismatched! want %t, got %T", d.Name, d.Limit, m)
+		}
+		if _, ok := m.(BatchModule); !ok {
+			t.Errorf("%s: module should still be a BatchModule", d.Name)
+		}
+		fi, err := m.Process()
+		if err != nil || fi.File != d.Config.Mission {
+			t.Errorf("%s: record mismatched! want %s, got %s (%v)", d.Name, d.Config.Mission, fi.File, err)
+		}
+	}
+
+	for _, fn := range []func(){
+		func() { Register("test.script", func(Config) (Module, error) { return nil, nil }) },
+		func() { Register("test.nil", nil) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Register should panic")
+				}
+			}()
+			fn()
+		}()
+	}
+}
+
+// single hides the ProcessBatch method of a script.
+type single struct {
+	s *script
+}
+
+func (s single) String() string {
+	return "single"
+}
+
+func (s single) Process() (FileInfo, error) {
+	return s.s.Process()
+}
+
+func TestRun(t *testing.T) {
+	errFail := errors.New("fail")
+	data := []struct {
+		Name    string
+		Batch   bool
+		Results []result
+		Files   string
+		Err     error
+	}{
+		{
+			Name:    "batch",
+			Batch:   true,
+			Results: []result{{Files: []string{"a", "b"}}, {Err: Skip("empty")}, {Files: []string{"c"}}},
+			Files:   "a,b,c",
+		},
+		{
+			Name:    "single",
+			Results: []result{{Files: []string{"a", "b"}}, {Err: Skip("empty")}, {Files: []string{"c"}}},
+			Files:   "a,c",
+		},
+		{
+			Name:    "batch with error",
+			Batch:   true,
+			Results: []result{{Files: []string{"a", "b"}, Err: errFail}, {Files: []string{"c"}}},
+			Files:   "a,b",
+			Err:     errFail,
+		},
+		{
+			Name:    "single with error",
+			Results: []result{{Files: []string{"a"}}, {Files: []string{"b"}, Err: errFail}, {Files: []string{"c"}}},
+			Files:   "a",
+			Err:     errFail,
+		},
+		{
+			Name:    "skip",
+			Results: []result{{Err: ErrSkip}, {Files: []string{"a"}}, {Err: fmt.Errorf("file: %w", ErrSkip)}, {Files: []string{"b"}}},
+			Files:   "a,b",
+		},
+		{
+			Name:    "done",
+			Results: []result{{Files: []string{"a"}}, {Err: ErrDone}, {Files: []string{"b"}}},
+			Files:   "a",
+		},
+		{
+			Name:    "batch done",
+			Batch:   true,
+			Results: []result{{Files: []string{"a", "b"}, Err: fmt.Errorf("last: %w", ErrDone)}, {Files: []string{"c"}}},
+			Files:   "a,b",
+		},
+		{
+			Name:    "sink error",
+			Results: []result{{Files: []string{"a"}}, {Files: []string{"fail"}}, {Files: []string{"c"}}},
+			Files:   "a",
+			Err:     errFail,
+		},
+	}
+	for _, d := range data {
+		var (
+			files []string
+			s     = &script{results: d.Results}
+			m     Module
+		)
+		if m = s; !d.Batch {
+			m = single{s}
+		}
+		err := Run(m, func(fi FileInfo) error {
+			if fi.File == "fail" {
+				return errFail
+			}
+			files = append(files, fi.File)
+			return nil
+		})
+		if !errors.Is(err, d.Err) {
+			t.Errorf("%s: expected error %v, got %v", d.Name, d.Err, err)
+		}
+		if got := strings.Join(files, ","); got != d.Files {
+			t.Errorf("%s: records mismatched! want %s, got %s", d.Name, d.Files, got)
+		}
+	}
+}
+
+// event is a message received by a recorder.
+type event struct {
+	Level string
+	Msg   string
+	Args  []interface{}
+}
+
+// recorder is a Logger keeping the events it receives.
+type recorder struct {
+	events []event
+}
+
+func (r *recorder) Info(msg string, args ...interface{}) {
+	r.events = append(r.events, event{Level: "info", Msg: msg, Args: args})
+}
+
+func (r *recorder) Warn(msg string, args ...interface{}) {
+	r.events = append(r.events, event{Level: "warn", Msg: msg, Args: args})
+}
+
+func (r *recorder) Error(msg string, args ...interface{}) {
+	r.events = append(r.events, event{Level: "error", Msg: msg, Args: args})
+}
+
+func TestRunnerLogger(t *testing.T) {
+	errFail := errors.New("fail")
+	data := []struct {
+		FailFast bool
+		Results  []result
+		Events   int
+	}{
+		{Results: []result{{Files: []string{"a"}}, {Err: Skip("empty")}}},
+		{Results: []result{{Err: errFail}, {Files: []string{"a"}}, {Err: errFail}}, Events: 2},
+		{FailFast: true, Results: []result{{Err: errFail}, {Files: []string{"a"}}}},
+	}
+	for _, d := range data {
+		var (
+			rec recorder
+			s   = script{results: d.Results}
+			r   = NewRunner(Config{FailFast: d.FailFast, Logger: &rec})
+		)
+		r.Run(&s, func(FileInfo) error { return nil })
+		if len(rec.events) != d.Events {
+			t.Errorf("fail-fast(%t): events mismatched! want %d, got %d (%v)", d.FailFast, d.Events, len(rec.events), rec.events)
+			continue
+		}
+		for _, e := range rec.events {
+			if e.Level != "error" || len(e.Args)%2 != 0 {
+				t.Errorf("fail-fast(%t): unexpected event %+v", d.FailFast, e)
+			}
+			if len(e.Args) < 2 || !errors.Is(e.Args[1].(error), errFail) {
+				t.Errorf("fail-fast(%t): event should give the error: %+v", d.FailFast, e)
+			}
+		}
+	}
+	if _, ok := (Config{}).Log().(discard); !ok {
+		t.Errorf("a Config without Logger should discard the events")
+	}
+	var rec recorder
+	if l := (Config{Logger: &rec}).Log(); l != &rec {
+		t.Errorf("the Logger of the Config should be used")
+	}
+}
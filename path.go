@@ -1,10 +1,33 @@
 package prospect
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
+	"net/url"
+	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	ErrTooLong = errors.New("path too long")
+	ErrEmpty   = errors.New("empty value")
+	ErrIndex   = errors.New("index out of range")
+	ErrControl = errors.New("control character")
+
+	ErrCollision = errors.New("path collision")
 )
 
 type Resolver interface {
@@ -12,8 +35,221 @@ type Resolver interface {
 	fmt.Stringer
 }
 
+// Pattern computes the location of files in the archive. A Pattern can be used
+// by multiple goroutines simultaneously: the elements keeping a state between
+// two resolutions (eg: ordinal) synchronize their access to it.
 type Pattern struct {
 	Resolver
+
+	lower     bool
+	fold      bool
+	strip     bool
+	mimeExt   bool
+	maxLength int
+	truncate  bool
+	maxName   int
+	truncName bool
+	funcs     []func(string) string
+	urlSafe   bool
+
+	provenance bool
+}
+
+type PatternOption func(*Pattern)
+
+// WithLowercase lowercases the whole resolved path, literals included.
+func WithLowercase() PatternOption {
+	return func(p *Pattern) {
+		p.lower = true
+	}
+}
+
+// WithFolding decomposes the characters of the resolved path (NFKD), removes
+// their diacritics and recomposes them (NFC) before the path is lowercased: é
+// gives e and the full width characters give their ASCII equivalent.
+func WithFolding() PatternOption {
+	return func(p *Pattern) {
+		p.fold = true
+	}
+}
+
+// WithStripControl removes the control characters from the resolved path
+// instead of failing with ErrControl. A directory made only of control
+// characters gives ErrEmpty.
+func WithStripControl() PatternOption {
+	return func(p *Pattern) {
+		p.strip = true
+	}
+}
+
+// WithMimeExtension appends to the resolved path the extension of the mime type
+// of the file if it is known and if the path does not already end with it.
+func WithMimeExtension() PatternOption {
+	return func(p *Pattern) {
+		p.mimeExt = true
+	}
+}
+
+// WithMaxLength limits the length in bytes of the resolved path. If truncate is
+// set, the stem of the filename is shortened to fit, otherwise resolving a
+// longer path gives ErrTooLong.
+func WithMaxLength(max int, truncate bool) PatternOption {
+	return func(p *Pattern) {
+		p.maxLength = max
+		p.truncate = truncate
+	}
+}
+
+// WithMaxComponent limits the length in bytes of each directory and of the
+// filename of the resolved path (eg: 255 for NAME_MAX). If truncate is set,
+// the longer components are shortened to fit, the extension of the last one
+// being kept, otherwise resolving a path with a longer component gives
+// ErrTooLong.
+func WithMaxComponent(max int, truncate bool) PatternOption {
+	return func(p *Pattern) {
+		p.maxName = max
+		p.truncName = truncate
+	}
+}
+
+// WithTransform registers a function applied on the resolved path before its
+// length is checked. Functions are applied in the order they are given. They
+// should be safe for concurrent use if the Pattern is shared by goroutines.
+func WithTransform(fn func(string) string) PatternOption {
+	return func(p *Pattern) {
+		if fn != nil {
+			p.funcs = append(p.funcs, fn)
+		}
+	}
+}
+
+// WithURLSafe percent-encodes each directory of the resolved path so that it
+// can be used as is in an URL. The separators are kept as is.
+func WithURLSafe() PatternOption {
+	return func(p *Pattern) {
+		p.urlSafe = true
+	}
+}
+
+// WithProvenance makes the Builder records, as metadata of each file, the
+// pattern used to resolve its location and the value of each of its
+// components.
+func WithProvenance() PatternOption {
+	return func(p *Pattern) {
+		p.provenance = true
+	}
+}
+
+// PatternOptions are the options of a Pattern that can be set from a
+// configuration file. Truncate applies to both MaxLength and MaxComponent.
+type PatternOptions struct {
+	Lowercase     bool `toml:"lowercase"`
+	Fold          bool `toml:"fold"`
+	StripControl  bool `toml:"strip-control"`
+	MimeExtension bool `toml:"mime-extension"`
+	URLSafe       bool `toml:"url-safe"`
+	Provenance    bool `toml:"provenance"`
+	MaxLength     int  `toml:"max-length"`
+	MaxComponent  int  `toml:"max-component"`
+	Truncate      bool `toml:"truncate"`
+}
+
+// Options gives the PatternOption of each option set.
+func (o PatternOptions) Options() []PatternOption {
+	var options []PatternOption
+	if o.Lowercase {
+		options = append(options, WithLowercase())
+	}
+	if o.Fold {
+		options = append(options, WithFolding())
+	}
+	if o.StripControl {
+		options = append(options, WithStripControl())
+	}
+	if o.MimeExtension {
+		options = append(options, WithMimeExtension())
+	}
+	if o.URLSafe {
+		options = append(options, WithURLSafe())
+	}
+	if o.Provenance {
+		options = append(options, WithProvenance())
+	}
+	if o.MaxLength > 0 {
+		options = append(options, WithMaxLength(o.MaxLength, o.Truncate))
+	}
+	if o.MaxComponent > 0 {
+		options = append(options, WithMaxComponent(o.MaxComponent, o.Truncate))
+	}
+	return options
+}
+
+func NewPattern(str string, options ...PatternOption) (Pattern, error) {
+	var p Pattern
+	for _, o := range options {
+		o(&p)
+	}
+	return p, p.Set(str)
+}
+
+// Component describes one element of the path of a Pattern. Only one of its
+// fields should be set: Fragment is parsed like the content of a placeholder
+// of the pattern syntax and Literal is used as is.
+type Component struct {
+	Fragment string
+	Literal  string
+}
+
+// NewPatternFromComponents builds the same Pattern as the one obtained by
+// joining the components with slashes, fragments being surrounded by curly
+// braces.
+func NewPatternFromComponents(cs []Component, options ...PatternOption) (Pattern, error) {
+	var p Pattern
+	for _, o := range options {
+		o(&p)
+	}
+	rs := make([]Resolver, 0, len(cs))
+	for _, c := range cs {
+		var (
+			r   Resolver
+			err error
+		)
+		switch {
+		case c.Fragment != "" && c.Literal != "":
+			err = fmt.Errorf("component can not be both a fragment and a literal")
+		case c.Fragment != "":
+			r, err = parseResolver(c.Fragment)
+		case c.Literal != "":
+			r = literal(c.Literal)
+		default:
+			err = fmt.Errorf("empty component")
+		}
+		if err != nil {
+			return p, err
+		}
+		rs = append(rs, r)
+	}
+	if len(rs) == 0 {
+		p.Resolver = empty{}
+	} else {
+		p.Resolver = path{rs: rs}
+	}
+	return p, nil
+}
+
+// PreviewPattern parses src once and resolves it against each of the samples.
+// An error is only returned if src is not a valid pattern, a sample that
+// resolves to nothing gives an empty string.
+func PreviewPattern(src string, samples []Data) ([]string, error) {
+	p, err := NewPattern(src)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]string, len(samples))
+	for i := range samples {
+		list[i] = p.Resolve(samples[i])
+	}
+	return list, nil
 }
 
 func (p *Pattern) Set(str string) error {
@@ -24,52 +260,566 @@ func (p *Pattern) Set(str string) error {
 	return err
 }
 
+// IsEmpty reports whether p has been created from an empty string or has not
+// been set at all.
+func (p Pattern) IsEmpty() bool {
+	if p.Resolver == nil {
+		return true
+	}
+	_, ok := p.Resolver.(empty)
+	return ok
+}
+
+// Resolve returns the resolved path of dat or an empty string if the
+// resolution fails. Use ResolveErr to get the reason of the failure.
+func (p Pattern) Resolve(dat Data) string {
+	str, _ := p.ResolveErr(dat)
+	return str
+}
+
+func (p Pattern) ResolveErr(dat Data) (string, error) {
+	if p.Resolver == nil {
+		return "", nil
+	}
+	str, err := resolveErr(p.Resolver, dat)
+	if err != nil {
+		return "", err
+	}
+	if x := strings.IndexFunc(str, isControl); x >= 0 {
+		if !p.strip {
+			return "", fmt.Errorf("%w: %q at position %d", ErrControl, str[x], x)
+		}
+		if str, err = stripControl(str); err != nil {
+			return "", err
+		}
+	}
+	if p.fold {
+		str = foldString(str)
+	}
+	if p.lower {
+		str = strings.ToLower(str)
+	}
+	for _, fn := range p.funcs {
+		str = fn(str)
+	}
+	if ext := MimeExtension(dat.Mime); p.mimeExt && ext != "" && !strings.EqualFold(filepath.Ext(str), ext) {
+		str += ext
+	}
+	if p.urlSafe {
+		str = escapePath(str)
+	}
+	if p.maxName > 0 {
+		if str, err = truncateComponents(str, p.maxName, p.truncName); err != nil {
+			return "", err
+		}
+	}
+	if p.maxLength > 0 && len(str) > p.maxLength {
+		if !p.truncate {
+			return "", fmt.Errorf("%w: %s (%d > %d)", ErrTooLong, str, len(str), p.maxLength)
+		}
+		return truncatePath(str, p.maxLength)
+	}
+	return str, nil
+}
+
+// ResolveStrict is like ResolveErr but fails with ErrIndex if an index or a
+// range of the pattern refers to a directory that dat.File does not have.
+func (p Pattern) ResolveStrict(dat Data) (string, error) {
+	if p.Resolver == nil {
+		return "", nil
+	}
+	count := func(origin bool) int {
+		return len(SplitComponents(dat.source(origin)))
+	}
+	err := walkResolver(p.Resolver, func(r Resolver) error {
+		switch r := r.(type) {
+		case index:
+			return r.check(count(r.origin))
+		case slice:
+			return r.check(count(r.origin))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return p.ResolveErr(dat)
+}
+
+// ResolveAll resolves each of ds and gives the resolved path of each file
+// indexed by its original name (File). All the files that resolve to the same
+// path are reported with ErrCollision. A file given more than once is only
+// resolved once.
+func (p Pattern) ResolveAll(ds []Data) (map[string]string, error) {
+	var (
+		paths = make(map[string]string, len(ds))
+		files = make(map[string][]string)
+	)
+	for _, d := range ds {
+		if _, ok := paths[d.File]; ok {
+			continue
+		}
+		str, err := p.ResolveErr(d)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", d.File, err)
+		}
+		paths[d.File] = str
+		files[str] = append(files[str], d.File)
+	}
+	var conflicts []string
+	for str, list := range files {
+		if len(list) == 1 {
+			continue
+		}
+		sort.Strings(list)
+		conflicts = append(conflicts, fmt.Sprintf("%s (%s)", str, strings.Join(list, ", ")))
+	}
+	if len(conflicts) > 0 {
+		sort.Strings(conflicts)
+		return nil, fmt.Errorf("%w: %s", ErrCollision, strings.Join(conflicts, "; "))
+	}
+	return paths, nil
+}
+
+// walkResolver calls fn for r and all the resolvers it contains.
+func walkResolver(r Resolver, fn func(Resolver) error) error {
+	if err := fn(r); err != nil {
+		return err
+	}
+	var rs []Resolver
+	switch r := r.(type) {
+	case path:
+		rs = r.rs
+	case compound:
+		rs = r.rs
+	case chain:
+		rs = r.rs
+	case join:
+		rs = r.rs
+	case datepath:
+		rs = r.rs
+	case modifier:
+		rs = append(rs, r.Resolver)
+	case optional:
+		rs = append(rs, r.Resolver)
+	}
+	for _, r := range rs {
+		if err := walkResolver(r, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RequireTime is the name given to RequireFragments to require any element
+// derived from the acquisition time.
+const RequireTime = "time"
+
+var timeFragments = []string{
+	levelYear, levelDoy, levelMonth, levelDay, levelHour, levelMinShort,
+	levelSecShort, levelSecOfDay, levelStamp, levelStamp36, levelStamp32,
+	levelFiscal, levelMissionDay,
+}
+
+// RequireFragments checks that each of the given names is referenced by at
+// least one element of r. RequireTime is satisfied by any element giving a
+// value derived from the acquisition time.
+func RequireFragments(r Resolver, names ...string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	seen := make(map[string]bool)
+	mark := func(name string) {
+		name = strings.ToLower(name)
+		if n, ok := synonyms[name]; ok {
+			name = n
+		}
+		seen[name] = true
+		for _, n := range timeFragments {
+			if n == name {
+				seen[RequireTime] = true
+			}
+		}
+	}
+	if r != nil {
+		walkResolver(r, func(r Resolver) error {
+			switch r := r.(type) {
+			case fragment:
+				mark(r.name)
+			case table:
+				mark(r.field.name)
+			case ordinal:
+				mark(r.field.name)
+			case volume:
+				mark(r.field)
+			case datepath, timefmt, bucket, msgdate:
+				seen[RequireTime] = true
+			}
+			return nil
+		})
+	}
+	var missing []string
+	for _, n := range names {
+		x := strings.ToLower(n)
+		if s, ok := synonyms[x]; ok {
+			x = s
+		}
+		if !seen[x] {
+			missing = append(missing, n)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("pattern does not use %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+const (
+	archPattern   = "archive.pattern"
+	archComponent = "archive.%d.component"
+	archValue     = "archive.%d.value"
+)
+
+// Provenance gives the pattern and the values of each of its components when
+// resolving dat as a list of parameters.
+func (p Pattern) Provenance(dat Data) []Parameter {
+	if p.Resolver == nil {
+		return nil
+	}
+	ps := []Parameter{
+		MakeParameter(archPattern, p.Resolver.String()),
+	}
+	var rs []Resolver
+	if x, ok := p.Resolver.(path); ok {
+		rs = x.rs
+	} else {
+		rs = append(rs, p.Resolver)
+	}
+	for i, r := range rs {
+		ps = append(ps, MakeParameter(fmt.Sprintf(archComponent, i+1), r.String()))
+		ps = append(ps, MakeParameter(fmt.Sprintf(archValue, i+1), r.Resolve(dat)))
+	}
+	return ps
+}
+
+// stripControl removes the control characters of each directory of str. A
+// directory made only of control characters gives ErrEmpty.
+func stripControl(str string) (string, error) {
+	parts := strings.Split(str, "/")
+	for i, c := range parts {
+		if strings.IndexFunc(c, isControl) < 0 {
+			continue
+		}
+		c = strings.Map(func(r rune) rune {
+			if isControl(r) {
+				return -1
+			}
+			return r
+		}, c)
+		if c == "" {
+			return "", fmt.Errorf("%w: component %d only has control characters", ErrEmpty, i+1)
+		}
+		parts[i] = c
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// isControl reports whether r is a control character that should never be
+// found in a path.
+func isControl(r rune) bool {
+	return r < 0x20 || r == 0x7f
+}
+
+func foldString(str string) string {
+	str = strings.Map(func(r rune) rune {
+		if unicode.Is(unicode.Mn, r) {
+			return -1
+		}
+		return r
+	}, norm.NFKD.String(str))
+	return norm.NFC.String(str)
+}
+
+func escapePath(str string) string {
+	xs := strings.Split(filepath.ToSlash(str), "/")
+	for i := range xs {
+		xs[i] = url.PathEscape(xs[i])
+	}
+	return strings.Join(xs, "/")
+}
+
+// truncatePath shortens the stem of the filename of str, keeping its
+// extension, until str is not longer than max bytes.
+func truncatePath(str string, max int) (string, error) {
+	var (
+		dir, base = filepath.Split(str)
+		ext       = filepath.Ext(base)
+		stem      = strings.TrimSuffix(base, ext)
+		size      = len(stem) - (len(str) - max)
+	)
+	if size <= 0 {
+		return "", fmt.Errorf("%w: %s can not be truncated to %d", ErrTooLong, str, max)
+	}
+	for size > 0 && !utf8.RuneStart(stem[size]) {
+		size--
+	}
+	return dir + stem[:size] + ext, nil
+}
+
+// truncateComponents checks the length of each component of str. The longer
+// ones are shortened if truncate is set: the last component keeps its
+// extension.
+func truncateComponents(str string, max int, truncate bool) (string, error) {
+	parts := strings.Split(str, "/")
+	for i, c := range parts {
+		if len(c) <= max {
+			continue
+		}
+		if !truncate {
+			return "", fmt.Errorf("%w: component %d of %s (%d > %d)", ErrTooLong, i+1, str, len(c), max)
+		}
+		var ext string
+		if i == len(parts)-1 {
+			ext = filepath.Ext(c)
+			if len(ext) >= max {
+				ext = ""
+			}
+		}
+		var (
+			stem = strings.TrimSuffix(c, ext)
+			size = max - len(ext)
+		)
+		for size > 0 && !utf8.RuneStart(stem[size]) {
+			size--
+		}
+		parts[i] = stem[:size] + ext
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// errResolver is implemented by the resolvers that can fail or that contain
+// resolvers that can fail.
+type errResolver interface {
+	resolveErr(Data) (string, error)
+}
+
+func resolveErr(r Resolver, dat Data) (string, error) {
+	if e, ok := r.(errResolver); ok {
+		return e.resolveErr(dat)
+	}
+	return r.Resolve(dat), nil
+}
+
+var (
+	partmu   sync.Mutex
+	partials = make(map[string]string)
+)
+
+// RegisterPartial makes str usable in other patterns with {@name}. Partials
+// are expanded when the patterns that use them are parsed.
+func RegisterPartial(name, str string) error {
+	if name == "" {
+		return fmt.Errorf("partial: empty name")
+	}
+	partmu.Lock()
+	defer partmu.Unlock()
+	if _, ok := partials[name]; ok {
+		return fmt.Errorf("%s: partial already registered", name)
+	}
+	partials[name] = str
+	if _, err := expandPartials(str, []string{name}); err != nil {
+		delete(partials, name)
+		return err
+	}
+	return nil
+}
+
+// expandPartials replaces the {@name} placeholders of str by the partial
+// registered under name. stack contains the partials being expanded to detect
+// recursion. partmu should be held by the caller.
+func expandPartials(str string, stack []string) (string, error) {
+	var (
+		buf    strings.Builder
+		marker = string(lcurly) + string(at)
+	)
+	for {
+		x := strings.Index(str, marker)
+		if x < 0 {
+			break
+		}
+		end := strings.IndexByte(str[x:], rcurly)
+		if end < 0 {
+			return "", fmt.Errorf("missing closing brace")
+		}
+		name := str[x+2 : x+end]
+		for _, s := range stack {
+			if s == name {
+				return "", fmt.Errorf("%s: recursive partial (%s)", name, strings.Join(append(stack, name), " -> "))
+			}
+		}
+		part, ok := partials[name]
+		if !ok {
+			return "", fmt.Errorf("%s: unknown partial", name)
+		}
+		part, err := expandPartials(part, append(stack, name))
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString(str[:x])
+		buf.WriteString(strings.Trim(part, "/"))
+		str = str[x+end+1:]
+	}
+	buf.WriteString(str)
+	return buf.String(), nil
+}
+
 func ParseResolver(str string) (Resolver, error) {
 	if str == "" {
 		return empty{}, nil
 	}
+	if strings.Contains(str, string(lcurly)+string(at)) {
+		partmu.Lock()
+		x, err := expandPartials(str, nil)
+		partmu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		str = x
+	}
 	var (
-		rs    []Resolver
-		parts = strings.Split(strings.Trim(str, "/"), "/")
+		rs     []Resolver
+		trim   = strings.TrimLeft(str, "/")
+		offset = len(str) - len(trim)
+		parts  = splitPattern(strings.TrimRight(trim, "/"))
 	)
 	for _, p := range parts {
-		r, err := parse(p)
+		if p == "" {
+			offset++
+			continue
+		}
+		r, err := parse(p, offset)
 		if err != nil {
 			return nil, err
 		}
 		rs = append(rs, r)
+		offset += len(p) + 1
 	}
 
 	return path{rs: rs}, nil
 }
 
+// splitPattern splits str on every slash that is not enclosed within curly
+// braces. A character preceded by a backslash within braces is kept as is.
+func splitPattern(str string) []string {
+	var (
+		parts []string
+		depth int
+		prev  int
+	)
+	for i := 0; i < len(str); i++ {
+		switch str[i] {
+		case backslash:
+			if depth > 0 {
+				i++
+			}
+		case lcurly:
+			depth++
+		case rcurly:
+			if depth > 0 {
+				depth--
+			}
+		case slash:
+			if depth == 0 {
+				parts = append(parts, str[prev:i])
+				prev = i + 1
+			}
+		}
+	}
+	return append(parts, str[prev:])
+}
+
 const (
 	lcurly = '{'
 	rcurly = '}'
 	colon  = ':'
+	slash  = '/'
+	quote  = '\''
+	bang   = '!'
+	equal  = '='
+	qmark  = '?'
+	at     = '@'
+
+	backslash = '\\'
+
+	chainSep = "||"
+)
+
+const (
+	levelLevel      = "level"
+	levelSource     = "source"
+	levelModel      = "model"
+	levelMime       = "mime"
+	levelFormat     = "format"
+	levelType       = "type"
+	levelRun        = "run"
+	levelYear       = "year"
+	levelDoy        = "doy"
+	levelMonth      = "month"
+	levelDay        = "day"
+	levelHour       = "hour"
+	levelMinLong    = "minute"
+	levelMinShort   = "min"
+	levelSecLong    = "second"
+	levelSecShort   = "sec"
+	levelStamp      = "timestamp"
+	levelParent     = "parent"
+	levelGrand      = "grandparent"
+	levelTag        = "leveltag"
+	levelDepth      = "depth"
+	levelStamp36    = "stamp36"
+	levelStamp32    = "stamp32"
+	levelFamily     = "modelfamily"
+	levelFiscal     = "fiscalyear"
+	levelMissionDay = "missionday"
+	levelCategory   = "category"
+	levelBatch      = "batch"
+	levelSecOfDay   = "secofday"
+	levelMission    = "mission"
+	levelOrigin     = "origin"
+	levelVersion    = "version"
 )
 
 const (
-	levelLevel    = "level"
-	levelSource   = "source"
-	levelModel    = "model"
-	levelMime     = "mime"
-	levelFormat   = "format"
-	levelType     = "type"
-	levelRun      = "run"
-	levelYear     = "year"
-	levelDoy      = "doy"
-	levelMonth    = "month"
-	levelDay      = "day"
-	levelHour     = "hour"
-	levelMinLong  = "minute"
-	levelMinShort = "min"
-	levelSecLong  = "second"
-	levelSecShort = "sec"
-	levelStamp    = "timestamp"
+	modAlias    = "alias"
+	modRequired = "required"
+	modPad      = "pad"
+	modPadLeft  = "padleft"
+	modFlat     = "flat"
+	modFormat   = "fmt"
+	modOrigin   = "origin"
+	modFirst    = "firstword"
 )
 
-func parse(str string) (Resolver, error) {
+const (
+	funcDatePath = "datepath"
+	funcTime     = "time"
+	funcMeta     = "meta"
+	funcLookup   = "lookup"
+	funcOrdinal  = "ordinal"
+	funcJoin     = "join"
+	funcFanout   = "fanout"
+	funcBucket   = "bucket"
+	funcMsgDate  = "msgdate"
+	funcVolume   = "volume"
+	funcSep      = "sep"
+	funcGrep     = "grep"
+
+	datePathYMD  = "ymd"
+	datePathYDoy = "ydoy"
+)
+
+// parse parses one directory of a pattern starting at base in the pattern.
+func parse(str string, base int) (Resolver, error) {
 	var (
 		offset int
 		rs     []Resolver
@@ -79,12 +829,12 @@ func parse(str string) (Resolver, error) {
 		if start < 0 {
 			break
 		}
-		end := strings.IndexByte(str[offset+start:], rcurly)
+		end := closingBrace(str[offset+start:])
 		if end < 0 {
-			return nil, fmt.Errorf("missing closing brace")
+			return nil, parseError(str[offset+start:], base+offset+start, fmt.Errorf("missing closing brace"))
 		}
-		if end-start == 1 {
-			return nil, fmt.Errorf("empty placeholder")
+		if end == 1 {
+			return nil, parseError(str[offset+start:offset+start+end+1], base+offset+start, fmt.Errorf("empty placeholder"))
 		}
 
 		if q := str[offset : offset+start]; len(q) > 0 {
@@ -93,7 +843,7 @@ func parse(str string) (Resolver, error) {
 		offset += start + 1
 		r, err := parseResolver(str[offset : offset+end-1])
 		if err != nil {
-			return nil, err
+			return nil, parseError(str[offset-1:offset+end], base+offset-1, err)
 		}
 		rs = append(rs, r)
 
@@ -110,11 +860,413 @@ func parse(str string) (Resolver, error) {
 	return compound{rs: rs}, nil
 }
 
+// closingBrace gives the index of the brace closing the one starting str or -1
+// if there is none. The braces enclosed within it (eg: the repetitions of a
+// regular expression) should be balanced unless they are preceded by a
+// backslash.
+func closingBrace(str string) int {
+	var depth int
+	for i := 0; i < len(str); i++ {
+		switch str[i] {
+		case backslash:
+			i++
+		case lcurly:
+			depth++
+		case rcurly:
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// ParseError is the error returned when a pattern can not be parsed. Offset is
+// the position in bytes, in the pattern, of the element that can not be parsed
+// and Text the element itself. The offsets refer to the pattern once its
+// partials are expanded.
+type ParseError struct {
+	Offset int
+	Text   string
+	Err    error
+}
+
+func parseError(text string, offset int, err error) error {
+	return &ParseError{
+		Offset: offset,
+		Text:   text,
+		Err:    err,
+	}
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s (offset %d: %s)", e.Err, e.Offset, e.Text)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
 func parseResolver(str string) (Resolver, error) {
+	if strings.HasPrefix(strings.ToLower(str), funcGrep+string(colon)) && !strings.Contains(str, chainSep) {
+		// the expression is kept as is and can not be followed by modifiers
+		return parseGrep(str[len(funcGrep)+1:])
+	}
+	if n := len(str) - 1; n > 0 && str[n] == qmark {
+		r, err := parseResolver(str[:n])
+		if err != nil {
+			return nil, err
+		}
+		return optional{Resolver: r}, nil
+	}
+	if strings.Contains(str, chainSep) {
+		return parseChain(str)
+	}
+	if strings.HasPrefix(strings.ToLower(str), funcTime+string(colon)) {
+		// the layout is kept as is and can not be followed by modifiers
+		return parseFunc(funcTime, str[len(funcTime)+1:])
+	}
+	parts := strings.Split(str, string(bang))
+	r, err := parseBase(parts[0])
+	if err != nil || len(parts) == 1 {
+		return r, err
+	}
+	m := modifier{Resolver: r}
+	for _, p := range parts[1:] {
+		t, err := parseTransform(p)
+		if err != nil {
+			return nil, err
+		}
+		if t.name == modOrigin {
+			if m.Resolver, err = fromOrigin(m.Resolver); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if f, ok := m.Resolver.(fragment); ok && t.name == modFirst && len(m.transforms) == 0 {
+			// the value of the fragment should be cut before its words are
+			// joined
+			f.first = true
+			m.Resolver = f
+			continue
+		}
+		m.transforms = append(m.transforms, t)
+	}
+	if len(m.transforms) == 0 {
+		return m.Resolver, nil
+	}
+	setFill(m.transforms)
+	return m, nil
+}
+
+// fromOrigin makes the index or the range r use the components of the origin
+// of the files instead of their name.
+func fromOrigin(r Resolver) (Resolver, error) {
+	switch i := r.(type) {
+	case index:
+		i.origin = true
+		return i, nil
+	case slice:
+		i.origin = true
+		return i, nil
+	default:
+		return nil, fmt.Errorf("%s: %s can only be used with an index or a range", r, modOrigin)
+	}
+}
+
+func parseBase(str string) (Resolver, error) {
+	if str == "" {
+		return nil, fmt.Errorf("missing fragment name")
+	}
+	if isNumber(str[0]) || isSign(str[0]) {
+		return parseIndex(str)
+	}
+	x := strings.IndexByte(str, colon)
+	if x < 0 {
+		return fragment{name: str}, nil
+	}
+	return parseFunc(str[:x], str[x+1:])
+}
+
+func parseFunc(name, arg string) (Resolver, error) {
+	switch strings.ToLower(name) {
+	case funcDatePath:
+		return parseDatePath(arg)
+	case funcTime:
+		if arg == "" {
+			return nil, fmt.Errorf("time: empty layout")
+		}
+		return timefmt{layout: arg}, nil
+	case funcMeta:
+		if arg == "" {
+			return nil, fmt.Errorf("meta: empty name")
+		}
+		return metadata{name: arg}, nil
+	case funcLookup:
+		if arg == "" {
+			return nil, fmt.Errorf("lookup: empty name")
+		}
+		return table{field: fragment{name: arg}}, nil
+	case funcJoin:
+		return parseJoin(arg)
+	case funcFanout:
+		return parseFanout(arg)
+	case funcBucket:
+		return parseBucket(arg)
+	case funcMsgDate:
+		return parseMsgDate(arg)
+	case funcVolume:
+		return parseVolume(arg)
+	case funcGrep:
+		return parseGrep(arg)
+	case funcSep:
+		if arg == "" {
+			return nil, fmt.Errorf("sep: empty separator")
+		}
+		if strings.ContainsAny(arg, "/\\") {
+			return nil, fmt.Errorf("sep: path separator can not be used")
+		}
+		return separator(arg), nil
+	case funcOrdinal:
+		if arg == "" {
+			return nil, fmt.Errorf("ordinal: empty name")
+		}
+		return ordinal{field: fragment{name: arg}, seen: newOccurrences()}, nil
+	default:
+		return fragment{name: name + string(colon) + arg}, nil
+	}
+}
+
+// parseJoin parses the list of elements and the optional separator (default to
+// -) of a join: "source,model:_".
+func parseJoin(str string) (Resolver, error) {
+	j := join{sep: "-"}
+	if x := strings.LastIndexByte(str, colon); x >= 0 {
+		str, j.sep = str[:x], str[x+1:]
+	}
+	if strings.ContainsAny(j.sep, "/\\") {
+		return nil, fmt.Errorf("join: separator can not be used")
+	}
+	for _, n := range strings.Split(str, ",") {
+		if n = strings.TrimSpace(n); n == "" {
+			return nil, fmt.Errorf("join: empty name")
+		}
+		j.rs = append(j.rs, fragment{name: n})
+	}
+	return j, nil
+}
+
+// parseBucket parses the duration of a bucket and its optional layout (default
+// to HHMM): "15m" or "15m:150405".
+func parseBucket(str string) (Resolver, error) {
+	b := bucket{layout: "1504"}
+	if x := strings.IndexByte(str, colon); x >= 0 {
+		str, b.layout = str[:x], str[x+1:]
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		return nil, fmt.Errorf("bucket: %w", err)
+	}
+	if d <= 0 {
+		return nil, fmt.Errorf("bucket: %s: duration should be positive", str)
+	}
+	if b.layout == "" {
+		return nil, fmt.Errorf("bucket: empty layout")
+	}
+	b.width = d
+	return b, nil
+}
+
+// parseVolume parses the list of choices of a volume and the optional name of
+// the element used to choose one of them: "vol1,vol2,vol3" or
+// "vol1,vol2,vol3:source".
+func parseVolume(str string) (Resolver, error) {
+	var v volume
+	if x := strings.LastIndexByte(str, colon); x >= 0 {
+		str, v.field = str[:x], strings.ToLower(str[x+1:])
+		if v.field == "" {
+			return nil, fmt.Errorf("volume: empty name")
+		}
+	}
+	for _, c := range strings.Split(str, ",") {
+		if c = strings.TrimSpace(c); c == "" {
+			return nil, fmt.Errorf("volume: empty choice")
+		}
+		if strings.ContainsAny(c, "/\\") {
+			return nil, fmt.Errorf("volume: %s: choice can not be used", c)
+		}
+		v.choices = append(v.choices, c)
+	}
+	return v, nil
+}
+
+// parseGrep parses the regular expression of a grep and the optional number
+// of the group to use (default to the first group or the whole match if the
+// expression has no group): "^ID=(\\w+)" or "^(\\w+)=(\\w+):2". A colon
+// followed by digits at the end of the expression is always taken as the
+// number of the group unless it is escaped.
+func parseGrep(str string) (Resolver, error) {
+	g := grep{group: -1}
+	if x := strings.LastIndexByte(str, colon); x >= 0 && !isEscaped(str, x) {
+		if n, err := strconv.Atoi(str[x+1:]); err == nil && isNumber(str[x+1]) {
+			str, g.group = str[:x], n
+		}
+	}
+	if str == "" {
+		return nil, fmt.Errorf("grep: empty expression")
+	}
+	re, err := regexp.Compile(str)
+	if err != nil {
+		return nil, fmt.Errorf("grep: %w", err)
+	}
+	if g.group < 0 {
+		g.group = 0
+		if re.NumSubexp() > 0 {
+			g.group = 1
+		}
+	}
+	if g.group > re.NumSubexp() {
+		return nil, fmt.Errorf("grep: %s: group %d does not exist", str, g.group)
+	}
+	g.re = re
+	g.cache = newGrepCache(grepCacheSize)
+	return g, nil
+}
+
+// isEscaped reports whether the character at x in str is preceded by an odd
+// number of backslashes.
+func isEscaped(str string, x int) bool {
+	var n int
+	for x--; x >= 0 && str[x] == backslash; x-- {
+		n++
+	}
+	return n%2 == 1
+}
+
+// parseMsgDate parses the field of the message date given to a msgdate:
+// "year", "doy", "month",...
+func parseMsgDate(str string) (Resolver, error) {
+	switch name := strings.ToLower(str); name {
+	case levelYear, levelDoy, levelMonth, levelDay, levelHour, levelMinShort, levelMinLong, levelSecShort, levelSecLong, levelSecOfDay, levelStamp:
+		return msgdate{field: fragment{name: name}}, nil
+	case "":
+		return nil, fmt.Errorf("msgdate: empty field")
+	default:
+		return nil, fmt.Errorf("msgdate: %s: unsupported field", str)
+	}
+}
+
+// parseFanout parses the comma separated list of the widths of the
+// directories of a fanout: "2,2".
+func parseFanout(str string) (Resolver, error) {
+	var f fanout
+	for _, x := range strings.Split(str, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(x))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("fanout: %s: invalid width", x)
+		}
+		f.widths = append(f.widths, n)
+	}
+	return f, nil
+}
+
+func parseTransform(str string) (transform, error) {
+	var t transform
+	if x := strings.IndexByte(str, equal); x >= 0 {
+		t.name, t.arg = str[:x], str[x+1:]
+	} else {
+		t.name = str
+	}
+	t.name = strings.ToLower(t.name)
 	var err error
-	if !(isNumber(str[0]) || isSign(str[0])) {
-		return fragment{name: str}, err
+	switch t.name {
+	case modAlias, modRequired, modOrigin, modFirst:
+	case modFlat:
+		if t.arg == "" {
+			t.arg = "-"
+		}
+		if strings.ContainsAny(t.arg, "/\\") {
+			err = fmt.Errorf("%s: separator can not be used as replacement", t.arg)
+		}
+	case modPad:
+		t.width, err = strconv.Atoi(t.arg)
+		if err == nil && t.width <= 0 {
+			err = fmt.Errorf("%s: width should be greater than 0", t.arg)
+		}
+	case modPadLeft:
+		if utf8.RuneCountInString(t.arg) != 1 {
+			err = fmt.Errorf("%s: fill should be a single character", t.arg)
+		}
+	case modFormat:
+		if !numberVerb.MatchString(t.arg) {
+			err = fmt.Errorf("%s: only one integer verb (d, x, X, o, b) can be used", t.arg)
+		}
+	default:
+		err = fmt.Errorf("%s: unknown modifier", t.name)
+	}
+	return t, err
+}
+
+// setFill gives to the pad transforms the fill character set by padleft.
+func setFill(ts []transform) {
+	var fill string
+	for _, t := range ts {
+		if t.name == modPadLeft {
+			fill = t.arg
+		}
+	}
+	if fill == "" {
+		return
 	}
+	for i := range ts {
+		if ts[i].name == modPad {
+			ts[i].fill = fill
+		}
+	}
+}
+
+func parseChain(str string) (Resolver, error) {
+	var c chain
+	for _, str := range strings.Split(str, chainSep) {
+		if str == "" {
+			return nil, fmt.Errorf("empty element in chain")
+		}
+		var (
+			r   Resolver
+			err error
+		)
+		if n := len(str); n >= 2 && str[0] == quote && str[n-1] == quote {
+			r = literal(str[1 : n-1])
+		} else {
+			r, err = parseResolver(str)
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.rs = append(c.rs, r)
+	}
+	return c, nil
+}
+
+func parseDatePath(str string) (Resolver, error) {
+	var rs []Resolver
+	switch strings.ToLower(str) {
+	case datePathYMD:
+		rs = append(rs, fragment{name: levelYear}, fragment{name: levelMonth}, fragment{name: levelDay})
+	case datePathYDoy:
+		rs = append(rs, fragment{name: levelYear}, fragment{name: levelDoy})
+	default:
+		return nil, fmt.Errorf("%s: unknown date hierarchy", str)
+	}
+	d := datepath{
+		name: str,
+		path: path{rs: rs},
+	}
+	return d, nil
+}
+
+func parseIndex(str string) (Resolver, error) {
+	var err error
 	x := strings.IndexByte(str, colon)
 	if x < 0 {
 		var i index
@@ -131,34 +1283,152 @@ func parseResolver(str string) (Resolver, error) {
 	return i, err
 }
 
-type empty struct{}
+type empty struct{}
+
+// empty is the resolver of an empty pattern. It gives the base name of the
+// file so that it is at least kept under its original name.
+func (e empty) Resolve(d Data) string {
+	if d.File == "" {
+		return ""
+	}
+	return filepath.Base(d.File)
+}
+
+func (e empty) String() string {
+	return ""
+}
+
+type path struct {
+	rs []Resolver
+}
+
+func (p path) Resolve(dat Data) string {
+	str, _ := p.resolveErr(dat)
+	return str
+}
+
+// resolveErr drops the segments that resolve to an empty value if they are
+// marked as optional. Other empty segments are an error.
+func (p path) resolveErr(dat Data) (string, error) {
+	str := make([]string, 0, len(p.rs))
+	for j, r := range p.rs {
+		s, err := resolveErr(r, dat)
+		if err != nil {
+			return "", err
+		}
+		if s == "" {
+			if isOptional(r) {
+				continue
+			}
+			return "", fmt.Errorf("%w: segment %d (%s)", ErrEmpty, j+1, r)
+		}
+		str = append(str, s)
+	}
+	return filepath.Join(str...), nil
+}
+
+func (p path) String() string {
+	str := make([]string, len(p.rs))
+	for j := range p.rs {
+		str[j] = p.rs[j].String()
+	}
+	return fmt.Sprintf("path(%s)", filepath.Join(str...))
+}
+
+// chain resolves to the first non empty value of its resolvers.
+type chain struct {
+	rs []Resolver
+}
+
+func (c chain) Resolve(dat Data) string {
+	str, _ := c.resolveErr(dat)
+	return str
+}
+
+// resolveErr only fails if the last resolver of the chain fails, the others
+// are only alternatives.
+func (c chain) resolveErr(dat Data) (string, error) {
+	for i, r := range c.rs {
+		str, err := resolveErr(r, dat)
+		if err != nil && i == len(c.rs)-1 {
+			return "", err
+		}
+		if err == nil && str != "" {
+			return str, nil
+		}
+	}
+	return "", nil
+}
+
+func (c chain) String() string {
+	str := make([]string, len(c.rs))
+	for j := range c.rs {
+		str[j] = c.rs[j].String()
+	}
+	return fmt.Sprintf("chain(%s)", strings.Join(str, "||"))
+}
+
+type datepath struct {
+	name string
+	path
+}
+
+func (d datepath) String() string {
+	return fmt.Sprintf("datepath(%s)", d.name)
+}
+
+type timefmt struct {
+	layout string
+}
+
+func (t timefmt) Resolve(dat Data) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':':
+			return '-'
+		default:
+			return r
+		}
+	}, dat.AcqTime.Format(t.layout))
+}
+
+// bucket gives the start of the window of the given width containing the
+// acquisition time.
+type bucket struct {
+	width  time.Duration
+	layout string
+}
 
-func (e empty) Resolve(d Data) string {
-	return "" //filepath.Base(d.File)
+func (b bucket) Resolve(dat Data) string {
+	dat.AcqTime = dat.AcqTime.Truncate(b.width)
+	return timefmt{layout: b.layout}.Resolve(dat)
 }
 
-func (e empty) String() string {
-	return ""
+func (b bucket) String() string {
+	return fmt.Sprintf("bucket(%s:%s)", b.width, b.layout)
 }
 
-type path struct {
-	rs []Resolver
+// msgdate gives a calendar field of the date of the message a file has been
+// extracted from instead of its acquisition time. It resolves to an empty
+// value if the message date is not known.
+type msgdate struct {
+	field fragment
 }
 
-func (p path) Resolve(dat Data) string {
-	str := make([]string, len(p.rs))
-	for j := range p.rs {
-		str[j] = p.rs[j].Resolve(dat)
+func (m msgdate) Resolve(dat Data) string {
+	if dat.MsgTime.IsZero() {
+		return ""
 	}
-	return filepath.Join(str...)
+	dat.AcqTime = dat.MsgTime
+	return m.field.Resolve(dat)
 }
 
-func (p path) String() string {
-	str := make([]string, len(p.rs))
-	for j := range p.rs {
-		str[j] = p.rs[j].String()
-	}
-	return fmt.Sprintf("path(%s)", filepath.Join(str...))
+func (m msgdate) String() string {
+	return fmt.Sprintf("msgdate(%s)", m.field.name)
+}
+
+func (t timefmt) String() string {
+	return fmt.Sprintf("time(%s)", t.layout)
 }
 
 type literal string
@@ -172,40 +1442,50 @@ func (i literal) String() string {
 }
 
 type index struct {
-	index int
+	index  int
+	origin bool
 }
 
 func (i index) Resolve(dat Data) string {
 	var (
-		dir = filepath.Dir(dat.File)
-		xs  = strings.Split(strings.TrimPrefix(dir, "/"), "/")
+		xs  = SplitComponents(dat.source(i.origin))
 		str string
 	)
-	if i.index < len(xs) {
+	if i.index >= 0 && i.index < len(xs) {
 		str = xs[i.index]
 	}
 	return str
 }
 
+func (i index) check(n int) error {
+	if i.index < 0 || i.index >= n {
+		return fmt.Errorf("%w: index %d (%d components)", ErrIndex, i.index, n)
+	}
+	return nil
+}
+
 func (i index) String() string {
+	if i.origin {
+		return fmt.Sprintf("index(%d!%s)", i.index, modOrigin)
+	}
 	return fmt.Sprintf("index(%d)", i.index)
 }
 
 type slice struct {
-	begin int
-	end   int
+	begin  int
+	end    int
+	origin bool
 }
 
 func (i slice) Resolve(dat Data) string {
 	var (
-		dir   = filepath.Dir(dat.File)
-		xs    = strings.Split(strings.TrimPrefix(dir, "/"), "/")
+		xs    = SplitComponents(dat.source(i.origin))
 		begin = normalize(i.begin, len(xs))
 		end   = normalize(i.end, len(xs))
 		str   string
 	)
 	switch {
-	case end == begin:
+	case end == begin && begin < len(xs):
 		str = xs[begin]
 	case end > begin:
 		str = filepath.Join(xs[begin:end]...)
@@ -213,10 +1493,54 @@ func (i slice) Resolve(dat Data) string {
 	return str
 }
 
+func (i slice) check(n int) error {
+	outside := func(x int) bool {
+		return x > n || -x > n
+	}
+	if outside(i.begin) || outside(i.end) || normalize(i.begin, n) >= n {
+		return fmt.Errorf("%w: range %d:%d (%d components)", ErrIndex, i.begin, i.end, n)
+	}
+	return nil
+}
+
 func (i slice) String() string {
+	if i.origin {
+		return fmt.Sprintf("range(%d:%d!%s)", i.begin, i.end, modOrigin)
+	}
 	return fmt.Sprintf("range(%d:%d)", i.begin, i.end)
 }
 
+// source gives the location used by the indexes and the ranges: the origin of
+// the file if origin is set, its name otherwise.
+func (d Data) source(origin bool) string {
+	if origin {
+		return d.Origin
+	}
+	return d.File
+}
+
+// SplitComponents splits the directory of file into its components as they are
+// used by the index, range, depth and parent elements of a pattern. Separators
+// are turned into slashes whatever the platform so that windows paths, leading,
+// trailing or doubled slashes do not give empty components. A trailing slash
+// means that file is a directory. It returns nil for a file without directory.
+func SplitComponents(file string) []string {
+	file = strings.ReplaceAll(file, "\\", "/")
+	if len(file) >= 2 && file[1] == colon {
+		file = file[2:]
+	}
+	var (
+		dir = filepath.ToSlash(filepath.Dir(file))
+		xs  []string
+	)
+	for _, x := range strings.Split(dir, "/") {
+		if x != "" && x != "." {
+			xs = append(xs, x)
+		}
+	}
+	return xs
+}
+
 func normalize(index, size int) int {
 	if index < 0 {
 		index = size + index
@@ -239,10 +1563,24 @@ func isSign(char byte) bool {
 
 type fragment struct {
 	name string
+	// first keeps only the first word of the value
+	first bool
 }
 
 func (f fragment) Resolve(dat Data) string {
+	return f.resolve(dat)
+}
+
+// resolve gives the value of the element named by f. The first word of the
+// values whose words are joined is taken before they are joined, the one of
+// the other values once they are resolved.
+func (f fragment) resolve(dat Data) string {
+	var joined bool
 	replace := func(str string) string {
+		if f.first {
+			str = firstWord(str)
+		}
+		joined = true
 		return strings.ReplaceAll(strings.Title(str), " ", "")
 	}
 
@@ -267,12 +1605,36 @@ func (f fragment) Resolve(dat Data) string {
 		str = replace(dat.Source)
 	case levelModel:
 		str = replace(dat.Model)
+	case levelMission:
+		str = replace(dat.Mission)
+	case levelOrigin:
+		str = dat.Origin
+	case levelVersion:
+		str = dat.Version
+	case levelFamily:
+		str = replace(modelFamily(dat.Model, dat.ModelFamily.Regexp))
 	case levelMime, levelFormat:
 		str = replace(splitMime(dat.Mime))
 	case levelType:
 		str = replace(dat.Type)
+	case levelCategory:
+		str = mimeCategory(dat.Mime)
+	case levelBatch:
+		if str = dat.Batch; str == "" {
+			str = DefaultBatchID
+		}
 	case levelYear:
 		str = strconv.Itoa(dat.AcqTime.Year())
+	case levelFiscal:
+		str = fmt.Sprintf("FY%d", fiscalYear(dat.AcqTime, dat.FiscalStart))
+	case levelMissionDay:
+		if !dat.Epoch.IsZero() {
+			if n := missionDay(dat.AcqTime, dat.Epoch); n < 0 {
+				str = fmt.Sprintf("-%04d", -n)
+			} else {
+				str = fmt.Sprintf("%04d", n)
+			}
+		}
 	case levelDoy:
 		str = fmt.Sprintf("%03d", dat.AcqTime.YearDay())
 	case levelMonth:
@@ -285,26 +1647,472 @@ func (f fragment) Resolve(dat Data) string {
 		str = fmt.Sprintf("%02d", dat.AcqTime.Minute())
 	case levelSecShort, levelSecLong:
 		str = fmt.Sprintf("%02d", dat.AcqTime.Second())
+	case levelSecOfDay:
+		h, m, sec := dat.AcqTime.Clock()
+		str = fmt.Sprintf("%05d", h*3600+m*60+sec)
 	case levelStamp:
 		str = strconv.Itoa(int(dat.AcqTime.Unix()))
+	case levelTag:
+		str = fmt.Sprintf("L%d", dat.Level)
+		if dat.Level == 0 && dat.LevelZero != "" {
+			str = dat.LevelZero
+		}
+	case levelStamp36:
+		str = formatStamp(dat.AcqTime.Unix(), 36)
+	case levelStamp32:
+		str = formatStamp(dat.AcqTime.Unix(), 32)
+	case levelDepth:
+		str = strconv.Itoa(len(SplitComponents(dat.File)))
+	case levelParent:
+		str = parentDir(dat.File, 1)
+	case levelGrand:
+		str = parentDir(dat.File, 2)
+	}
+	if f.first && !joined {
+		str = firstWord(str)
 	}
 	return str
 }
 
 func (f fragment) String() string {
+	if f.first {
+		return fmt.Sprintf("fragment(%s!%s)", f.name, modFirst)
+	}
 	return fmt.Sprintf("fragment(%s)", f.name)
 }
 
+// firstWord gives str up to its first white space.
+func firstWord(str string) string {
+	str = strings.TrimSpace(str)
+	if x := strings.IndexFunc(str, unicode.IsSpace); x >= 0 {
+		str = str[:x]
+	}
+	return str
+}
+
+type metadata struct {
+	name string
+}
+
+func (m metadata) Resolve(dat Data) string {
+	for _, p := range dat.Parameters {
+		if p.Name == m.name {
+			return p.Value
+		}
+	}
+	return ""
+}
+
+func (m metadata) String() string {
+	return fmt.Sprintf("meta(%s)", m.name)
+}
+
+// table gives the label of the value of field found in the lookup table having
+// the same name as field. It resolves to an empty value if the value is not in
+// the table.
+type table struct {
+	field fragment
+}
+
+func (t table) Resolve(dat Data) string {
+	str, ok := lookup(dat.Lookups.Table(t.field.name), t.field.Resolve(dat))
+	if !ok {
+		return ""
+	}
+	return str
+}
+
+func (t table) String() string {
+	return fmt.Sprintf("lookup(%s)", t.field.name)
+}
+
+// fanout splits the hexadecimal digest of a file into directories of the given
+// widths followed by the rest of the digest.
+type fanout struct {
+	widths []int
+}
+
+func (f fanout) Resolve(dat Data) string {
+	var (
+		sum = strings.ToLower(dat.Sum)
+		str []string
+	)
+	if sum == "" {
+		return ""
+	}
+	for _, w := range f.widths {
+		if w >= len(sum) {
+			break
+		}
+		str, sum = append(str, sum[:w]), sum[w:]
+	}
+	return strings.Join(append(str, sum), "/")
+}
+
+func (f fanout) String() string {
+	str := make([]string, len(f.widths))
+	for i := range f.widths {
+		str[i] = strconv.Itoa(f.widths[i])
+	}
+	return fmt.Sprintf("fanout(%s)", strings.Join(str, ","))
+}
+
+// join gives the non empty values of its elements separated by sep.
+type join struct {
+	rs  []Resolver
+	sep string
+}
+
+func (j join) Resolve(dat Data) string {
+	var str []string
+	for _, r := range j.rs {
+		if s := r.Resolve(dat); s != "" {
+			str = append(str, s)
+		}
+	}
+	return strings.Join(str, j.sep)
+}
+
+func (j join) String() string {
+	str := make([]string, len(j.rs))
+	for i := range j.rs {
+		str[i] = j.rs[i].String()
+	}
+	return fmt.Sprintf("join(%s:%s)", strings.Join(str, ","), j.sep)
+}
+
+// volume chooses one of its choices from a hash of the value of field so that
+// a file is always given the same choice. The digest of the file, or its name
+// if it has no digest, is used when field is not set.
+type volume struct {
+	choices []string
+	field   string
+}
+
+func (v volume) Resolve(dat Data) string {
+	var str string
+	switch {
+	case v.field != "":
+		str = fragment{name: v.field}.Resolve(dat)
+	case dat.Sum != "":
+		str = strings.ToLower(dat.Sum)
+	default:
+		str = dat.File
+	}
+	h := fnv.New32a()
+	io.WriteString(h, str)
+	return v.choices[h.Sum32()%uint32(len(v.choices))]
+}
+
+func (v volume) String() string {
+	return fmt.Sprintf("volume(%s:%s)", strings.Join(v.choices, ","), v.field)
+}
+
+const (
+	// grepLimit is the number of bytes of a file read by grep.
+	grepLimit = 1 << 20
+	// grepCacheSize is the number of files whose value is kept by grep.
+	grepCacheSize = 1024
+)
+
+// grep gives the group of the first line of the file matching the regular
+// expression. Only the first grepLimit bytes of the file are read and the
+// value found for the last grepCacheSize files is kept so that they are only
+// read once.
+type grep struct {
+	re    *regexp.Regexp
+	group int
+	cache *grepCache
+}
+
+func (g grep) Resolve(dat Data) string {
+	if dat.File == "" {
+		return ""
+	}
+	if str, ok := g.cache.get(dat.File); ok {
+		return str
+	}
+	str := g.search(dat.File)
+	g.cache.put(dat.File, str)
+	return str
+}
+
+func (g grep) search(file string) string {
+	r, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer r.Close()
+
+	scan := bufio.NewScanner(io.LimitReader(r, grepLimit))
+	for scan.Scan() {
+		if ms := g.re.FindStringSubmatch(scan.Text()); ms != nil {
+			return ms[g.group]
+		}
+	}
+	return ""
+}
+
+func (g grep) String() string {
+	return fmt.Sprintf("grep(%s:%d)", g.re, g.group)
+}
+
+// grepCache keeps the values found in the last files read by a grep. The
+// files are not read while the lock is held: two goroutines resolving the same
+// file at the same time can both read it.
+type grepCache struct {
+	mu     sync.Mutex
+	size   int
+	values map[string]string
+	files  []string
+}
+
+func newGrepCache(size int) *grepCache {
+	return &grepCache{
+		size:   size,
+		values: make(map[string]string),
+	}
+}
+
+func (c *grepCache) get(file string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	str, ok := c.values[file]
+	return str, ok
+}
+
+// put registers the value of file, removing the oldest file if the cache is
+// full.
+func (c *grepCache) put(file, str string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.values[file]; ok {
+		return
+	}
+	if len(c.files) >= c.size {
+		delete(c.values, c.files[0])
+		c.files = c.files[1:]
+	}
+	c.values[file] = str
+	c.files = append(c.files, file)
+}
+
+// ordinal gives the number of times the value of field has been seen while
+// resolving the files of a run. Resolving the same file again gives the same
+// value.
+type ordinal struct {
+	field fragment
+	seen  *occurrences
+}
+
+func (o ordinal) Resolve(dat Data) string {
+	n := o.seen.count(o.field.Resolve(dat), dat.File)
+	return fmt.Sprintf("%03d", n)
+}
+
+func (o ordinal) String() string {
+	return fmt.Sprintf("ordinal(%s)", o.field.name)
+}
+
+type occurrences struct {
+	mu     sync.Mutex
+	values map[string]int
+	files  map[[2]string]int
+}
+
+func newOccurrences() *occurrences {
+	return &occurrences{
+		values: make(map[string]int),
+		files:  make(map[[2]string]int),
+	}
+}
+
+func (o *occurrences) count(value, file string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	k := [2]string{value, file}
+	if n, ok := o.files[k]; ok {
+		return n
+	}
+	o.values[value]++
+	n := o.values[value]
+	o.files[k] = n
+	return n
+}
+
+// optional marks the segment where it appears as one that can be omitted
+// when it resolves to an empty value.
+type optional struct {
+	Resolver
+}
+
+func (o optional) resolveErr(dat Data) (string, error) {
+	return resolveErr(o.Resolver, dat)
+}
+
+func (o optional) String() string {
+	return fmt.Sprintf("optional(%s)", o.Resolver)
+}
+
+func isOptional(r Resolver) bool {
+	switch r := r.(type) {
+	case optional:
+		return true
+	case compound:
+		for _, r := range r.rs {
+			if isOptional(r) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// modifier applies its transforms on the value given by its Resolver.
+type modifier struct {
+	Resolver
+	transforms []transform
+}
+
+func (m modifier) Resolve(dat Data) string {
+	str, _ := m.resolveErr(dat)
+	return str
+}
+
+func (m modifier) resolveErr(dat Data) (string, error) {
+	str, err := resolveErr(m.Resolver, dat)
+	if err != nil {
+		return "", err
+	}
+	for _, t := range m.transforms {
+		if str, err = t.apply(str, dat); err != nil {
+			return "", fmt.Errorf("%s: %w", m.Resolver, err)
+		}
+	}
+	return str, nil
+}
+
+func (m modifier) String() string {
+	var buf strings.Builder
+	buf.WriteString(m.Resolver.String())
+	for _, t := range m.transforms {
+		buf.WriteByte(bang)
+		buf.WriteString(t.String())
+	}
+	return buf.String()
+}
+
+// transform is a modifier applied on the value of a fragment once resolved.
+type transform struct {
+	name string
+	arg  string
+
+	width int
+	fill  string
+}
+
+func (t transform) apply(str string, dat Data) (string, error) {
+	switch t.name {
+	case modAlias:
+		str, _ = lookup(dat.Aliases, str)
+	case modFirst:
+		str = firstWord(str)
+	case modFlat:
+		str = strings.NewReplacer("/", t.arg, "\\", t.arg).Replace(str)
+	case modRequired:
+		if str == "" {
+			return "", ErrEmpty
+		}
+	case modFormat:
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("%s: not a number", str)
+		}
+		str = fmt.Sprintf(t.arg, n)
+	case modPad:
+		fill := t.fill
+		if fill == "" {
+			fill = "0"
+		}
+		if n := utf8.RuneCountInString(str); n < t.width {
+			str = strings.Repeat(fill, t.width-n) + str
+		}
+	}
+	return str, nil
+}
+
+func (t transform) String() string {
+	if t.arg == "" {
+		return t.name
+	}
+	return t.name + string(equal) + t.arg
+}
+
+// lookup searches str in table ignoring case. str is returned as is if it is
+// not found.
+func lookup(table map[string]string, str string) (string, bool) {
+	if v, ok := table[str]; ok {
+		return v, ok
+	}
+	for k, v := range table {
+		if strings.EqualFold(k, str) {
+			return v, true
+		}
+	}
+	return str, false
+}
+
 type compound struct {
 	rs []Resolver
 }
 
 func (c compound) Resolve(dat Data) string {
-	var buf strings.Builder
+	str, _ := c.resolveErr(dat)
+	return str
+}
+
+// resolveErr concatenates the values of the elements of c. A separator is only
+// written if the value before it and the one right after it are not empty.
+func (c compound) resolveErr(dat Data) (string, error) {
+	var (
+		buf     strings.Builder
+		pending string
+	)
 	for _, r := range c.rs {
-		buf.WriteString(r.Resolve(dat))
+		if s, ok := r.(separator); ok {
+			pending = string(s)
+			continue
+		}
+		str, err := resolveErr(r, dat)
+		if err != nil {
+			return "", err
+		}
+		if str == "" {
+			pending = ""
+			continue
+		}
+		if buf.Len() > 0 {
+			buf.WriteString(pending)
+		}
+		pending = ""
+		buf.WriteString(str)
 	}
-	return buf.String()
+	return buf.String(), nil
+}
+
+// separator is written between the values of the elements of a compound
+// surrounding it only if both are not empty. It gives an empty value alone.
+type separator string
+
+func (s separator) Resolve(_ Data) string {
+	return ""
+}
+
+func (s separator) String() string {
+	return fmt.Sprintf("sep(%s)", string(s))
 }
 
 func (c compound) String() string {
@@ -315,6 +2123,134 @@ func (c compound) String() string {
 	return fmt.Sprintf("compound(%s)", buf.String())
 }
 
+// fiscalYear gives the year when the fiscal year of w has started. A fiscal
+// year starts the first day of the start month (january if start is not a
+// valid month).
+func fiscalYear(w time.Time, start int) int {
+	year := w.Year()
+	if start > 1 && start <= 12 && int(w.Month()) < start {
+		year--
+	}
+	return year
+}
+
+// missionDay gives the number of days elapsed since epoch. The day before the
+// epoch is -1.
+func missionDay(w, epoch time.Time) int {
+	const day = 24 * time.Hour
+	var (
+		diff = w.Sub(epoch)
+		n    = int(diff / day)
+	)
+	if diff < 0 && diff%day != 0 {
+		n--
+	}
+	return n
+}
+
+var numberVerb = regexp.MustCompile(`^%[-+ 0]*[0-9]*[dxXob]$`)
+
+var familyVersion = regexp.MustCompile(`-\d+$`)
+
+// modelFamily gives the family of model. If re has a group, the family is the
+// value of the first one otherwise the text matching re is removed from model.
+// By default, a trailing -N version is removed.
+func modelFamily(model string, re *regexp.Regexp) string {
+	if re == nil {
+		re = familyVersion
+	}
+	if re.NumSubexp() == 0 {
+		return re.ReplaceAllString(model, "")
+	}
+	if xs := re.FindStringSubmatch(model); len(xs) > 1 {
+		return xs[1]
+	}
+	return model
+}
+
+// parentDir gives the name of the directory found level directories above
+// file or an empty string if there is none.
+func parentDir(file string, level int) string {
+	xs := SplitComponents(file)
+	if level <= 0 || level > len(xs) {
+		return ""
+	}
+	return xs[len(xs)-level]
+}
+
+const (
+	stampWidth = 7
+	crockford  = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+)
+
+// formatStamp encodes stamp in lower case base36 or in Crockford base32. The
+// result is left padded with zeros to a fixed width so that the lexical order
+// of the encoded stamps is the same as their chronological order.
+func formatStamp(stamp int64, base int) string {
+	if stamp < 0 {
+		return "-" + formatStamp(-stamp, base)
+	}
+	var str string
+	if base == 32 {
+		var buf []byte
+		for x := uint64(stamp); x > 0; x /= 32 {
+			buf = append([]byte{crockford[x%32]}, buf...)
+		}
+		str = string(buf)
+	} else {
+		str = strconv.FormatInt(stamp, base)
+	}
+	if n := len(str); n < stampWidth {
+		str = strings.Repeat("0", stampWidth-n) + str
+	}
+	return str
+}
+
+var extensions = map[string]string{
+	MimePlain:              ".txt",
+	MimeCsv:                ".csv",
+	MimeJpeg:               ".jpg",
+	MimePng:                ".png",
+	MimeQuick:              ".mov",
+	MimeGz:                 ".gz",
+	"text/html":            ".html",
+	"text/xml":             ".xml",
+	"application/xml":      ".xml",
+	"application/json":     ".json",
+	"application/x-ndjson": ".ndjson",
+	"application/pdf":      ".pdf",
+	"application/zip":      ".zip",
+	"image/gif":            ".gif",
+	"image/tiff":           ".tiff",
+	"video/mp4":            ".mp4",
+	"message/rfc822":       ".eml",
+}
+
+// MimeExtension gives the extension, with its leading dot, of the files of the
+// given mime type or an empty string if it is not known.
+func MimeExtension(mime string) string {
+	if x := strings.IndexByte(mime, ';'); x >= 0 {
+		mime = mime[:x]
+	}
+	return extensions[strings.ToLower(strings.TrimSpace(mime))]
+}
+
+const categoryUnknown = "unknown"
+
+// mimeCategory gives the main type of mime if it is one of text, image, audio,
+// video or application and unknown otherwise.
+func mimeCategory(mime string) string {
+	if ix := strings.Index(mime, "/"); ix >= 0 {
+		mime = mime[:ix]
+	}
+	switch mime = strings.ToLower(strings.TrimSpace(mime)); mime {
+	case "text", "image", "audio", "video", "application":
+		return mime
+	default:
+		return categoryUnknown
+	}
+}
+
 func splitMime(mime string) string {
 	if ix := strings.Index(mime, "/"); ix >= 0 && ix+1 < len(mime) {
 		mime = mime[ix+1:]
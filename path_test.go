@@ -0,0 +1,1432 @@
+package prospect
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPatternResolveErr(t *testing.T) {
+	data := []struct {
+		Pattern string
+		Data    Data
+		Want    string
+		Err     error
+	}{
+		{
+			Pattern: "{meta:run!required}",
+			Data:    Data{Parameters: []Parameter{{Name: "run", Value: "R1"}}},
+			Want:    "R1",
+		},
+		{
+			Pattern: "{meta:run!required}",
+			Err:     ErrEmpty,
+		},
+		{
+			Pattern: "{source}/{model}",
+			Data:    Data{Source: "src"},
+			Err:     ErrEmpty,
+		},
+		{
+			Pattern: "{source}/{model?}",
+			Data:    Data{Source: "src"},
+			Want:    "Src",
+		},
+		{
+			Pattern: "{source}/{model?}/{type}",
+			Data:    Data{Source: "src", Type: "data"},
+			Want:    "Src/Data",
+		},
+		{
+			Pattern: "{source}/{model?}/{type}",
+			Data:    Data{Source: "src", Model: "fm", Type: "data"},
+			Want:    "Src/Fm/Data",
+		},
+		{
+			Pattern: "{source}/{model?}/{mime?}",
+			Data:    Data{Source: "src"},
+			Want:    "Src",
+		},
+		{
+			Pattern: "{model?}/{type}",
+			Data:    Data{Source: "src"},
+			Err:     ErrEmpty,
+		},
+	}
+	for _, d := range data {
+		p, err := NewPattern(d.Pattern)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Pattern, err)
+			continue
+		}
+		got, err := p.ResolveErr(d.Data)
+		if d.Err != nil {
+			if !errors.Is(err, d.Err) {
+				t.Errorf("%s: expected error %v, got %v", d.Pattern, d.Err, err)
+			}
+			if str := p.Resolve(d.Data); str != "" {
+				t.Errorf("%s: Resolve should give an empty string, got %s", d.Pattern, str)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Pattern, err)
+			continue
+		}
+		if got != d.Want {
+			t.Errorf("%s: paths mismatched! want %s, got %s", d.Pattern, d.Want, got)
+		}
+	}
+}
+
+func TestGrep(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		match = filepath.Join(dir, "match.txt")
+		other = filepath.Join(dir, "other.txt")
+	)
+	if err := ioutil.WriteFile(match, []byte("header\nID=2021:ABC!\nINSTR=HDRC-2 rev 1\nINSTR=X\nend:12\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(other, []byte("nothing to see\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data := []struct {
+		Pattern string
+		Want    string
+		Empty   bool
+	}{
+		{Pattern: `{grep:^INSTR=(\S+)}`, Want: "HDRC-2"},
+		{Pattern: `{grep:^(\w+)=\d+:(\S+):2}`, Want: "ABC!"},
+		{Pattern: `{grep:^ID=(\d{4})}`, Want: "2021"},
+		{Pattern: `{grep:^ID=\d{4}:(\w+)!}`, Want: "ABC"},
+		{Pattern: `{grep:^end:1?}`, Want: "end:1"},
+		{Pattern: `{grep:^end\:12}`, Want: "end:12"},
+		{Pattern: `{grep:\{x\}||'none'}`, Want: "none", Empty: true},
+		{Pattern: `{grep:rev (\d)}/{grep:^INSTR=(\w+)}`, Want: "1/HDRC", Empty: true},
+	}
+	for _, d := range data {
+		p, err := NewPattern(d.Pattern)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Pattern, err)
+			continue
+		}
+		if got := p.Resolve(Data{File: match}); got != d.Want {
+			t.Errorf("%s: values mismatched! want %q, got %q", d.Pattern, d.Want, got)
+		}
+		got, err := p.ResolveErr(Data{File: other})
+		switch {
+		case d.Empty && err == nil && got != "none":
+			t.Errorf("%s: expected an error or the fallback without match, got %q", d.Pattern, got)
+		case !d.Empty && !errors.Is(err, ErrEmpty):
+			t.Errorf("%s: expected an empty value without match, got %q (%v)", d.Pattern, got, err)
+		}
+	}
+	for _, str := range []string{`{grep:}`, `{grep:(x}`, `{grep:(x):3}`, `{grep:^ID=(\d{4}}`} {
+		if _, err := NewPattern(str); err == nil {
+			t.Errorf("%s: expected an error", str)
+		}
+	}
+}
+
+func TestGrepCache(t *testing.T) {
+	c := newGrepCache(2)
+	for i := 0; i < 3; i++ {
+		c.put(fmt.Sprintf("file%d", i), fmt.Sprint(i))
+	}
+	if _, ok := c.get("file0"); ok {
+		t.Errorf("the oldest file should have been removed from the cache")
+	}
+	for _, f := range []string{"file1", "file2"} {
+		if _, ok := c.get(f); !ok {
+			t.Errorf("%s: should be in the cache", f)
+		}
+	}
+
+	file := filepath.Join(t.TempDir(), "file.txt")
+	if err := ioutil.WriteFile(file, []byte("ID=42\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPattern(`{grep:^ID=(\d+)}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := p.Resolve(Data{File: file}); got != "42" {
+				t.Errorf("values mismatched! want 42, got %s", got)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPatternConcurrent(t *testing.T) {
+	const workers = 64
+
+	var (
+		dir   = t.TempDir()
+		files = make([]string, workers)
+	)
+	for i := range files {
+		files[i] = filepath.Join(dir, fmt.Sprintf("file%d.txt", i))
+		if err := ioutil.WriteFile(files[i], []byte("ID=42\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p, err := NewPattern(`{source}/{ordinal:source}/{grep:^ID=(\d+)}/{year}`, WithLowercase(), WithMaxComponent(8, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		paths = make(map[string]string)
+		when  = time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC)
+	)
+	for _, f := range files {
+		wg.Add(1)
+		go func(file string) {
+			defer wg.Done()
+			dat := Data{
+				File:    file,
+				Source:  "src",
+				AcqTime: when,
+			}
+			first := p.Resolve(dat)
+			if again := p.Resolve(dat); again != first {
+				t.Errorf("%s: resolving the same file gives different paths: %s and %s", file, first, again)
+			}
+			mu.Lock()
+			paths[file] = first
+			mu.Unlock()
+		}(f)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for _, str := range paths {
+		if seen[str] {
+			t.Errorf("%s: path given to more than one file", str)
+		}
+		seen[str] = true
+	}
+	for i := 1; i <= workers; i++ {
+		if want := fmt.Sprintf("src/%03d/42/2021", i); !seen[want] {
+			t.Errorf("%s: path not resolved", want)
+		}
+	}
+}
+
+func TestTypeFallback(t *testing.T) {
+	data := []struct {
+		Pattern string
+		Data    Data
+		Want    string
+	}{
+		{Pattern: "{type||category}", Data: Data{Type: "science", Mime: "image/png"}, Want: "Science"},
+		{Pattern: "{type||category}", Data: Data{Mime: "image/png"}, Want: "image"},
+		{Pattern: "{type||category}", Data: Data{Mime: "chemical/x-pdb"}, Want: "unknown"},
+		{Pattern: "{type||category}", Data: Data{}, Want: "unknown"},
+		{Pattern: "{type||category!pad=8!padleft=_}/{year}", Data: Data{Mime: "text/csv", AcqTime: time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC)}, Want: "____text/2021"},
+	}
+	for _, d := range data {
+		p, err := NewPattern(d.Pattern)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Pattern, err)
+			continue
+		}
+		if got := p.Resolve(d.Data); got != d.Want {
+			t.Errorf("%s: values mismatched! want %q, got %q", d.Pattern, d.Want, got)
+		}
+	}
+}
+
+func TestFirstWord(t *testing.T) {
+	data := []struct {
+		Pattern string
+		Data    Data
+		Want    string
+	}{
+		{Pattern: "{source!firstword}", Data: Data{Source: "HDRC camera 1"}, Want: "HDRC"},
+		{Pattern: "{source}", Data: Data{Source: "HDRC camera 1"}, Want: "HDRCCamera1"},
+		{Pattern: "{model!firstword}", Data: Data{Model: "  flight model"}, Want: "Flight"},
+		{Pattern: "{run!firstword}", Data: Data{Source: "R1 extra"}, Want: "R1"},
+		{Pattern: "{version!firstword}", Data: Data{Version: "v3 beta"}, Want: "v3"},
+		{Pattern: "{source!firstword!pad=6!padleft=_}", Data: Data{Source: "hdrc camera"}, Want: "__Hdrc"},
+		{Pattern: "{source!firstword}", Data: Data{}, Want: ""},
+	}
+	for _, d := range data {
+		p, err := NewPattern(d.Pattern)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Pattern, err)
+			continue
+		}
+		if got := p.Resolve(d.Data); got != d.Want {
+			t.Errorf("%s: values mismatched! want %q, got %q", d.Pattern, d.Want, got)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	t.Cleanup(func() {
+		partmu.Lock()
+		defer partmu.Unlock()
+		delete(partials, "test.parse-error")
+	})
+	if err := RegisterPartial("test.parse-error", "{source}/{model}"); err != nil {
+		t.Fatal(err)
+	}
+	data := []struct {
+		Pattern string
+		Offset  int
+		Text    string
+	}{
+		{Pattern: "{source", Offset: 0, Text: "{source"},
+		{Pattern: "a/{}", Offset: 2, Text: "{}"},
+		{Pattern: "/{source}/{bogus!nope}", Offset: 10, Text: "{bogus!nope}"},
+		{Pattern: "x/{year}/y{meta:}z", Offset: 10, Text: "{meta:}"},
+		{Pattern: "{source}/{model}/{1:x}", Offset: 17, Text: "{1:x}"},
+		{Pattern: "{source}{", Offset: 8, Text: "{"},
+		{Pattern: "//a/{time:}", Offset: 4, Text: "{time:}"},
+		{Pattern: "{level!fmt=%s}", Offset: 0, Text: "{level!fmt=%s}"},
+		{Pattern: "{@test.parse-error}/{year!pad=x}", Offset: 17, Text: "{year!pad=x}"},
+	}
+	for _, d := range data {
+		_, err := NewPattern(d.Pattern)
+		var pe *ParseError
+		if !errors.As(err, &pe) {
+			t.Errorf("%s: expected a ParseError, got %v", d.Pattern, err)
+			continue
+		}
+		if pe.Offset != d.Offset || pe.Text != d.Text {
+			t.Errorf("%s: error mismatched! want %d/%s, got %d/%s", d.Pattern, d.Offset, d.Text, pe.Offset, pe.Text)
+		}
+		if pe.Unwrap() == nil {
+			t.Errorf("%s: ParseError should wrap the cause of the error", d.Pattern)
+		}
+	}
+}
+
+func TestFormatModifier(t *testing.T) {
+	data := []struct {
+		Pattern string
+		Level   int
+		Want    string
+		Invalid bool
+	}{
+		{Pattern: "{level!fmt=%03d}", Level: 2, Want: "002"},
+		{Pattern: "{level!fmt=%d}", Level: 12, Want: "12"},
+		{Pattern: "{level!fmt=%x}", Level: 255, Want: "ff"},
+		{Pattern: "{level!fmt=%X}", Level: 255, Want: "FF"},
+		{Pattern: "{level!fmt=%o}", Level: 8, Want: "10"},
+		{Pattern: "{level!fmt=%b}", Level: 5, Want: "101"},
+		{Pattern: "{level!fmt=%-3d}_", Level: 1, Want: "1  _"},
+		{Pattern: "{level!fmt=L%02d}", Invalid: true},
+		{Pattern: "{level!fmt=%s}", Invalid: true},
+		{Pattern: "{level!fmt=%d%d}", Invalid: true},
+		{Pattern: "{level!fmt=}", Invalid: true},
+		{Pattern: "{level!fmt=%v}", Invalid: true},
+	}
+	for _, d := range data {
+		p, err := NewPattern(d.Pattern)
+		if d.Invalid {
+			if err == nil {
+				t.Errorf("%s: expected an error", d.Pattern)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Pattern, err)
+			continue
+		}
+		if got := p.Resolve(Data{Level: d.Level}); got != d.Want {
+			t.Errorf("%s: values mismatched! want %q, got %q", d.Pattern, d.Want, got)
+		}
+	}
+	p, _ := NewPattern("{source!fmt=%03d}")
+	if _, err := p.ResolveErr(Data{Source: "src"}); err == nil {
+		t.Errorf("formatting a value that is not a number should fail")
+	}
+}
+
+func TestResolveStrict(t *testing.T) {
+	const file = "/data/a/b/c/file.dat"
+	data := []struct {
+		Pattern string
+		Want    string
+		Err     error
+		Strict  error
+	}{
+		{Pattern: "{0}", Want: "data"},
+		{Pattern: "{2}", Want: "b"},
+		{Pattern: "{1:3}", Want: "a/b"},
+		{Pattern: "{3:3}", Want: "c"},
+		{Pattern: "{depth}", Want: "4"},
+		{Pattern: "{parent}/{grandparent}", Want: "c/b"},
+		{Pattern: "{0}/{4?}", Want: "data", Strict: ErrIndex},
+		{Pattern: "{0}/{4}", Err: ErrEmpty, Strict: ErrIndex},
+		{Pattern: "{0}/{5?}", Want: "data", Strict: ErrIndex},
+		{Pattern: "{0:10}", Want: "data/a/b/c", Strict: ErrIndex},
+		{Pattern: "{-10:2}", Want: "data/a", Strict: ErrIndex},
+		{Pattern: "{10:12}", Err: ErrEmpty, Strict: ErrIndex},
+	}
+	for _, d := range data {
+		p, err := NewPattern(d.Pattern)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Pattern, err)
+			continue
+		}
+		dat := Data{File: file}
+		got, err := p.ResolveErr(dat)
+		switch {
+		case d.Err != nil && !errors.Is(err, d.Err):
+			t.Errorf("%s: expected error %v, got %v", d.Pattern, d.Err, err)
+		case d.Err == nil && err != nil:
+			t.Errorf("%s: unexpected error: %s", d.Pattern, err)
+		case d.Err == nil && got != d.Want:
+			t.Errorf("%s: values mismatched! want %q, got %q", d.Pattern, d.Want, got)
+		}
+
+		got, err = p.ResolveStrict(dat)
+		if d.Strict != nil {
+			if !errors.Is(err, d.Strict) {
+				t.Errorf("%s: strict: expected error %v, got %v", d.Pattern, d.Strict, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: strict: unexpected error: %s", d.Pattern, err)
+			continue
+		}
+		if got != d.Want {
+			t.Errorf("%s: strict: values mismatched! want %q, got %q", d.Pattern, d.Want, got)
+		}
+	}
+}
+
+// resolveCase is a pattern resolved by checkResolve. Invalid patterns should
+// fail to parse.
+type resolveCase struct {
+	Pattern string
+	Data    Data
+	Want    string
+	Err     error
+	Invalid bool
+}
+
+func checkResolve(t *testing.T, data []resolveCase, options ...PatternOption) {
+	t.Helper()
+	for _, d := range data {
+		p, err := NewPattern(d.Pattern, options...)
+		if d.Invalid {
+			if err == nil {
+				t.Errorf("%s: expected a parse error", d.Pattern)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Pattern, err)
+			continue
+		}
+		got, err := p.ResolveErr(d.Data)
+		if d.Err != nil {
+			if !errors.Is(err, d.Err) {
+				t.Errorf("%s: expected error %v, got %v", d.Pattern, d.Err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Pattern, err)
+			continue
+		}
+		if got != d.Want {
+			t.Errorf("%s: values mismatched! want %q, got %q", d.Pattern, d.Want, got)
+		}
+	}
+}
+
+func TestDatePath(t *testing.T) {
+	var (
+		when = time.Date(2021, 5, 7, 10, 52, 9, 0, time.UTC)
+		dat  = Data{Source: "src", AcqTime: when}
+	)
+	checkResolve(t, []resolveCase{
+		{Pattern: "{datepath:ymd}", Data: dat, Want: "2021/05/07"},
+		{Pattern: "{datepath:ydoy}", Data: dat, Want: "2021/127"},
+		{Pattern: "{datepath:YMD}", Data: dat, Want: "2021/05/07"},
+		{Pattern: "{source}/{datepath:ydoy}/{hour}", Data: dat, Want: "Src/2021/127/10"},
+		{Pattern: "{datepath:ymd}", Data: Data{AcqTime: time.Date(2020, 12, 31, 0, 0, 0, 0, time.UTC)}, Want: "2020/12/31"},
+		{Pattern: "{datepath:ydoy}", Data: Data{AcqTime: time.Date(2020, 12, 31, 0, 0, 0, 0, time.UTC)}, Want: "2020/366"},
+		{Pattern: "{datepath:ym}", Invalid: true},
+		{Pattern: "{datepath:}", Invalid: true},
+	})
+}
+
+func TestTimeLayout(t *testing.T) {
+	dat := Data{AcqTime: time.Date(2021, 5, 7, 10, 52, 9, 0, time.UTC)}
+	checkResolve(t, []resolveCase{
+		{Pattern: "{time:2006}", Data: dat, Want: "2021"},
+		{Pattern: "{time:20060102}/{time:150405}", Data: dat, Want: "20210507/105209"},
+		{Pattern: "{time:2006-01-02T15}", Data: dat, Want: "2021-05-07T10"},
+		{Pattern: "{time:15:04}", Data: dat, Want: "10-52"},
+		{Pattern: "{time:2006/01}", Data: dat, Want: "2021-05"},
+		{Pattern: "{time:Jan}", Data: dat, Want: "May"},
+		{Pattern: "{time:}", Invalid: true},
+	})
+}
+
+func TestChain(t *testing.T) {
+	checkResolve(t, []resolveCase{
+		{Pattern: "{model||source||type}", Data: Data{Model: "fm", Source: "src", Type: "data"}, Want: "Fm"},
+		{Pattern: "{model||source||type}", Data: Data{Source: "src", Type: "data"}, Want: "Src"},
+		{Pattern: "{model||source||type}", Data: Data{Type: "data"}, Want: "Data"},
+		{Pattern: "{model||source||'unknown'}", Want: "unknown"},
+		{Pattern: "{meta:run||'R0'}", Data: Data{Parameters: []Parameter{{Name: "run", Value: "R1"}}}, Want: "R1"},
+		{Pattern: "{meta:run||'R0'}", Want: "R0"},
+		{Pattern: "{year}/{model||source}", Data: Data{AcqTime: time.Date(2021, 5, 7, 0, 0, 0, 0, time.UTC)}, Err: ErrEmpty},
+	})
+}
+
+func TestParentFragments(t *testing.T) {
+	checkResolve(t, []resolveCase{
+		{Pattern: "{parent}", Data: Data{File: "/data/a/b/c/file.dat"}, Want: "c"},
+		{Pattern: "{grandparent}/{parent}", Data: Data{File: "/data/a/b/c/file.dat"}, Want: "b/c"},
+		{Pattern: "{parent}", Data: Data{File: "/data/a/b/c/"}, Want: "c"},
+		{Pattern: "{parent}", Data: Data{File: "data//a\\file.dat"}, Want: "a"},
+		{Pattern: "{parent}", Data: Data{File: "/data/file.dat"}, Want: "data"},
+		{Pattern: "{grandparent?}/{parent}", Data: Data{File: "/data/file.dat"}, Want: "data"},
+		{Pattern: "{grandparent}", Data: Data{File: "/data/file.dat"}, Err: ErrEmpty},
+		{Pattern: "{parent}", Data: Data{File: "file.dat"}, Err: ErrEmpty},
+	})
+}
+
+func TestPadModifier(t *testing.T) {
+	dat := Data{Source: "src", Model: "fm", AcqTime: time.Date(2021, 1, 7, 0, 0, 0, 0, time.UTC)}
+	checkResolve(t, []resolveCase{
+		{Pattern: "{doy!pad=5}", Data: dat, Want: "00007"},
+		{Pattern: "{source!pad=5}", Data: dat, Want: "00Src"},
+		{Pattern: "{source!pad=5!padleft=_}", Data: dat, Want: "__Src"},
+		{Pattern: "{source!padleft=_!pad=5}", Data: dat, Want: "__Src"},
+		{Pattern: "{source!pad=2}", Data: dat, Want: "Src"},
+		{Pattern: "{model||source!pad=4}", Data: dat, Want: "Fm"},
+		{Pattern: "{model||source!pad=4}", Data: Data{Source: "src"}, Want: "0Src"},
+		{Pattern: "{source!pad=0}", Invalid: true},
+		{Pattern: "{source!pad=x}", Invalid: true},
+		{Pattern: "{source!pad=5!padleft=ab}", Invalid: true},
+	})
+}
+
+func TestLevelTag(t *testing.T) {
+	checkResolve(t, []resolveCase{
+		{Pattern: "{leveltag}", Data: Data{Level: 0}, Want: "L0"},
+		{Pattern: "{leveltag}", Data: Data{Level: 1}, Want: "L1"},
+		{Pattern: "{leveltag}", Data: Data{Level: 12}, Want: "L12"},
+		{Pattern: "{leveltag}", Data: Data{Level: 0, LevelZero: "RAW"}, Want: "RAW"},
+		{Pattern: "{leveltag}", Data: Data{Level: 2, LevelZero: "RAW"}, Want: "L2"},
+		{Pattern: "{source}/{leveltag}", Data: Data{Source: "src", Level: 1}, Want: "Src/L1"},
+	})
+}
+
+func TestDepth(t *testing.T) {
+	checkResolve(t, []resolveCase{
+		{Pattern: "{depth}", Data: Data{File: "/data/a/b/c/file.dat"}, Want: "4"},
+		{Pattern: "{depth}", Data: Data{File: "/data/file.dat"}, Want: "1"},
+		{Pattern: "{depth}", Data: Data{File: "file.dat"}, Want: "0"},
+		{Pattern: "{depth}", Data: Data{File: "//data//a/file.dat"}, Want: "2"},
+		{Pattern: "{depth}", Data: Data{File: "C:\\data\\a\\file.dat"}, Want: "2"},
+		{Pattern: "{depth}", Data: Data{File: "/data/a/"}, Want: "2"},
+		{Pattern: "d{depth}/{parent}", Data: Data{File: "/data/a/file.dat"}, Want: "d2/a"},
+	})
+}
+
+func TestCompactStamps(t *testing.T) {
+	var (
+		when  = time.Date(2021, 5, 7, 10, 52, 9, 0, time.UTC)
+		epoch = time.Unix(0, 0).UTC()
+	)
+	checkResolve(t, []resolveCase{
+		{Pattern: "{stamp36}", Data: Data{AcqTime: when}, Want: "0qsqgux"},
+		{Pattern: "{stamp32}", Data: Data{AcqTime: when}, Want: "1G9A6YS"},
+		{Pattern: "{stamp36}", Data: Data{AcqTime: epoch}, Want: "0000000"},
+		{Pattern: "{stamp32}", Data: Data{AcqTime: epoch.Add(31 * time.Second)}, Want: "000000Z"},
+		{Pattern: "{stamp36}", Data: Data{AcqTime: when.In(time.FixedZone("", 3600))}, Want: "0qsqgux"},
+		{Pattern: "{source}_{stamp32}", Data: Data{Source: "src", AcqTime: when}, Want: "Src_1G9A6YS"},
+	})
+}
+
+func TestFlatModifier(t *testing.T) {
+	dat := Data{Parameters: []Parameter{{Name: "path", Value: "a/b\\c"}}}
+	checkResolve(t, []resolveCase{
+		{Pattern: "{meta:path!flat}", Data: dat, Want: "a-b-c"},
+		{Pattern: "{meta:path!flat=_}", Data: dat, Want: "a_b_c"},
+		{Pattern: "{meta:path!flat=..}", Data: dat, Want: "a..b..c"},
+		{Pattern: "x/{meta:path!flat}/y", Data: dat, Want: "x/a-b-c/y"},
+		{Pattern: "{meta:path}", Data: dat, Want: "a/b\\c"},
+		{Pattern: "{meta:path!flat=/}", Invalid: true},
+		{Pattern: "{meta:path!flat=\\}", Invalid: true},
+	})
+}
+
+func TestModelFamily(t *testing.T) {
+	var (
+		prefix = Regexp{Regexp: regexp.MustCompile(`^([A-Z]+)`)}
+		suffix = Regexp{Regexp: regexp.MustCompile(`_[0-9]+$`)}
+	)
+	checkResolve(t, []resolveCase{
+		{Pattern: "{modelfamily}", Data: Data{Model: "HDRC-2"}, Want: "HDRC"},
+		{Pattern: "{modelfamily}", Data: Data{Model: "HDRC"}, Want: "HDRC"},
+		{Pattern: "{modelfamily}/{model}", Data: Data{Model: "HDRC-2"}, Want: "HDRC/HDRC-2"},
+		{Pattern: "{modelfamily}", Data: Data{Model: "EM2", ModelFamily: prefix}, Want: "EM"},
+		{Pattern: "{modelfamily}", Data: Data{Model: "em2", ModelFamily: prefix}, Want: "Em2"},
+		{Pattern: "{modelfamily}", Data: Data{Model: "FM_12", ModelFamily: suffix}, Want: "FM"},
+		{Pattern: "{modelfamily||'none'}", Want: "none"},
+	})
+}
+
+func TestOrdinal(t *testing.T) {
+	p, err := NewPattern("{source}/{ordinal:source}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []struct {
+		Data Data
+		Want string
+	}{
+		{Data: Data{Source: "a", File: "f1"}, Want: "A/001"},
+		{Data: Data{Source: "a", File: "f2"}, Want: "A/002"},
+		{Data: Data{Source: "b", File: "f3"}, Want: "B/001"},
+		{Data: Data{Source: "a", File: "f1"}, Want: "A/001"},
+		{Data: Data{Source: "a", File: "f4"}, Want: "A/003"},
+		{Data: Data{Source: "b", File: "f1"}, Want: "B/002"},
+	}
+	for _, d := range data {
+		if got := p.Resolve(d.Data); got != d.Want {
+			t.Errorf("%s (%s): values mismatched! want %s, got %s", d.Data.File, d.Data.Source, d.Want, got)
+		}
+	}
+	other, _ := NewPattern("{ordinal:source}")
+	if got := other.Resolve(Data{Source: "a", File: "f5"}); got != "001" {
+		t.Errorf("occurrences should not be shared between patterns, got %s", got)
+	}
+	if _, err := NewPattern("{ordinal:}"); err == nil {
+		t.Errorf("ordinal without name should fail")
+	}
+}
+
+func TestFiscalYear(t *testing.T) {
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 12, 0, 0, 0, time.UTC)
+	}
+	checkResolve(t, []resolveCase{
+		{Pattern: "{fiscalyear}", Data: Data{AcqTime: at(2025, 3, 31), FiscalStart: 4}, Want: "FY2024"},
+		{Pattern: "{fiscalyear}", Data: Data{AcqTime: at(2025, 4, 1), FiscalStart: 4}, Want: "FY2025"},
+		{Pattern: "{fiscalyear}", Data: Data{AcqTime: at(2025, 12, 31), FiscalStart: 4}, Want: "FY2025"},
+		{Pattern: "{fiscalyear}", Data: Data{AcqTime: at(2025, 1, 1), FiscalStart: 1}, Want: "FY2025"},
+		{Pattern: "{fiscalyear}", Data: Data{AcqTime: at(2025, 1, 1)}, Want: "FY2025"},
+		{Pattern: "{fiscalyear}", Data: Data{AcqTime: at(2025, 1, 1), FiscalStart: 13}, Want: "FY2025"},
+		{Pattern: "{fiscalyear}", Data: Data{AcqTime: at(2025, 11, 30), FiscalStart: 12}, Want: "FY2024"},
+		{Pattern: "{fiscalyear}/{month}", Data: Data{AcqTime: at(2025, 10, 1), FiscalStart: 10}, Want: "FY2025/10"},
+	})
+}
+
+func TestJoin(t *testing.T) {
+	checkResolve(t, []resolveCase{
+		{Pattern: "{join:source,model}", Data: Data{Source: "src", Model: "fm"}, Want: "Src-Fm"},
+		{Pattern: "{join:source,model:_}", Data: Data{Source: "src", Model: "fm"}, Want: "Src_Fm"},
+		{Pattern: "{join:source,model:__}", Data: Data{Source: "src", Model: "fm"}, Want: "Src__Fm"},
+		{Pattern: "{join:source,model:_}", Data: Data{Source: "src"}, Want: "Src"},
+		{Pattern: "{join:source,model:_}", Data: Data{Model: "fm"}, Want: "Fm"},
+		{Pattern: "{join:source,type,model:.}", Data: Data{Source: "src", Type: "data", Model: "fm"}, Want: "Src.Data.Fm"},
+		{Pattern: "{join:source,model:_}", Err: ErrEmpty},
+		{Pattern: "{join:source,model:/}", Invalid: true},
+		{Pattern: "{join:}", Invalid: true},
+	})
+}
+
+func TestMissionDay(t *testing.T) {
+	epoch := time.Date(2021, 5, 1, 0, 0, 0, 0, time.UTC)
+	checkResolve(t, []resolveCase{
+		{Pattern: "{missionday}", Data: Data{Epoch: epoch, AcqTime: epoch}, Want: "0000"},
+		{Pattern: "{missionday}", Data: Data{Epoch: epoch, AcqTime: epoch.Add(23 * time.Hour)}, Want: "0000"},
+		{Pattern: "{missionday}", Data: Data{Epoch: epoch, AcqTime: epoch.Add(6*24*time.Hour + time.Hour)}, Want: "0006"},
+		{Pattern: "{missionday}", Data: Data{Epoch: epoch, AcqTime: epoch.Add(-time.Hour)}, Want: "-0001"},
+		{Pattern: "{missionday}", Data: Data{Epoch: epoch, AcqTime: epoch.Add(-24 * time.Hour)}, Want: "-0001"},
+		{Pattern: "{missionday}", Data: Data{Epoch: epoch, AcqTime: epoch.Add(-24*time.Hour - time.Second)}, Want: "-0002"},
+		{Pattern: "{missionday}", Data: Data{Epoch: epoch, AcqTime: epoch.AddDate(30, 0, 0)}, Want: "10957"},
+		{Pattern: "{missionday||'none'}", Data: Data{AcqTime: epoch}, Want: "none"},
+	})
+}
+
+func TestFanout(t *testing.T) {
+	const sum = "0123456789ABCDEF"
+	checkResolve(t, []resolveCase{
+		{Pattern: "{fanout:2}", Data: Data{Sum: sum}, Want: "01/23456789abcdef"},
+		{Pattern: "{fanout:2,2}", Data: Data{Sum: sum}, Want: "01/23/456789abcdef"},
+		{Pattern: "{fanout:1,3}", Data: Data{Sum: sum}, Want: "0/123/456789abcdef"},
+		{Pattern: "{fanout:2,2}", Data: Data{Sum: "012"}, Want: "01/2"},
+		{Pattern: "{fanout:2,2}", Data: Data{Sum: "01"}, Want: "01"},
+		{Pattern: "{type}/{fanout:2}", Data: Data{Type: "data"}, Err: ErrEmpty},
+		{Pattern: "{fanout:}", Invalid: true},
+		{Pattern: "{fanout:0}", Invalid: true},
+		{Pattern: "{fanout:2,x}", Invalid: true},
+	})
+}
+
+func TestCategory(t *testing.T) {
+	checkResolve(t, []resolveCase{
+		{Pattern: "{category}", Data: Data{Mime: "text/csv"}, Want: "text"},
+		{Pattern: "{category}", Data: Data{Mime: "image/png"}, Want: "image"},
+		{Pattern: "{category}", Data: Data{Mime: "Audio/MPEG"}, Want: "audio"},
+		{Pattern: "{category}", Data: Data{Mime: "video/mp4"}, Want: "video"},
+		{Pattern: "{category}", Data: Data{Mime: "application/json; charset=utf-8"}, Want: "application"},
+		{Pattern: "{category}", Data: Data{Mime: "model/gltf+json"}, Want: categoryUnknown},
+		{Pattern: "{category}", Want: categoryUnknown},
+		{Pattern: "{type||category}", Data: Data{Type: "data", Mime: "image/png"}, Want: "Data"},
+		{Pattern: "{type||category}", Data: Data{Mime: "image/png"}, Want: "image"},
+	})
+}
+
+func TestBatch(t *testing.T) {
+	checkResolve(t, []resolveCase{
+		{Pattern: "{batch}", Data: Data{Batch: "B1"}, Want: "B1"},
+		{Pattern: "{batch}", Want: DefaultBatchID},
+		{Pattern: "{source}/{batch}", Data: Data{Source: "src", Batch: "20240102T150405"}, Want: "Src/20240102T150405"},
+		{Pattern: "{batch}", Data: Context{Batch: "B2"}.Update(Data{}), Want: "B2"},
+		{Pattern: "{batch}", Data: Context{Batch: "B2"}.Update(Data{Batch: "B3"}), Want: "B3"},
+	})
+	if got := (Config{}).Batch(); got != DefaultBatchID {
+		t.Errorf("default batch mismatched! want %s, got %s", DefaultBatchID, got)
+	}
+	if got := (Config{BatchID: "B4"}).Batch(); got != "B4" {
+		t.Errorf("batch mismatched! want B4, got %s", got)
+	}
+	if a, b := newBatchID(), newBatchID(); a == b {
+		t.Errorf("batch ids should differ, got %s twice", a)
+	}
+}
+
+func TestSecondOfDay(t *testing.T) {
+	day := time.Date(2021, 5, 7, 0, 0, 0, 0, time.UTC)
+	checkResolve(t, []resolveCase{
+		{Pattern: "{secofday}", Data: Data{AcqTime: day}, Want: "00000"},
+		{Pattern: "{secofday}", Data: Data{AcqTime: day.Add(time.Second + 999*time.Millisecond)}, Want: "00001"},
+		{Pattern: "{secofday}", Data: Data{AcqTime: day.Add(10*time.Hour + 52*time.Minute + 9*time.Second)}, Want: "39129"},
+		{Pattern: "{secofday}", Data: Data{AcqTime: day.Add(24*time.Hour - time.Nanosecond)}, Want: "86399"},
+		{Pattern: "{year}/{doy}/{secofday}", Data: Data{AcqTime: day.Add(time.Minute)}, Want: "2021/127/00060"},
+	})
+}
+
+func TestPartials(t *testing.T) {
+	t.Cleanup(func() {
+		partmu.Lock()
+		defer partmu.Unlock()
+		for n := range partials {
+			if strings.HasPrefix(n, "test.") {
+				delete(partials, n)
+			}
+		}
+	})
+	for _, p := range []struct {
+		Name    string
+		Pattern string
+		Invalid bool
+	}{
+		{Name: "test.datedir", Pattern: "{year}/{doy}"},
+		{Name: "test.product", Pattern: "/{source}/{@test.datedir}/"},
+		{Name: "test.datedir", Pattern: "{year}", Invalid: true},
+		{Name: "test.self", Pattern: "{@test.self}", Invalid: true},
+		{Name: "test.unknown", Pattern: "{@test.missing}", Invalid: true},
+		{Name: "", Pattern: "{year}", Invalid: true},
+	} {
+		err := RegisterPartial(p.Name, p.Pattern)
+		if p.Invalid != (err != nil) {
+			t.Errorf("%s (%s): unexpected result: %v", p.Name, p.Pattern, err)
+		}
+	}
+	dat := Data{Source: "src", Type: "data", AcqTime: time.Date(2021, 5, 7, 0, 0, 0, 0, time.UTC)}
+	checkResolve(t, []resolveCase{
+		{Pattern: "{@test.datedir}", Data: dat, Want: "2021/127"},
+		{Pattern: "{type}/{@test.datedir}", Data: dat, Want: "Data/2021/127"},
+		{Pattern: "{@test.product}/{type}", Data: dat, Want: "Src/2021/127/Data"},
+		{Pattern: "{@test.datedir}/{@test.datedir}", Data: dat, Want: "2021/127/2021/127"},
+		{Pattern: "{@test.missing}", Invalid: true},
+		{Pattern: "{@test.datedir", Invalid: true},
+	})
+}
+
+func TestMission(t *testing.T) {
+	checkResolve(t, []resolveCase{
+		{Pattern: "{mission}", Data: Data{Mission: "ISS"}, Want: "ISS"},
+		{Pattern: "{mission}/{source}", Data: Data{Mission: "ISS", Source: "src"}, Want: "ISS/Src"},
+		{Pattern: "{mission}", Data: Context{Mission: "ISS"}.Update(Data{}), Want: "ISS"},
+		{Pattern: "{mission}", Data: Context{Mission: "ISS"}.Update(Data{Mission: "Columbus"}), Want: "Columbus"},
+		{Pattern: "{mission||'unknown'}", Want: "unknown"},
+		{Pattern: "{mission}", Err: ErrEmpty},
+	})
+}
+
+func TestMimeExtension(t *testing.T) {
+	checkResolve(t, []resolveCase{
+		{Pattern: "{source}/{type}", Data: Data{Source: "src", Type: "data", Mime: "text/csv"}, Want: "Src/Data.csv"},
+		{Pattern: "{source}/{type}", Data: Data{Source: "src", Type: "data", Mime: "application/json; charset=utf-8"}, Want: "Src/Data.json"},
+		{Pattern: "{source}/data.csv", Data: Data{Source: "src", Mime: "text/csv"}, Want: "Src/data.csv"},
+		{Pattern: "{source}/data.CSV", Data: Data{Source: "src", Mime: "text/csv"}, Want: "Src/data.CSV"},
+		{Pattern: "{source}/{type}", Data: Data{Source: "src", Type: "data", Mime: "application/x-unknown"}, Want: "Src/Data"},
+		{Pattern: "{source}/{type}", Data: Data{Source: "src", Type: "data"}, Want: "Src/Data"},
+	}, WithMimeExtension())
+	checkResolve(t, []resolveCase{
+		{Pattern: "{source}/{type}", Data: Data{Source: "src", Type: "data", Mime: "text/csv"}, Want: "Src/Data"},
+	})
+	for mime, ext := range map[string]string{
+		"text/csv":               ".csv",
+		"IMAGE/PNG":              ".png",
+		" application/pdf ":      ".pdf",
+		"text/plain; charset=us": ".txt",
+		"application/x-unknown":  "",
+		"":                       "",
+	} {
+		if got := MimeExtension(mime); got != ext {
+			t.Errorf("%s: extensions mismatched! want %q, got %q", mime, ext, got)
+		}
+	}
+}
+
+func TestBucket(t *testing.T) {
+	dat := Data{AcqTime: time.Date(2021, 5, 7, 10, 52, 9, 0, time.UTC)}
+	checkResolve(t, []resolveCase{
+		{Pattern: "{bucket:15m}", Data: dat, Want: "1045"},
+		{Pattern: "{bucket:10m}", Data: dat, Want: "1050"},
+		{Pattern: "{bucket:1h}", Data: dat, Want: "1000"},
+		{Pattern: "{bucket:6h}", Data: dat, Want: "0600"},
+		{Pattern: "{bucket:30s:150405}", Data: dat, Want: "105200"},
+		{Pattern: "{bucket:1h:15}", Data: dat, Want: "10"},
+		{Pattern: "{year}/{doy}/{bucket:15m}", Data: dat, Want: "2021/127/1045"},
+		{Pattern: "{bucket:15m}", Data: Data{AcqTime: time.Date(2021, 5, 7, 10, 45, 0, 0, time.UTC)}, Want: "1045"},
+		{Pattern: "{bucket:15m}", Data: Data{AcqTime: time.Date(2021, 5, 7, 10, 44, 59, 0, time.UTC)}, Want: "1030"},
+		{Pattern: "{bucket:}", Invalid: true},
+		{Pattern: "{bucket:0s}", Invalid: true},
+		{Pattern: "{bucket:-1m}", Invalid: true},
+		{Pattern: "{bucket:fifteen}", Invalid: true},
+	})
+}
+
+func TestVolume(t *testing.T) {
+	data := []struct {
+		Pattern string
+		Left    Data
+		Right   Data
+		Same    bool
+	}{
+		{Pattern: "{volume:v1,v2,v3}", Left: Data{File: "a.dat"}, Right: Data{File: "a.dat"}, Same: true},
+		{Pattern: "{volume:v1,v2,v3}", Left: Data{File: "a.dat", Sum: "ABCDEF"}, Right: Data{File: "b.dat", Sum: "abcdef"}, Same: true},
+		{Pattern: "{volume:v1,v2:source}", Left: Data{File: "a.dat", Source: "src"}, Right: Data{File: "b.dat", Source: "src"}, Same: true},
+		{Pattern: "{volume:v1}", Left: Data{File: "a.dat"}, Right: Data{File: "b.dat"}, Same: true},
+	}
+	for _, d := range data {
+		p, err := NewPattern(d.Pattern)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Pattern, err)
+			continue
+		}
+		left, right := p.Resolve(d.Left), p.Resolve(d.Right)
+		if left == "" || right == "" {
+			t.Errorf("%s: empty volume (%q, %q)", d.Pattern, left, right)
+		}
+		if (left == right) != d.Same {
+			t.Errorf("%s: volumes mismatched! %s - %s", d.Pattern, left, right)
+		}
+	}
+
+	p, _ := NewPattern("{volume:v1,v2,v3}")
+	seen := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		seen[p.Resolve(Data{File: fmt.Sprintf("file_%d.dat", i)})]++
+	}
+	if len(seen) != 3 {
+		t.Errorf("all the volumes should be used: %v", seen)
+	}
+	for _, str := range []string{"{volume:}", "{volume:v1,,v2}", "{volume:v1,v/2}"} {
+		if _, err := NewPattern(str); err == nil {
+			t.Errorf("%s: expected a parse error", str)
+		}
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	dat := Data{File: "/tmp/work/file.dat", Origin: "/storage/mission/run/data/file.dat"}
+	checkResolve(t, []resolveCase{
+		{Pattern: "{origin}", Data: dat, Want: dat.Origin},
+		{Pattern: "{1}", Data: dat, Want: "work"},
+		{Pattern: "{1!origin}", Data: dat, Want: "mission"},
+		{Pattern: "{1:3!origin}", Data: dat, Want: "mission/run"},
+		{Pattern: "{1!origin}", Data: Data{File: dat.File}, Err: ErrEmpty},
+		{Pattern: "{origin||'local'}", Data: Data{File: dat.File}, Want: "local"},
+		{Pattern: "{source!origin}", Invalid: true},
+	})
+	fi := FileInfo{File: dat.File, Origin: dat.Origin}
+	if got := DataFromFileInfo(fi); got.Origin != fi.Origin {
+		t.Errorf("origin mismatched! want %s, got %s", fi.Origin, got.Origin)
+	}
+}
+
+func TestRequireFragments(t *testing.T) {
+	data := []struct {
+		Pattern string
+		Names   []string
+		Missing bool
+	}{
+		{Pattern: "{source}/{type}"},
+		{Pattern: "{source}/{type}", Names: []string{"source"}},
+		{Pattern: "{source}/{type}", Names: []string{"Source", "TYPE"}},
+		{Pattern: "{model||source}", Names: []string{"source"}},
+		{Pattern: "{source!pad=5}", Names: []string{"source"}},
+		{Pattern: "{lookup:type}", Names: []string{"type"}},
+		{Pattern: "{ordinal:model}", Names: []string{"model"}},
+		{Pattern: "{year}/{minute}", Names: []string{"min"}},
+		{Pattern: "{year}", Names: []string{RequireTime}},
+		{Pattern: "{datepath:ydoy}", Names: []string{RequireTime}},
+		{Pattern: "{bucket:15m}", Names: []string{RequireTime}},
+		{Pattern: "{time:2006}", Names: []string{RequireTime}},
+		{Pattern: "{source}/{type}", Names: []string{RequireTime}, Missing: true},
+		{Pattern: "{source}/{type}", Names: []string{"model"}, Missing: true},
+		{Pattern: "{source}/model", Names: []string{"model"}, Missing: true},
+		{Pattern: "", Names: []string{"source"}, Missing: true},
+	}
+	for _, d := range data {
+		r, err := ParseResolver(d.Pattern)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Pattern, err)
+			continue
+		}
+		err = RequireFragments(r, d.Names...)
+		if d.Missing != (err != nil) {
+			t.Errorf("%s (%s): unexpected result: %v", d.Pattern, d.Names, err)
+		}
+	}
+}
+
+func TestResolveAll(t *testing.T) {
+	data := []struct {
+		Pattern string
+		Data    []Data
+		Want    map[string]string
+		Err     error
+	}{
+		{
+			Pattern: "{source}/{type}",
+			Data: []Data{
+				{File: "a.dat", Source: "src", Type: "data"},
+				{File: "b.png", Source: "src", Type: "image"},
+			},
+			Want: map[string]string{"a.dat": "Src/Data", "b.png": "Src/Image"},
+		},
+		{
+			Pattern: "{source}/{type}",
+			Data: []Data{
+				{File: "a.dat", Source: "src", Type: "data"},
+				{File: "a.dat", Source: "src", Type: "data"},
+			},
+			Want: map[string]string{"a.dat": "Src/Data"},
+		},
+		{
+			Pattern: "{source}",
+			Want:    map[string]string{},
+		},
+		{
+			Pattern: "{source}",
+			Data: []Data{
+				{File: "a.dat", Source: "src"},
+				{File: "b.dat", Source: "src"},
+				{File: "c.dat", Source: "other"},
+			},
+			Err: ErrCollision,
+		},
+		{
+			Pattern: "{source}/{type}",
+			Data: []Data{
+				{File: "a.dat", Source: "src", Type: "data"},
+				{File: "b.dat", Source: "src"},
+			},
+			Err: ErrEmpty,
+		},
+	}
+	for _, d := range data {
+		p, err := NewPattern(d.Pattern)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Pattern, err)
+			continue
+		}
+		got, err := p.ResolveAll(d.Data)
+		if d.Err != nil {
+			if !errors.Is(err, d.Err) {
+				t.Errorf("%s: expected error %v, got %v", d.Pattern, d.Err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Pattern, err)
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(d.Want) {
+			t.Errorf("%s: paths mismatched! want %v, got %v", d.Pattern, d.Want, got)
+		}
+	}
+}
+
+func TestSeparator(t *testing.T) {
+	checkResolve(t, []resolveCase{
+		{Pattern: "rt{sep:_}{source}{sep:_}{model}.dat", Data: Data{Source: "src", Model: "fm"}, Want: "rt_Src_Fm.dat"},
+		{Pattern: "rt{sep:_}{source}{sep:_}{model}.dat", Data: Data{Source: "src"}, Want: "rt_Src.dat"},
+		{Pattern: "rt{sep:_}{source}{sep:_}{model}.dat", Data: Data{Model: "fm"}, Want: "rt_Fm.dat"},
+		{Pattern: "rt{sep:_}{source}{sep:_}{model}.dat", Want: "rt.dat"},
+		{Pattern: "{source}{sep:-}{model}", Data: Data{Source: "src"}, Want: "Src"},
+		{Pattern: "{source}{sep:-}{model}", Data: Data{Model: "fm"}, Want: "Fm"},
+		{Pattern: "{source}{sep:--}{model}", Data: Data{Source: "src", Model: "fm"}, Want: "Src--Fm"},
+		{Pattern: "{source}{sep:_}{type}{sep:_}{model}", Data: Data{Source: "src", Model: "fm"}, Want: "Src_Fm"},
+		{Pattern: "{sep:_}", Err: ErrEmpty},
+		{Pattern: "{source}{sep:}{model}", Invalid: true},
+		{Pattern: "{source}{sep:/}{model}", Invalid: true},
+		{Pattern: "{source}{sep:\\\\}{model}", Invalid: true},
+	})
+}
+
+func TestVersion(t *testing.T) {
+	checkResolve(t, []resolveCase{
+		{Pattern: "{version}", Data: Data{Version: "v3"}, Want: "v3"},
+		{Pattern: "{source}/{version}", Data: Data{Source: "src", Version: "v3"}, Want: "Src/v3"},
+		{Pattern: "{source}/{version?}", Data: Data{Source: "src"}, Want: "Src"},
+		{Pattern: "{version||'v1'}", Want: "v1"},
+		{Pattern: "{version}", Data: Context{Version: "v2"}.Update(Data{}), Want: "v2"},
+		{Pattern: "{version}", Data: Context{Version: "v2"}.Update(Data{Version: "v4"}), Want: "v4"},
+		{Pattern: "{version}", Err: ErrEmpty},
+	})
+}
+
+func TestMaxComponent(t *testing.T) {
+	meta := func(v string) Data {
+		return Data{Source: "src", Parameters: []Parameter{{Name: "name", Value: v}}}
+	}
+	checkResolve(t, []resolveCase{
+		{Pattern: "{source}/{meta:name}", Data: meta("abcdefgh"), Want: "Src/abcdefgh"},
+		{Pattern: "{source}/{meta:name}", Data: meta("abcdefghij"), Err: ErrTooLong},
+	}, WithMaxComponent(8, false))
+	checkResolve(t, []resolveCase{
+		{Pattern: "{source}/{meta:name}", Data: meta("abcdefgh"), Want: "Src/abcdefgh"},
+		{Pattern: "{source}/{meta:name}", Data: meta("abcdefghij"), Want: "Src/abcdefgh"},
+		{Pattern: "{meta:name}/{source}", Data: meta("abcdefghij"), Want: "abcdefgh/Src"},
+		{Pattern: "{source}/{meta:name}", Data: meta("abcdefghij.dat"), Want: "Src/abcd.dat"},
+		{Pattern: "{meta:name}/{source}", Data: meta("abcdefghij.dat"), Want: "abcdefgh/Src"},
+		{Pattern: "{source}/{meta:name}", Data: meta("abc.verylongext"), Want: "Src/abc.very"},
+		{Pattern: "{source}/{meta:name}", Data: meta("ééééé"), Want: "Src/éééé"},
+		{Pattern: "{source}/{meta:name}", Data: meta("aéééé"), Want: "Src/aééé"},
+	}, WithMaxComponent(8, true))
+}
+
+func TestWithTransform(t *testing.T) {
+	var (
+		dat    = Data{Source: "src", Type: "data", Mime: "text/csv"}
+		prefix = func(str string) string { return "archive/" + str }
+		upper  = strings.ToUpper
+		long   = func(str string) string { return str + "/" + strings.Repeat("x", 20) }
+	)
+	checkResolve(t, []resolveCase{
+		{Pattern: "{source}/{type}", Data: dat, Want: "archive/Src/Data"},
+	}, WithTransform(prefix))
+	checkResolve(t, []resolveCase{
+		{Pattern: "{source}/{type}", Data: dat, Want: "archive/SRC/DATA"},
+	}, WithTransform(upper), WithTransform(prefix))
+	checkResolve(t, []resolveCase{
+		{Pattern: "{source}/{type}", Data: dat, Want: "ARCHIVE/SRC/DATA"},
+	}, WithTransform(prefix), WithTransform(upper))
+	checkResolve(t, []resolveCase{
+		{Pattern: "{source}/{type}", Data: dat, Want: "archive/Src/Data.csv"},
+	}, WithTransform(prefix), WithMimeExtension())
+	checkResolve(t, []resolveCase{
+		{Pattern: "{source}/{type}", Data: dat, Err: ErrTooLong},
+	}, WithTransform(long), WithMaxLength(20, false))
+	checkResolve(t, []resolveCase{
+		{Pattern: "{source}/{type}", Err: ErrEmpty},
+	}, WithTransform(prefix))
+}
+
+func TestEmptyPattern(t *testing.T) {
+	checkResolve(t, []resolveCase{
+		{Pattern: "", Data: Data{File: "/data/a/file.dat"}, Want: "file.dat"},
+		{Pattern: "", Data: Data{File: "file.dat", Source: "src"}, Want: "file.dat"},
+		{Pattern: "", Want: ""},
+	})
+	data := []struct {
+		Pattern Pattern
+		Empty   bool
+	}{
+		{Pattern: Pattern{}, Empty: true},
+		{Pattern: mustPattern(t, ""), Empty: true},
+		{Pattern: mustPattern(t, "{source}")},
+		{Pattern: mustPattern(t, "data")},
+	}
+	for _, d := range data {
+		if got := d.Pattern.IsEmpty(); got != d.Empty {
+			t.Errorf("%s: empty mismatched! want %t, got %t", d.Pattern.Canonical(), d.Empty, got)
+		}
+		dat := Data{File: "/data/a/file.dat", Source: "src", Archive: d.Pattern}
+		if got := dat.Resolve(); d.Empty && got != "" {
+			t.Errorf("an empty pattern should give the root of the archive, got %s", got)
+		}
+	}
+}
+
+func mustPattern(t *testing.T, str string) Pattern {
+	t.Helper()
+	p, err := NewPattern(str)
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %s", str, err)
+	}
+	return p
+}
+
+func TestIndexCleanPaths(t *testing.T) {
+	checkResolve(t, []resolveCase{
+		{Pattern: "{0}/{1}", Data: Data{File: "C:\\a\\b\\c\\file.dat"}, Want: "a/b"},
+		{Pattern: "{1:3}", Data: Data{File: "C:\\a\\b\\c\\file.dat"}, Want: "b/c"},
+		{Pattern: "{0}/{1}", Data: Data{File: "a//b/c/file.dat"}, Want: "a/b"},
+		{Pattern: "{0}/{1}", Data: Data{File: "a/../b/c/file.dat"}, Want: "b/c"},
+		{Pattern: "{0}/{1}", Data: Data{File: "./a/./b/file.dat"}, Want: "a/b"},
+		{Pattern: "{0:2}", Data: Data{File: "a\\b/c\\file.dat"}, Want: "a/b"},
+		{Pattern: "{2}", Data: Data{File: "a/../b/c/file.dat"}, Err: ErrEmpty},
+	})
+}
+
+func TestIndexSlashes(t *testing.T) {
+	checkResolve(t, []resolveCase{
+		{Pattern: "{0}", Data: Data{File: "/a/b/file.dat"}, Want: "a"},
+		{Pattern: "{0}", Data: Data{File: "//a/b/file.dat"}, Want: "a"},
+		{Pattern: "{0}", Data: Data{File: "a/b/file.dat"}, Want: "a"},
+		{Pattern: "{1}", Data: Data{File: "/a//b/file.dat"}, Want: "b"},
+		{Pattern: "{1}", Data: Data{File: "/a/b/"}, Want: "b"},
+		{Pattern: "{0:2}", Data: Data{File: "///a///b///file.dat"}, Want: "a/b"},
+		{Pattern: "{2?}/{1}", Data: Data{File: "/a/b//"}, Want: "b"},
+	})
+}
+
+func TestSplitComponents(t *testing.T) {
+	data := []struct {
+		File string
+		Want []string
+	}{
+		{File: "/data/a/b/file.dat", Want: []string{"data", "a", "b"}},
+		{File: "data/a/file.dat", Want: []string{"data", "a"}},
+		{File: "/data/a/b/", Want: []string{"data", "a", "b"}},
+		{File: "//data//a/file.dat", Want: []string{"data", "a"}},
+		{File: "C:\\data\\a\\file.dat", Want: []string{"data", "a"}},
+		{File: "data\\a/file.dat", Want: []string{"data", "a"}},
+		{File: "./data/../a/file.dat", Want: []string{"a"}},
+		{File: "file.dat"},
+		{File: "/file.dat"},
+		{File: ""},
+	}
+	for _, d := range data {
+		got := SplitComponents(d.File)
+		if len(got) != len(d.Want) || strings.Join(got, ",") != strings.Join(d.Want, ",") {
+			t.Errorf("%s: components mismatched! want %q, got %q", d.File, d.Want, got)
+		}
+	}
+}
+
+func TestNewPatternFromComponents(t *testing.T) {
+	data := []struct {
+		Components []Component
+		Want       string
+		Invalid    bool
+	}{
+		{
+			Components: []Component{{Literal: "archive"}, {Fragment: "source"}, {Fragment: "year"}},
+			Want:       "archive/{source}/{year}",
+		},
+		{
+			Components: []Component{{Fragment: "model||source||'unknown'"}, {Fragment: "meta:run!required"}},
+			Want:       "{model||source||'unknown'}/{meta:run!required}",
+		},
+		{
+			Components: []Component{{Fragment: "datepath:ydoy"}, {Fragment: "model?"}},
+			Want:       "{datepath:ydoy}/{model?}",
+		},
+		{
+			Want: "",
+		},
+		{
+			Components: []Component{{Fragment: "source", Literal: "src"}},
+			Invalid:    true,
+		},
+		{
+			Components: []Component{{Literal: "archive"}, {}},
+			Invalid:    true,
+		},
+		{
+			Components: []Component{{Fragment: "source!pad=x"}},
+			Invalid:    true,
+		},
+	}
+	for _, d := range data {
+		got, err := NewPatternFromComponents(d.Components)
+		if d.Invalid {
+			if err == nil {
+				t.Errorf("%+v: expected an error", d.Components)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%+v: unexpected error: %s", d.Components, err)
+			continue
+		}
+		if want := mustPattern(t, d.Want); !got.Equal(want) {
+			t.Errorf("%+v: patterns mismatched! want %s, got %s", d.Components, want.Canonical(), got.Canonical())
+		}
+	}
+}
+
+func TestControlCharacters(t *testing.T) {
+	meta := func(v string) Data {
+		return Data{Source: "src", Parameters: []Parameter{{Name: "run", Value: v}}}
+	}
+	checkResolve(t, []resolveCase{
+		{Pattern: "{source}/{meta:run}", Data: meta("R1"), Want: "Src/R1"},
+		{Pattern: "{source}/{meta:run}", Data: meta("R\x001"), Err: ErrControl},
+		{Pattern: "{source}/{meta:run}", Data: meta("R1\n"), Err: ErrControl},
+		{Pattern: "{source}/{meta:run}", Data: meta("R\t1"), Err: ErrControl},
+		{Pattern: "{source}/{meta:run}", Data: meta("R\x7f1"), Err: ErrControl},
+		{Pattern: "{source}/{meta:run}", Data: meta("Ré1"), Want: "Src/Ré1"},
+	})
+	checkResolve(t, []resolveCase{
+		{Pattern: "{source}/{meta:run}", Data: meta("R\x001"), Want: "Src/R1"},
+		{Pattern: "{source}/{meta:run}", Data: meta("R1\r\n"), Want: "Src/R1"},
+		{Pattern: "{source}/{meta:run}", Data: meta("\x00"), Err: ErrEmpty},
+		{Pattern: "{meta:run}/{source}", Data: meta("\x00\n"), Err: ErrEmpty},
+	}, WithStripControl())
+}
+
+func TestMsgDate(t *testing.T) {
+	var (
+		acq = time.Date(2021, 5, 7, 10, 52, 9, 0, time.UTC)
+		msg = time.Date(2020, 12, 31, 23, 5, 1, 0, time.UTC)
+		dat = Data{Source: "src", AcqTime: acq, MsgTime: msg}
+	)
+	checkResolve(t, []resolveCase{
+		{Pattern: "{msgdate:year}/{msgdate:doy}", Data: dat, Want: "2020/366"},
+		{Pattern: "{msgdate:month}/{msgdate:day}", Data: dat, Want: "12/31"},
+		{Pattern: "{msgdate:hour}{msgdate:min}{msgdate:second}", Data: dat, Want: "230501"},
+		{Pattern: "{msgdate:SecOfDay}", Data: dat, Want: "83101"},
+		{Pattern: "{msgdate:timestamp}", Data: dat, Want: "1609455901"},
+		{Pattern: "{year}/{msgdate:year}", Data: dat, Want: "2021/2020"},
+		{Pattern: "{source}/{msgdate:year}", Data: Data{Source: "src", AcqTime: acq}, Err: ErrEmpty},
+		{Pattern: "{source}/{msgdate:year?}", Data: Data{Source: "src", AcqTime: acq}, Want: "Src"},
+		{Pattern: "{msgdate:year||year}", Data: Data{AcqTime: acq}, Want: "2021"},
+		{Pattern: "{msgdate:}", Invalid: true},
+		{Pattern: "{msgdate:source}", Invalid: true},
+	})
+	if d := DataFromFileInfo(FileInfo{File: "file.csv", MsgTime: msg}); !d.MsgTime.Equal(msg) {
+		t.Errorf("message times mismatched! want %s, got %s", msg, d.MsgTime)
+	}
+}
+
+func TestLowercase(t *testing.T) {
+	dat := Data{
+		Source:     "SRC",
+		Model:      "Fm",
+		Type:       "data",
+		Parameters: []Parameter{{Name: "run", Value: "Run-A"}},
+	}
+	checkResolve(t, []resolveCase{
+		{Pattern: "ABC/def", Want: "ABC/def"},
+		{Pattern: "Archive/{source}/{model}", Data: dat, Want: "Archive/SRC/Fm"},
+		{Pattern: "MyData/{meta:run}/{type}", Data: dat, Want: "MyData/Run-A/Data"},
+	})
+	checkResolve(t, []resolveCase{
+		{Pattern: "ABC/def", Want: "abc/def"},
+		{Pattern: "Archive/{source}/{model}", Data: dat, Want: "archive/src/fm"},
+		{Pattern: "MyData/{meta:run}/{type}", Data: dat, Want: "mydata/run-a/data"},
+	}, WithLowercase())
+}
+
+func TestPreviewPattern(t *testing.T) {
+	var (
+		when    = time.Date(2021, 5, 7, 10, 52, 9, 0, time.UTC)
+		samples = []Data{
+			{Source: "src", Type: "data", AcqTime: when},
+			{Source: "other", Type: "image", AcqTime: when.AddDate(1, 0, 0)},
+			{Source: "src"},
+		}
+	)
+	got, err := PreviewPattern("{source}/{year}/{type}", samples)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	want := []string{"Src/2021/Data", "Other/2022/Image", ""}
+	if strings.Join(got, ",") != strings.Join(want, ",") || len(got) != len(want) {
+		t.Errorf("previews mismatched! want %q, got %q", want, got)
+	}
+
+	got, err = PreviewPattern("{source}/{bogus!nope}", samples)
+	if got != nil {
+		t.Errorf("invalid pattern: unexpected previews %q", got)
+	}
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("invalid pattern: expected a ParseError, got %v", err)
+	}
+	if pe.Offset != 9 || pe.Text != "{bogus!nope}" {
+		t.Errorf("invalid pattern: error mismatched! want 9/{bogus!nope}, got %d/%s", pe.Offset, pe.Text)
+	}
+}
+
+func TestAlias(t *testing.T) {
+	aliases := map[string]string{"src": "source", "Gps": "navigation"}
+	checkResolve(t, []resolveCase{
+		{Pattern: "{source!alias}", Data: Data{Source: "src", Aliases: aliases}, Want: "source"},
+		{Pattern: "{source!alias}", Data: Data{Source: "other", Aliases: aliases}, Want: "Other"},
+		{Pattern: "{source!alias}", Data: Data{Source: "GPS", Aliases: aliases}, Want: "navigation"},
+		{Pattern: "{source!alias}", Data: Data{Source: "src"}, Want: "Src"},
+		{Pattern: "{meta:run!alias}", Data: Data{Aliases: aliases, Parameters: []Parameter{{Name: "run", Value: "gps"}}}, Want: "navigation"},
+	})
+
+	data := []struct {
+		Value string
+		Want  string
+		Found bool
+	}{
+		{Value: "src", Want: "source", Found: true},
+		{Value: "SRC", Want: "source", Found: true},
+		{Value: "gps", Want: "navigation", Found: true},
+		{Value: "other", Want: "other"},
+		{Value: "", Want: ""},
+	}
+	for _, d := range data {
+		got, ok := lookup(aliases, d.Value)
+		if got != d.Want || ok != d.Found {
+			t.Errorf("%q: lookup mismatched! want %q (%t), got %q (%t)", d.Value, d.Want, d.Found, got, ok)
+		}
+	}
+}
+
+func TestProvenance(t *testing.T) {
+	dat := Data{
+		Source:     "src",
+		Type:       "data",
+		AcqTime:    time.Date(2021, 5, 7, 10, 52, 9, 0, time.UTC),
+		Parameters: []Parameter{{Name: "run", Value: "R1"}},
+	}
+	data := []struct {
+		Pattern    string
+		Components []string
+		Values     []string
+	}{
+		{
+			Pattern:    "{source}/{year}/{doy}",
+			Components: []string{"fragment(source)", "fragment(year)", "fragment(doy)"},
+			Values:     []string{"Src", "2021", "127"},
+		},
+		{
+			Pattern:    "archive/{source}-{meta:run}",
+			Components: []string{"literal(archive)", "compound(fragment(source)literal(-)meta(run))"},
+			Values:     []string{"archive", "Src-R1"},
+		},
+		{
+			Pattern:    "{source}/{model?}/{type}",
+			Components: []string{"fragment(source)", "optional(fragment(model))", "fragment(type)"},
+			Values:     []string{"Src", "", "Data"},
+		},
+	}
+	for _, d := range data {
+		p := mustPattern(t, d.Pattern)
+		ps := p.Provenance(dat)
+		if len(ps) != 1+2*len(d.Components) {
+			t.Errorf("%s: expected %d parameters, got %d", d.Pattern, 1+2*len(d.Components), len(ps))
+			continue
+		}
+		if ps[0].Name != archPattern || ps[0].Value != p.Resolver.String() {
+			t.Errorf("%s: pattern mismatched! want %s, got %s=%s", d.Pattern, p.Resolver, ps[0].Name, ps[0].Value)
+		}
+		for i := range d.Components {
+			var (
+				comp = ps[1+2*i]
+				val  = ps[2+2*i]
+			)
+			if want := fmt.Sprintf(archComponent, i+1); comp.Name != want || comp.Value != d.Components[i] {
+				t.Errorf("%s: component mismatched! want %s=%s, got %s=%s", d.Pattern, want, d.Components[i], comp.Name, comp.Value)
+			}
+			if want := fmt.Sprintf(archValue, i+1); val.Name != want || val.Value != d.Values[i] {
+				t.Errorf("%s: value mismatched! want %s=%s, got %s=%s", d.Pattern, want, d.Values[i], val.Name, val.Value)
+			}
+		}
+	}
+	if ps := (Pattern{}).Provenance(dat); len(ps) != 0 {
+		t.Errorf("unset pattern: unexpected parameters %v", ps)
+	}
+}
+
+func TestURLSafe(t *testing.T) {
+	meta := func(v string) Data {
+		return Data{Source: "src", Parameters: []Parameter{{Name: "run", Value: v}}}
+	}
+	checkResolve(t, []resolveCase{
+		{Pattern: "{source}/{meta:run}", Data: meta("run 1"), Want: "Src/run 1"},
+		{Pattern: "{source}/{meta:run}", Data: meta("a/b#c"), Want: "Src/a/b#c"},
+	})
+	checkResolve(t, []resolveCase{
+		{Pattern: "{source}/{meta:run}", Data: meta("R1"), Want: "Src/R1"},
+		{Pattern: "{source}/{meta:run}", Data: meta("run 1"), Want: "Src/run%201"},
+		{Pattern: "{source}/{meta:run}", Data: meta("a#1"), Want: "Src/a%231"},
+		{Pattern: "{source}/{meta:run}", Data: meta("a?b=1"), Want: "Src/a%3Fb=1"},
+		{Pattern: "{source}/{meta:run}", Data: meta("café"), Want: "Src/caf%C3%A9"},
+		{Pattern: "{source}/{meta:run}", Data: meta("a/b#c"), Want: "Src/a/b%23c"},
+		{Pattern: "my data/{source}", Data: meta("R1"), Want: "my%20data/Src"},
+	}, WithURLSafe())
+
+	data := []struct {
+		Path string
+		Want string
+	}{
+		{Path: "", Want: ""},
+		{Path: "a/b/c", Want: "a/b/c"},
+		{Path: "/a b/c?d#e/", Want: "/a%20b/c%3Fd%23e/"},
+		{Path: "été/日本", Want: "%C3%A9t%C3%A9/%E6%97%A5%E6%9C%AC"},
+	}
+	for _, d := range data {
+		if got := escapePath(d.Path); got != d.Want {
+			t.Errorf("%q: paths mismatched! want %q, got %q", d.Path, d.Want, got)
+		}
+	}
+}
+
+func TestFolding(t *testing.T) {
+	meta := func(v string) Data {
+		return Data{Source: "src", Parameters: []Parameter{{Name: "run", Value: v}}}
+	}
+	checkResolve(t, []resolveCase{
+		{Pattern: "{source}/{meta:run}", Data: meta("Éléphant"), Want: "Src/Éléphant"},
+		{Pattern: "{source}/{meta:run}", Data: meta("ﬁle"), Want: "Src/ﬁle"},
+		{Pattern: "{source}/{meta:run}", Data: meta("Ｆｕｌｌ"), Want: "Src/Ｆｕｌｌ"},
+	})
+	checkResolve(t, []resolveCase{
+		{Pattern: "{source}/{meta:run}", Data: meta("Éléphant"), Want: "Src/Elephant"},
+		{Pattern: "{source}/{meta:run}", Data: meta("naïve-Ångström"), Want: "Src/naive-Angstrom"},
+		{Pattern: "{source}/{meta:run}", Data: meta("ﬁle-ﬂow"), Want: "Src/file-flow"},
+		{Pattern: "{source}/{meta:run}", Data: meta("Ｆｕｌｌ"), Want: "Src/Full"},
+		// æ, œ and ß are letters, not ligatures: they have no decomposition
+		{Pattern: "{source}/{meta:run}", Data: meta("æther-œuvre-straße"), Want: "Src/æther-œuvre-straße"},
+		{Pattern: "café/{source}", Want: "cafe/Src", Data: meta("")},
+	}, WithFolding())
+	checkResolve(t, []resolveCase{
+		{Pattern: "{source}/{meta:run}", Data: meta("Éléphant"), Want: "src/elephant"},
+		{Pattern: "{source}/{meta:run}", Data: meta("ﬁle"), Want: "src/file"},
+	}, WithFolding(), WithLowercase())
+}
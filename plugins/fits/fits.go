@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/busoc/prospect"
+	"github.com/midbel/toml"
+)
+
+const (
+	fitsObject     = "fits.object"
+	fitsInstrument = "fits.instrument"
+	fitsTelescope  = "fits.telescope"
+	fitsObserver   = "fits.observer"
+	fitsDateObs    = "fits.date-obs"
+
+	keyDateObs    = "DATE-OBS"
+	keyInstrument = "INSTRUME"
+	keyTelescope  = "TELESCOP"
+	keyObject     = "OBJECT"
+	keyObserver   = "OBSERVER"
+	keyEnd        = "END"
+
+	mimeFITS = "image/fits"
+
+	cardLen  = 80
+	blockLen = 2880
+)
+
+var extensions = []string{".fits", ".fit", ".fts"}
+
+type module struct {
+	cfg   prospect.Config
+	files []string
+}
+
+func init() {
+	prospect.Register("fits", New)
+}
+
+func New(cfg prospect.Config) (prospect.Module, error) {
+	c := struct {
+		Extensions []string
+	}{}
+	if cfg.Config != "" {
+		if err := toml.DecodeFile(cfg.Config, &c); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.Extensions) == 0 {
+		c.Extensions = extensions
+	}
+	m := module{cfg: cfg}
+	var err error
+	if m.files, err = listFiles(cfg.Location, c.Extensions); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (m *module) String() string {
+	return "fits"
+}
+
+func (m *module) Process() (prospect.FileInfo, error) {
+	if len(m.files) == 0 {
+		return prospect.FileInfo{}, prospect.ErrDone
+	}
+	file := m.files[0]
+	m.files = m.files[1:]
+
+	r, err := os.Open(file)
+	if err != nil {
+		return prospect.FileInfo{}, err
+	}
+	defer r.Close()
+
+	var (
+		digest = m.cfg.NewDigester()
+		rs     = bufio.NewReader(io.TeeReader(r, digest))
+	)
+	hdr, err := readHeader(rs)
+	if err != nil {
+		return prospect.FileInfo{}, fmt.Errorf("%s: %w", file, err)
+	}
+	// the data array is only read to compute the digest of the whole file
+	size, err := io.Copy(ioutil.Discard, rs)
+	if err != nil {
+		return prospect.FileInfo{}, err
+	}
+	size += hdr.size
+
+	info := prospect.FileInfo{
+		File:      file,
+		Type:      m.cfg.Type,
+		Mime:      mimeFITS,
+		Model:     hdr.values[keyInstrument],
+		Level:     m.cfg.Level,
+		Size:      size,
+		Integrity: digest.Integrity(),
+	}
+	if info.Type == "" {
+		info.Type = prospect.TypeData
+	}
+	if str := hdr.values[keyDateObs]; str != "" {
+		if info.AcqTime, err = m.parseDate(str); err != nil {
+			return prospect.FileInfo{}, fmt.Errorf("%s: %s: %w", file, keyDateObs, err)
+		}
+		info.ModTime = info.AcqTime
+	}
+	info.Parameters = []prospect.Parameter{
+		prospect.MakeParameter(prospect.FileSize, size),
+	}
+	for _, k := range []struct {
+		Key  string
+		Name string
+	}{
+		{Key: keyDateObs, Name: fitsDateObs},
+		{Key: keyInstrument, Name: fitsInstrument},
+		{Key: keyTelescope, Name: fitsTelescope},
+		{Key: keyObject, Name: fitsObject},
+		{Key: keyObserver, Name: fitsObserver},
+	} {
+		if v, ok := hdr.values[k.Key]; ok && v != "" {
+			info.Parameters = append(info.Parameters, prospect.MakeParameter(k.Name, v))
+		}
+	}
+	return info, nil
+}
+
+type header struct {
+	values map[string]string
+	size   int64
+}
+
+// readHeader reads the cards of the primary header until the END card and the
+// rest of the block containing it. Each card is 80 characters long: a keyword
+// of 8 characters, the value indicator "= " and a value followed by an optional
+// comment introduced by a slash.
+func readHeader(r io.Reader) (header, error) {
+	h := header{values: make(map[string]string)}
+	card := make([]byte, cardLen)
+	for {
+		if _, err := io.ReadFull(r, card); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = fmt.Errorf("missing %s card", keyEnd)
+			}
+			return h, err
+		}
+		h.size += cardLen
+		if h.size == cardLen && !bytes.HasPrefix(card, []byte("SIMPLE  =")) {
+			return h, fmt.Errorf("not a fits file")
+		}
+		key := strings.TrimSpace(string(card[:8]))
+		if key == keyEnd {
+			break
+		}
+		if !bytes.Equal(card[8:10], []byte("= ")) {
+			continue
+		}
+		h.values[key] = parseValue(string(card[10:]))
+	}
+	if n := h.size % blockLen; n > 0 {
+		c, err := io.CopyN(ioutil.Discard, r, blockLen-n)
+		h.size += c
+		if err != nil && err != io.EOF {
+			return h, err
+		}
+	}
+	return h, nil
+}
+
+// parseValue gives the value of a card without its comment. The quotes of a
+// string value are removed and the doubled quotes are unescaped.
+func parseValue(str string) string {
+	str = strings.TrimSpace(str)
+	if !strings.HasPrefix(str, "'") {
+		if x := strings.IndexByte(str, '/'); x >= 0 {
+			str = str[:x]
+		}
+		return strings.TrimSpace(str)
+	}
+	var buf strings.Builder
+	for i := 1; i < len(str); i++ {
+		if str[i] == '\'' {
+			if i+1 < len(str) && str[i+1] == '\'' {
+				buf.WriteByte('\'')
+				i++
+				continue
+			}
+			break
+		}
+		buf.WriteByte(str[i])
+	}
+	return strings.TrimRight(buf.String(), " ")
+}
+
+// parseDate parses the value of DATE-OBS in the configured time zone. The old
+// format dd/mm/yy is only valid for the years 1900 to 1999.
+func (m *module) parseDate(str string) (time.Time, error) {
+	for _, layout := range []string{
+		"2006-01-02T15:04:05.999999999",
+		"2006-01-02T15:04:05",
+		"2006-01-02",
+		"02/01/06",
+	} {
+		when, err := m.cfg.ParseTime(layout, str)
+		if err != nil {
+			continue
+		}
+		if layout == "02/01/06" && when.Year() >= 2000 {
+			when = when.AddDate(-100, 0, 0)
+		}
+		return when, nil
+	}
+	return time.Time{}, fmt.Errorf("%s: invalid date", str)
+}
+
+// listFiles gives the files found under location having one of the given
+// extensions. location can also be a single file.
+func listFiles(location string, exts []string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(location, func(file string, i os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !i.Mode().IsRegular() {
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(file))
+		for _, e := range exts {
+			if strings.ToLower(e) == ext {
+				files = append(files, file)
+				break
+			}
+		}
+		return nil
+	})
+	return files, err
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/busoc/prospect"
+)
+
+// makeFITS builds a primary header with the given cards padded to a whole
+// block followed by data.
+func makeFITS(data string, cards ...string) []byte {
+	var buf bytes.Buffer
+	for _, c := range append([]string{"SIMPLE  =                    T"}, cards...) {
+		buf.WriteString(c + strings.Repeat(" ", cardLen-len(c)))
+	}
+	buf.WriteString(keyEnd + strings.Repeat(" ", cardLen-len(keyEnd)))
+	if n := buf.Len() % blockLen; n > 0 {
+		buf.WriteString(strings.Repeat(" ", blockLen-n))
+	}
+	buf.WriteString(data)
+	return buf.Bytes()
+}
+
+func TestParseValue(t *testing.T) {
+	data := []struct {
+		Value string
+		Want  string
+	}{
+		{Value: "                   T", Want: "T"},
+		{Value: "                  42 / the answer", Want: "42"},
+		{Value: "'M31     '", Want: "M31"},
+		{Value: "'M31 / Andromeda' / the object", Want: "M31 / Andromeda"},
+		{Value: "'O''Brien '", Want: "O'Brien"},
+		{Value: "''", Want: ""},
+		{Value: "", Want: ""},
+	}
+	for _, d := range data {
+		if got := parseValue(d.Value); got != d.Want {
+			t.Errorf("%q: values mismatched! want %q, got %q", d.Value, d.Want, got)
+		}
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	data := []struct {
+		Name   string
+		Data   []byte
+		Values map[string]string
+		Size   int64
+		Err    bool
+	}{
+		{
+			Name: "one block",
+			Data: makeFITS("data", "OBJECT  = 'M31     '", "COMMENT without value"),
+			Values: map[string]string{
+				"SIMPLE":  "T",
+				keyObject: "M31",
+			},
+			Size: blockLen,
+		},
+		{
+			Name:   "two blocks",
+			Data:   makeFITS("", strings.Split(strings.Repeat("HISTORY more cards,", 40), ",")...),
+			Values: map[string]string{"SIMPLE": "T"},
+			Size:   2 * blockLen,
+		},
+		{
+			Name: "not a fits file",
+			Data: []byte(strings.Repeat("x", blockLen)),
+			Err:  true,
+		},
+		{
+			Name: "missing end card",
+			Data: makeFITS("")[:cardLen],
+			Err:  true,
+		},
+	}
+	for _, d := range data {
+		h, err := readHeader(bytes.NewReader(d.Data))
+		if d.Err {
+			if err == nil {
+				t.Errorf("%s: expected an error", d.Name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Name, err)
+			continue
+		}
+		if h.size != d.Size {
+			t.Errorf("%s: sizes mismatched! want %d, got %d", d.Name, d.Size, h.size)
+		}
+		if len(h.values) != len(d.Values) {
+			t.Errorf("%s: values mismatched! want %v, got %v", d.Name, d.Values, h.values)
+		}
+		for k, v := range d.Values {
+			if h.values[k] != v {
+				t.Errorf("%s: %s: values mismatched! want %q, got %q", d.Name, k, v, h.values[k])
+			}
+		}
+	}
+}
+
+func TestParseDate(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip(err)
+	}
+	data := []struct {
+		Value string
+		Zone  *time.Location
+		Want  time.Time
+		Err   bool
+	}{
+		{Value: "2021-01-04T10:00:00.5", Want: time.Date(2021, 1, 4, 10, 0, 0, 5e8, time.UTC)},
+		{Value: "2021-01-04T10:00:00", Want: time.Date(2021, 1, 4, 10, 0, 0, 0, time.UTC)},
+		{Value: "2021-01-04T10:00:00", Zone: tokyo, Want: time.Date(2021, 1, 4, 1, 0, 0, 0, time.UTC)},
+		{Value: "2021-01-04", Want: time.Date(2021, 1, 4, 0, 0, 0, 0, time.UTC)},
+		{Value: "04/01/98", Want: time.Date(1998, 1, 4, 0, 0, 0, 0, time.UTC)},
+		{Value: "04/01/21", Want: time.Date(1921, 1, 4, 0, 0, 0, 0, time.UTC)},
+		{Value: "2021-13-04", Err: true},
+		{Value: "yesterday", Err: true},
+	}
+	for _, d := range data {
+		m := module{cfg: prospect.Config{Timezone: prospect.Location{Location: d.Zone}}}
+		got, err := m.parseDate(d.Value)
+		if d.Err {
+			if err == nil {
+				t.Errorf("%s: expected an error", d.Value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Value, err)
+			continue
+		}
+		if !got.Equal(d.Want) {
+			t.Errorf("%s: times mismatched! want %s, got %s", d.Value, d.Want, got)
+		}
+	}
+}
+
+func TestProcess(t *testing.T) {
+	dir := t.TempDir()
+	files := []struct {
+		Name string
+		Data []byte
+	}{
+		{
+			Name: "m31.fits",
+			Data: makeFITS("data",
+				"DATE-OBS= '2021-01-04T10:00:00'",
+				"INSTRUME= 'WFC     '",
+				"TELESCOP= 'HST     '",
+				"OBJECT  = 'M31     ' / Andromeda",
+				"OBSERVER= ''",
+			),
+		},
+		{Name: "notes.txt", Data: []byte("not a fits file")},
+		{Name: "sub/broken.FTS", Data: []byte(strings.Repeat("x", blockLen))},
+	}
+	for _, f := range files {
+		file := filepath.Join(dir, f.Name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, f.Data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mod, err := New(prospect.Config{Location: dir})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	i, err := mod.Process()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if want := filepath.Join(dir, "m31.fits"); i.File != want {
+		t.Errorf("files mismatched! want %s, got %s", want, i.File)
+	}
+	if i.Mime != mimeFITS || i.Type != prospect.TypeData || i.Model != "WFC" {
+		t.Errorf("unexpected info %+v", i)
+	}
+	if want := int64(len(files[0].Data)); i.Size != want {
+		t.Errorf("sizes mismatched! want %d, got %d", want, i.Size)
+	}
+	if want := time.Date(2021, 1, 4, 10, 0, 0, 0, time.UTC); !i.AcqTime.Equal(want) || !i.ModTime.Equal(want) {
+		t.Errorf("times mismatched! want %s, got %s/%s", want, i.AcqTime, i.ModTime)
+	}
+	sum, _ := prospect.Config{}.Digest(bytes.NewReader(files[0].Data))
+	if i.Integrity.String() != sum.String() {
+		t.Errorf("digests mismatched! want %s, got %s", sum, i.Integrity)
+	}
+	want := map[string]string{
+		fitsDateObs:    "2021-01-04T10:00:00",
+		fitsInstrument: "WFC",
+		fitsTelescope:  "HST",
+		fitsObject:     "M31",
+	}
+	for _, p := range i.Parameters {
+		if p.Name == prospect.FileSize {
+			continue
+		}
+		if v, ok := want[p.Name]; !ok || v != p.Value {
+			t.Errorf("%s: unexpected parameter %q", p.Name, p.Value)
+		}
+		delete(want, p.Name)
+	}
+	if len(want) > 0 {
+		t.Errorf("missing parameters %v", want)
+	}
+
+	if _, err := mod.Process(); err == nil || errors.Is(err, prospect.ErrDone) {
+		t.Errorf("invalid file: expected an error, got %v", err)
+	}
+	if _, err := mod.Process(); !errors.Is(err, prospect.ErrDone) {
+		t.Errorf("expected %v, got %v", prospect.ErrDone, err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"a.fits", "b.fit", "c.FTS", "d.txt", "e.img"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, f), makeFITS(""), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := []struct {
+		Config string
+		Want   []string
+	}{
+		{Want: []string{"a.fits", "b.fit", "c.FTS"}},
+		{Config: "extensions = [\".IMG\", \".txt\"]\n", Want: []string{"d.txt", "e.img"}},
+	}
+	for _, d := range data {
+		cfg := prospect.Config{Location: dir}
+		if d.Config != "" {
+			cfg.Config = filepath.Join(t.TempDir(), "fits.toml")
+			if err := ioutil.WriteFile(cfg.Config, []byte(d.Config), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mod, err := New(cfg)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", d.Config, err)
+			continue
+		}
+		var got []string
+		for _, f := range mod.(*module).files {
+			got = append(got, filepath.Base(f))
+		}
+		if strings.Join(got, ",") != strings.Join(d.Want, ",") {
+			t.Errorf("%q: files mismatched! want %s, got %s", d.Config, d.Want, got)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/busoc/prospect"
+	"github.com/midbel/toml"
+)
+
+const (
+	gitRef    = "git.ref"
+	gitPath   = "git.path"
+	gitCommit = "git.commit"
+	gitAuthor = "git.author"
+	gitEmail  = "git.email"
+	gitObject = "git.object"
+)
+
+type blob struct {
+	Object string
+	Path   string
+	Size   int64
+}
+
+type module struct {
+	cfg    prospect.Config
+	ref    string
+	export string
+
+	blobs []blob
+}
+
+func init() {
+	prospect.Register("git", New)
+}
+
+func New(cfg prospect.Config) (prospect.Module, error) {
+	c := struct {
+		Ref    string
+		Export string
+	}{}
+	if err := toml.DecodeFile(cfg.Config, &c); err != nil {
+		return nil, err
+	}
+	if c.Ref == "" {
+		c.Ref = "HEAD"
+	}
+	m := module{
+		cfg:    cfg,
+		ref:    c.Ref,
+		export: c.Export,
+	}
+	if m.export == "" {
+		// the files of the working tree are only those of the ref if it is
+		// checked out: the blobs of the other refs should be exported.
+		same, err := m.checkedOut()
+		if err != nil {
+			return nil, err
+		}
+		if !same {
+			return nil, fmt.Errorf("%s: ref not checked out (export should be set)", m.ref)
+		}
+	}
+	var err error
+	if m.blobs, err = m.listBlobs(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (m *module) String() string {
+	return "git"
+}
+
+func (m *module) Process() (prospect.FileInfo, error) {
+	if len(m.blobs) == 0 {
+		return prospect.FileInfo{}, prospect.ErrDone
+	}
+	b := m.blobs[0]
+	m.blobs = m.blobs[1:]
+
+	info := prospect.FileInfo{
+		File:  filepath.Join(m.cfg.Location, b.Path),
+		Type:  m.cfg.Type,
+		Level: m.cfg.Level,
+		Size:  b.Size,
+	}
+	if m.export != "" {
+		info.File = filepath.Join(m.export, b.Path)
+	}
+	var err error
+	if info.Integrity, err = m.readBlob(b, info.File); err != nil {
+		return prospect.FileInfo{}, fmt.Errorf("%s: %w", b.Path, err)
+	}
+	if info.Type == "" {
+		info.Type = prospect.TypeData
+	}
+	info.Parameters = []prospect.Parameter{
+		prospect.MakeParameter(gitRef, m.ref),
+		prospect.MakeParameter(gitPath, b.Path),
+		prospect.MakeParameter(gitObject, b.Object),
+		prospect.MakeParameter(prospect.FileSize, b.Size),
+	}
+	return m.lastCommit(info, b)
+}
+
+// readBlob computes the digest of the content of b. The content is also
+// written to file if the blobs are exported. The object name of b is not used
+// as digest: it is the SHA1 of the content prefixed by a git header.
+func (m *module) readBlob(b blob, file string) (prospect.Integrity, error) {
+	var (
+		digest = m.cfg.NewDigester()
+		w      = io.Writer(digest)
+	)
+	if m.export != "" {
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return prospect.Integrity{}, err
+		}
+		f, err := os.Create(file)
+		if err != nil {
+			return prospect.Integrity{}, err
+		}
+		defer f.Close()
+		w = io.MultiWriter(f, digest)
+	}
+	cmd := exec.Command("git", "-C", m.cfg.Location, "cat-file", "blob", b.Object)
+	r, err := cmd.StdoutPipe()
+	if err != nil {
+		return prospect.Integrity{}, err
+	}
+	if err := cmd.Start(); err != nil {
+		return prospect.Integrity{}, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		cmd.Wait()
+		return prospect.Integrity{}, err
+	}
+	if err := cmd.Wait(); err != nil {
+		return prospect.Integrity{}, err
+	}
+	return digest.Integrity(), nil
+}
+
+// checkedOut reports whether the ref is the commit checked out in the working
+// tree.
+func (m *module) checkedOut() (bool, error) {
+	head, err := m.git("rev-parse", "HEAD")
+	if err != nil {
+		return false, err
+	}
+	ref, err := m.git("rev-parse", m.ref+"^{commit}")
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(bytes.TrimSpace(head), bytes.TrimSpace(ref)), nil
+}
+
+// lastCommit sets the acquisition time of info to the time of the last commit
+// that modified the blob and adds the commit and its author as metadata.
+func (m *module) lastCommit(info prospect.FileInfo, b blob) (prospect.FileInfo, error) {
+	out, err := m.git("log", "-1", "--format=%H%x00%an%x00%ae%x00%cI", m.ref, "--", b.Path)
+	if err != nil {
+		return info, err
+	}
+	parts := strings.Split(strings.TrimSpace(string(out)), "\x00")
+	if len(parts) != 4 {
+		return info, fmt.Errorf("%s: no commit found", b.Path)
+	}
+	when, err := m.cfg.ParseTime(time.RFC3339, parts[3])
+	if err != nil {
+		return info, err
+	}
+	info.AcqTime = when
+	info.ModTime = when
+	info.Parameters = append(info.Parameters,
+		prospect.MakeParameter(gitCommit, parts[0]),
+		prospect.MakeParameter(gitAuthor, parts[1]),
+		prospect.MakeParameter(gitEmail, parts[2]),
+	)
+	return info, nil
+}
+
+// listBlobs lists the blobs of the tree of the configured ref. Each entry of
+// the output of ls-tree has the form: <mode> <type> <object> <size>\t<path>.
+func (m *module) listBlobs() ([]blob, error) {
+	out, err := m.git("ls-tree", "-r", "-l", "-z", m.ref)
+	if err != nil {
+		return nil, err
+	}
+	var bs []blob
+	for _, line := range bytes.Split(out, []byte{0}) {
+		if len(line) == 0 {
+			continue
+		}
+		x := bytes.IndexByte(line, '\t')
+		if x < 0 {
+			return nil, fmt.Errorf("%s: invalid tree entry", line)
+		}
+		fields := strings.Fields(string(line[:x]))
+		if len(fields) != 4 || fields[1] != "blob" {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		b := blob{
+			Object: fields[2],
+			Path:   string(line[x+1:]),
+			Size:   size,
+		}
+		bs = append(bs, b)
+	}
+	return bs, nil
+}
+
+func (m *module) git(args ...string) ([]byte, error) {
+	args = append([]string{"-C", m.cfg.Location}, args...)
+	out, err := exec.Command("git", args...).Output()
+	if err, ok := err.(*exec.ExitError); ok && len(err.Stderr) > 0 {
+		return nil, fmt.Errorf("git: %s", bytes.TrimSpace(err.Stderr))
+	}
+	return out, err
+}
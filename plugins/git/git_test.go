@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/busoc/prospect"
+)
+
+// makeRepo creates a repository with two commits of the file data.txt: the
+// content of the first one is old and the one of the second is new.
+func makeRepo(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	run := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		cmd.Env = append(cmd.Env,
+			"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+			"GIT_CONFIG_NOSYSTEM=1", "HOME="+dir,
+		)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %s (%s)", args, err, out)
+		}
+	}
+	write := func(str string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, "data.txt"), []byte(str), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run("init", "-q")
+	write("old")
+	run("add", "data.txt")
+	run("commit", "-q", "-m", "first")
+	write("new")
+	run("commit", "-q", "-a", "-m", "second")
+	return dir
+}
+
+func TestProcess(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	var (
+		repo   = makeRepo(t)
+		export = t.TempDir()
+	)
+	data := []struct {
+		Config  string
+		File    string
+		Content string
+		Invalid bool
+	}{
+		{Config: ``, File: filepath.Join(repo, "data.txt"), Content: "new"},
+		{Config: "ref = 'HEAD~1'\n", Invalid: true},
+		{Config: "ref = 'HEAD~1'\nexport = '" + export + "'\n", File: filepath.Join(export, "data.txt"), Content: "old"},
+	}
+	for _, d := range data {
+		file := filepath.Join(t.TempDir(), "git.toml")
+		if err := ioutil.WriteFile(file, []byte(d.Config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mod, err := New(prospect.Config{Location: repo, Config: file})
+		if d.Invalid {
+			if err == nil {
+				t.Errorf("%q: expected an error", d.Config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", d.Config, err)
+			continue
+		}
+		info, err := mod.Process()
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", d.Config, err)
+			continue
+		}
+		if info.File != d.File {
+			t.Errorf("%q: files mismatched! want %s, got %s", d.Config, d.File, info.File)
+		}
+		if buf, err := ioutil.ReadFile(info.File); err != nil || string(buf) != d.Content {
+			t.Errorf("%q: content mismatched! want %s, got %s (%v)", d.Config, d.Content, buf, err)
+		}
+		sum := sha256.Sum256([]byte(d.Content))
+		if info.Integrity.Algorithm != prospect.SHA || info.Integrity.Digest() != hex.EncodeToString(sum[:]) {
+			t.Errorf("%q: digest mismatched! want sha256 of %q, got %s", d.Config, d.Content, info.Integrity)
+		}
+		var object string
+		for _, p := range info.Parameters {
+			if p.Name == gitObject {
+				object = p.Value
+			}
+		}
+		if len(object) != 40 {
+			t.Errorf("%q: missing object name of the blob (%q)", d.Config, object)
+		}
+		if _, err := mod.Process(); err != prospect.ErrDone {
+			t.Errorf("%q: expected ErrDone, got %v", d.Config, err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+
+	"github.com/midbel/mbox"
+)
+
+// hdrAlternative is set on the parts of a message that are one of the
+// representations of a multipart/alternative body. Its value identifies the
+// body and the representation: "body.representation". It is only used inside
+// the module: the parts of the messages read never keep their own.
+const hdrAlternative = "X-Prospect-Alternative"
+
+const (
+	multiPart   = "multipart/"
+	multiAlt    = "multipart/alternative"
+	fromLineTag = "From "
+)
+
+// readMessage reads the next message of rs. Its raw text is kept to find the
+// parts belonging to a multipart/alternative body since they are flattened
+// with the other parts of the message by mbox. It returns io.EOF if rs has no
+// more message.
+func readMessage(rs *bufio.Reader) (mbox.Message, error) {
+	raw, err := readRaw(rs)
+	if err != nil {
+		return mbox.Message{}, err
+	}
+	msg, err := mbox.ReadMessage(bufio.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		return msg, err
+	}
+	markAlternatives(msg, raw)
+	return msg, nil
+}
+
+// readRaw gives the text of a message: its From line and the following lines
+// until the From line of the next message.
+func readRaw(rs *bufio.Reader) ([]byte, error) {
+	var (
+		buf     bytes.Buffer
+		started bool
+		delim   = []byte(fromLineTag)
+	)
+	for {
+		if started {
+			if next, _ := rs.Peek(len(delim)); bytes.Equal(next, delim) {
+				break
+			}
+		}
+		line, err := rs.ReadBytes('\n')
+		buf.Write(line)
+		if len(bytes.TrimSpace(line)) > 0 {
+			started = true
+		}
+		if err == io.EOF && started {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// markAlternatives sets hdrAlternative on the parts of msg that are a
+// representation of a multipart/alternative body. The parts of msg are left
+// unmarked if the structure found in raw does not match them.
+func markAlternatives(msg mbox.Message, raw []byte) {
+	for _, p := range msg.Parts {
+		p.Del(hdrAlternative)
+	}
+	rs := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw)))
+	if _, err := rs.ReadLine(); err != nil {
+		return
+	}
+	hdr, err := rs.ReadMIMEHeader()
+	if err != nil {
+		return
+	}
+	var s structure
+	if err := s.walk(hdr.Get(hdrType), rs.R, ""); err != nil || len(s.leaves) != len(msg.Parts) {
+		return
+	}
+	for i, str := range s.leaves {
+		if str != "" && msg.Parts[i].Header != nil {
+			msg.Parts[i].Set(hdrAlternative, str)
+		}
+	}
+}
+
+// structure gives, for each leaf part of a message in the order they are
+// found, the representation of the innermost multipart/alternative body
+// containing it.
+type structure struct {
+	leaves []string
+	bodies int
+}
+
+func (s *structure) walk(ctype string, body io.Reader, alt string) error {
+	mt, ps, err := mime.ParseMediaType(ctype)
+	if err != nil || !strings.HasPrefix(mt, multiPart) {
+		s.leaves = append(s.leaves, alt)
+		return nil
+	}
+	var (
+		mr   = multipart.NewReader(body, ps["boundary"])
+		id   int
+		curr = alt
+	)
+	if mt == multiAlt {
+		s.bodies++
+		id = s.bodies
+	}
+	for i := 0; ; i++ {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if id > 0 {
+			curr = fmt.Sprintf("%d.%d", id, i)
+		}
+		if err := s.walk(p.Header.Get(hdrType), p, curr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// alternativeOf splits the value of hdrAlternative of p in the body and the
+// representation it belongs to. body is empty if p is not part of a
+// multipart/alternative body.
+func alternativeOf(p mbox.Part) (body, repr string) {
+	str := p.Get(hdrAlternative)
+	if x := strings.IndexByte(str, '.'); x > 0 {
+		return str[:x], str[x+1:]
+	}
+	return "", ""
+}
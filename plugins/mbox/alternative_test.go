@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"mime"
+	"strings"
+	"testing"
+)
+
+const alternativeText = `From sender@example.com Mon Jan  4 10:00:00 2021
+From: sender@example.com
+To: receiver@example.com
+Subject: report
+Date: Mon, 04 Jan 2021 10:00:00 +0000
+MIME-Version: 1.0
+Content-Type: multipart/mixed; boundary="XXX"
+
+--XXX
+Content-Type: multipart/alternative; boundary="YYY"
+
+--YYY
+Content-Type: text/plain
+
+the report in plain text
+--YYY
+Content-Type: text/html
+
+<p>the report in html</p>
+--YYY--
+--XXX
+Content-Type: text/csv; name="data.csv"
+Content-Disposition: attachment; filename="data.csv"
+
+a,b
+1,2
+--XXX--
+`
+
+func TestMarkAlternatives(t *testing.T) {
+	msg, err := readMessage(bufio.NewReader(strings.NewReader(alternativeText)))
+	if err != nil {
+		t.Fatalf("fail to read message: %s", err)
+	}
+	want := []string{"1.0", "1.1", ""}
+	if len(msg.Parts) != len(want) {
+		t.Fatalf("expected %d parts, got %d", len(want), len(msg.Parts))
+	}
+	for i, p := range msg.Parts {
+		if got := p.Get(hdrAlternative); got != want[i] {
+			t.Errorf("part #%d: representations mismatched! want %q, got %q", i+1, want[i], got)
+		}
+	}
+
+	forged := strings.Replace(messageText(attachment{Name: "data.csv", Mime: "text/csv", Body: "a,b\n"}), "Content-Transfer-Encoding", hdrAlternative+": 1.1\nContent-Transfer-Encoding", 1)
+	msg, err = readMessage(bufio.NewReader(strings.NewReader(forged)))
+	if err != nil {
+		t.Fatalf("fail to read message: %s", err)
+	}
+	if got := msg.Parts[0].Get(hdrAlternative); got != "" {
+		t.Errorf("header of the message should be removed, got %q", got)
+	}
+}
+
+func TestHandlerAlternative(t *testing.T) {
+	msg, err := readMessage(bufio.NewReader(strings.NewReader(alternativeText)))
+	if err != nil {
+		t.Fatalf("fail to read message: %s", err)
+	}
+	var (
+		plain = []string{"text/plain"}
+		html  = []string{"text/html"}
+		csv   = []string{"text/csv"}
+	)
+	data := []struct {
+		Name     string
+		Inline   bool
+		Includes []include
+		Want     []string
+	}{
+		{
+			Name:     "plain first",
+			Includes: []include{{Types: plain}, {Types: html}, {Types: csv}},
+			Want:     []string{"text/plain", "text/csv"},
+		},
+		{
+			Name:     "html first",
+			Includes: []include{{Types: html}, {Types: plain}, {Types: csv}},
+			Want:     []string{"text/html", "text/csv"},
+		},
+		{
+			Name:     "any text",
+			Includes: []include{{Types: []string{"text/"}}},
+			Want:     []string{"text/plain", "text/csv"},
+		},
+		{
+			Name:     "attachment only",
+			Includes: []include{{Types: csv}},
+			Want:     []string{"text/csv"},
+		},
+		{
+			Name:     "included",
+			Inline:   true,
+			Includes: []include{{Types: plain}, {Types: html}, {Types: csv}},
+			Want:     []string{"text/plain", "text/html", "text/csv"},
+		},
+	}
+	for _, d := range data {
+		var (
+			h = handler{
+				Maildir:  t.TempDir(),
+				Inline:   d.Inline,
+				Includes: d.Includes,
+			}
+			got []string
+		)
+		for _, i := range h.items(msg) {
+			mt, _, _ := mime.ParseMediaType(i.Get(hdrType))
+			got = append(got, mt)
+		}
+		if strings.Join(got, ",") != strings.Join(d.Want, ",") {
+			t.Errorf("%s: parts mismatched! want %s, got %s", d.Name, d.Want, got)
+		}
+	}
+}
+
+func TestModuleAlternative(t *testing.T) {
+	const config = "[[mail.file]]\ncontent-type = [\"text/html\"]\n[[mail.file]]\ncontent-type = [\"text/plain\"]\n[[mail.file]]\ncontent-type = [\"text/csv\"]\n"
+	m, err := newModule(t, alternativeText+alternativeText, "", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for {
+		i, err := m.Process()
+		if err != nil {
+			break
+		}
+		got = append(got, i.Mime)
+	}
+	if want := "text/html,text/csv,text/html,text/csv"; strings.Join(got, ",") != want {
+		t.Errorf("files mismatched! want %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/busoc/prospect"
+)
+
+const (
+	mailArchivePath = "mail.archive.path"
+
+	roleArchive = "archive"
+	extZip      = ".zip"
+	extExplode  = ".d"
+	mimeZip     = "application/zip"
+
+	// defaultExplodeLimit is the maximum number of bytes extracted from a zip
+	// file when the explode-limit option is not set.
+	defaultExplodeLimit = 1 << 30
+)
+
+var errLimit = errors.New("extraction limit reached")
+
+func isZip(mt, file string) bool {
+	if ix := strings.IndexByte(mt, ';'); ix >= 0 {
+		mt = mt[:ix]
+	}
+	return strings.EqualFold(strings.TrimSpace(mt), mimeZip) || strings.EqualFold(filepath.Ext(file), extZip)
+}
+
+// explode extracts the members of the zip file in the directory given by
+// explodeDir and gives a record for each of them, based on
+// info. The members that are zip files are extracted in turn, instead of being
+// given, until depth is reached. limit is the number of bytes that can still be
+// extracted, nested zip files included: the member exceeding it is removed and
+// the extraction stops.
+func (m *module) explode(info prospect.FileInfo, file, prefix string, depth int, limit *int64) []part {
+	r, err := zip.OpenReader(file)
+	if err != nil {
+		return []part{{Info: info, Err: fmt.Errorf("%s: %w", file, err)}}
+	}
+	defer r.Close()
+
+	var (
+		dir   = explodeDir(file)
+		parts []part
+	)
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		name := path.Clean(strings.ReplaceAll(f.Name, "\\", "/"))
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			m.cfg.Log().Warn("archive member skipped", "reason", "outside of archive", "file", file, "member", f.Name)
+			continue
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if depth > 1 && isZip("", name) {
+			if _, err := m.extractMember(target, f, limit); err != nil {
+				parts = append(parts, part{Info: info, Err: err})
+				if errors.Is(err, errLimit) {
+					break
+				}
+				continue
+			}
+			parts = append(parts, m.explode(info, target, prefix+name+"/", depth-1, limit)...)
+			continue
+		}
+		fi := info
+		fi.File = target
+		fi.Mime = mime.TypeByExtension(filepath.Ext(name))
+		if ix := strings.IndexByte(fi.Mime, ';'); ix >= 0 {
+			fi.Mime = fi.Mime[:ix]
+		}
+		fi.Parameters = append([]prospect.Parameter{}, info.Parameters...)
+		fi.Links = append([]prospect.Link{}, info.Links...)
+		fi.Links = append(fi.Links, prospect.Link{File: file, Role: roleArchive})
+
+		m.digest.Reset()
+		n, err := m.extractMember(target, f, limit)
+		if err == nil {
+			fi.Size = n
+			fi.Integrity = m.digest.Integrity()
+			fi.Parameters = append(fi.Parameters,
+				prospect.MakeParameter(prospect.FileSize, fi.Size),
+				prospect.MakeParameter(mailArchivePath, prefix+name),
+			)
+		} else {
+			m.cfg.Log().Error("archive member not written", "file", file, "member", f.Name, "error", err)
+		}
+		parts = append(parts, part{Info: fi, Err: err})
+		if errors.Is(err, errLimit) {
+			break
+		}
+	}
+	return parts
+}
+
+// explodeDir gives the directory where the members of the zip file are
+// extracted: the name of file without its extension or, if it has none, its
+// name followed by extExplode so that it is never the zip file itself.
+func explodeDir(file string) string {
+	ext := filepath.Ext(file)
+	if ext == "" {
+		return file + extExplode
+	}
+	return strings.TrimSuffix(file, ext)
+}
+
+// extractMember writes the content of f to file and to the digest. It gives the
+// number of bytes written which is subtracted from limit. The size given by
+// the header of f is not trusted: the file is removed if more than limit bytes
+// are read.
+func (m *module) extractMember(file string, f *zip.File, limit *int64) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return 0, err
+	}
+	r, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	w, err := os.Create(file)
+	if err != nil {
+		return 0, err
+	}
+	defer w.Close()
+
+	n, err := io.Copy(io.MultiWriter(w, m.digest), io.LimitReader(r, *limit+1))
+	if err == nil && n > *limit {
+		err = fmt.Errorf("%s: %w (%d bytes)", f.Name, errLimit, *limit)
+	}
+	if err != nil {
+		os.Remove(file)
+		return 0, err
+	}
+	*limit -= n
+	return n, nil
+}
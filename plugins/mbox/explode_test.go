@@ -0,0 +1,131 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/busoc/prospect"
+)
+
+func TestExplodeLimit(t *testing.T) {
+	members := []struct {
+		Name string
+		Body string
+	}{
+		{Name: "a.txt", Body: strings.Repeat("a", 10)},
+		{Name: "b.txt", Body: strings.Repeat("b", 10)},
+		{Name: "c.txt", Body: strings.Repeat("c", 10)},
+	}
+	data := []struct {
+		Limit int64
+		Want  []string
+		Err   bool
+	}{
+		{Limit: 100, Want: []string{"a.txt", "b.txt", "c.txt"}},
+		{Limit: 30, Want: []string{"a.txt", "b.txt", "c.txt"}},
+		{Limit: 15, Want: []string{"a.txt"}, Err: true},
+		{Limit: 5, Err: true},
+	}
+	for _, d := range data {
+		var (
+			dir  = t.TempDir()
+			file = filepath.Join(dir, "archive.zip")
+		)
+		w, err := os.Create(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z := zip.NewWriter(w)
+		for _, m := range members {
+			f, err := z.Create(m.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write([]byte(m.Body))
+		}
+		z.Close()
+		w.Close()
+
+		var (
+			m      = module{digest: prospect.Config{}.NewDigester()}
+			n      = d.Limit
+			got    []string
+			failed bool
+		)
+		for _, p := range m.explode(prospect.FileInfo{File: file}, file, "", 1, &n) {
+			if p.Err != nil {
+				failed = failed || errors.Is(p.Err, errLimit)
+				if _, err := os.Stat(p.Info.File); err == nil && p.Info.File != file {
+					t.Errorf("limit(%d): %s: file kept after error", d.Limit, p.Info.File)
+				}
+				continue
+			}
+			got = append(got, filepath.Base(p.Info.File))
+			if p.Info.Size != 10 {
+				t.Errorf("limit(%d): %s: size mismatched! want 10, got %d", d.Limit, p.Info.File, p.Info.Size)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(d.Want, ",") {
+			t.Errorf("limit(%d): members mismatched! want %s, got %s", d.Limit, d.Want, got)
+		}
+		if failed != d.Err {
+			t.Errorf("limit(%d): limit error mismatched! want %t, got %t", d.Limit, d.Err, failed)
+		}
+	}
+}
+
+func TestExplodeDir(t *testing.T) {
+	data := []struct {
+		File string
+		Want string
+	}{
+		{File: "/mail/archive.zip", Want: "/mail/archive"},
+		{File: "/mail/archive.tar.zip", Want: "/mail/archive.tar"},
+		{File: "/mail/archive", Want: "/mail/archive.d"},
+	}
+	for _, d := range data {
+		if got := explodeDir(d.File); got != d.Want {
+			t.Errorf("%s: directories mismatched! want %s, got %s", d.File, d.Want, got)
+		}
+	}
+
+	var buf bytes.Buffer
+	z := zip.NewWriter(&buf)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		f, err := z.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(name))
+	}
+	z.Close()
+	var (
+		input  = messageText(attachment{Name: "archive", Mime: mimeZip, Body: buf.String()})
+		config = "[[mail.file]]\ncontent-type = [\"application/zip\"]\nexplode = true\n"
+	)
+	m, err := newModule(t, input, "keep-files = true", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for {
+		i, err := m.Process()
+		if errors.Is(err, prospect.ErrDone) {
+			break
+		}
+		if err != nil {
+			t.Errorf("unexpected error: %s", err)
+			break
+		}
+		got = append(got, filepath.Join(filepath.Base(filepath.Dir(i.File)), filepath.Base(i.File)))
+	}
+	want := []string{filepath.Join("archive.d", "a.txt"), filepath.Join("archive.d", "b.txt")}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("members mismatched! want %s, got %s", want, got)
+	}
+}
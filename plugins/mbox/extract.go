@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bufio"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/busoc/prospect"
+)
+
+// extractFunc gives the metadata found in the content of a file. It should
+// only read what it needs from r.
+type extractFunc func(io.Reader) []prospect.Parameter
+
+var extractors = make(map[string]extractFunc)
+
+func init() {
+	registerExtractor("image", extractImage)
+}
+
+// registerExtractor registers fn for a full mime type (image/png) or only for
+// a main type (image).
+func registerExtractor(mime string, fn extractFunc) {
+	extractors[strings.ToLower(mime)] = fn
+}
+
+// extractMetadata gives the metadata of file, an attachment of the given mime
+// type already written. The file is only read by the extractor registered for
+// the mime type, if any.
+func extractMetadata(mime, file string) []prospect.Parameter {
+	mime = strings.ToLower(mime)
+	if ix := strings.IndexByte(mime, ';'); ix >= 0 {
+		mime = mime[:ix]
+	}
+	fn, ok := extractors[mime]
+	if !ok {
+		if ix := strings.IndexByte(mime, '/'); ix >= 0 {
+			fn, ok = extractors[mime[:ix]]
+		}
+	}
+	if !ok {
+		return nil
+	}
+	r, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer r.Close()
+	return fn(bufio.NewReader(r))
+}
+
+func extractImage(r io.Reader) []prospect.Parameter {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil
+	}
+	return []prospect.Parameter{
+		prospect.MakeParameter(prospect.ImageWidth, cfg.Width),
+		prospect.MakeParameter(prospect.ImageHeight, cfg.Height),
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/busoc/prospect"
+)
+
+func TestExtractMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 3, 2))); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		dir     = t.TempDir()
+		picture = filepath.Join(dir, "picture.png")
+		text    = filepath.Join(dir, "data.txt")
+	)
+	if err := ioutil.WriteFile(picture, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(text, []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data := []struct {
+		Mime string
+		File string
+		Want map[string]string
+	}{
+		{Mime: "image/png", File: picture, Want: map[string]string{prospect.ImageWidth: "3", prospect.ImageHeight: "2"}},
+		{Mime: "IMAGE/PNG; name=picture.png", File: picture, Want: map[string]string{prospect.ImageWidth: "3", prospect.ImageHeight: "2"}},
+		{Mime: "image/png", File: text},
+		{Mime: "text/plain", File: picture},
+		{Mime: "image/png", File: filepath.Join(dir, "missing.png")},
+	}
+	for _, d := range data {
+		got := make(map[string]string)
+		for _, p := range extractMetadata(d.Mime, d.File) {
+			got[p.Name] = p.Value
+		}
+		if len(got) != len(d.Want) {
+			t.Errorf("%s (%s): metadata mismatched! want %v, got %v", d.File, d.Mime, d.Want, got)
+			continue
+		}
+		for k, v := range d.Want {
+			if got[k] != v {
+				t.Errorf("%s (%s): %s mismatched! want %s, got %s", d.File, d.Mime, k, v, got[k])
+			}
+		}
+	}
+}
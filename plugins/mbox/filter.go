@@ -12,12 +12,14 @@ type filterFunc func(mbox.Message) bool
 
 func buildFilter(p predicate) filterFunc {
 	fs := []filterFunc{
-		withFrom(p.From),
-		withTo(p.To),
+		withFromList(p.From, p.senders),
+		withToList(p.To, p.recipients),
 		withSubject(p.Subject),
 		withReply(p.NoReply),
 		withInterval(p.Starts, p.Ends),
+		withWithin(p.Within.Duration),
 		withAttachment(p.Attachment),
+		withHeaders(p.Headers),
 	}
 	return withFilter(fs...)
 }
@@ -33,6 +35,17 @@ func withFilter(funcs ...filterFunc) filterFunc {
 	}
 }
 
+func withAny(funcs ...filterFunc) filterFunc {
+	return func(m mbox.Message) bool {
+		for _, fn := range funcs {
+			if fn(m) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 func withFrom(from string) filterFunc {
 	str, accept := cmpStrings(from)
 	return func(m mbox.Message) bool {
@@ -40,6 +53,42 @@ func withFrom(from string) filterFunc {
 	}
 }
 
+// withFromList accepts the messages whose sender matches one of the entries of
+// list. from is used alone when no list has been loaded.
+func withFromList(from string, list []string) filterFunc {
+	if len(list) == 0 {
+		return withFrom(from)
+	}
+	return withList(list, withFrom)
+}
+
+// withToList accepts the messages having a recipient that matches one of the
+// entries of list. to is used alone when no list has been loaded.
+func withToList(to string, list []string) filterFunc {
+	if len(list) == 0 {
+		return withTo(to)
+	}
+	return withList(list, withTo)
+}
+
+// withList accepts the messages matching one of the entries of list, or all of
+// them if list only has negated entries (starting with !), and none of the
+// negated entries of list.
+func withList(list []string, filter func(string) filterFunc) filterFunc {
+	var allow, deny []filterFunc
+	for _, str := range list {
+		if strings.HasPrefix(str, "!") {
+			deny = append(deny, filter(str))
+		} else {
+			allow = append(allow, filter(str))
+		}
+	}
+	if len(allow) > 0 {
+		deny = append(deny, withAny(allow...))
+	}
+	return withFilter(deny...)
+}
+
 func withTo(to string) filterFunc {
 	if to == "" {
 		return keep
@@ -89,6 +138,44 @@ func withInterval(starts, ends time.Time) filterFunc {
 	}
 }
 
+// withWithin accepts the messages sent during the last d before the filter is
+// created.
+func withWithin(d time.Duration) filterFunc {
+	if d <= 0 {
+		return keep
+	}
+	starts := time.Now().Add(-d).UTC()
+	return func(m mbox.Message) bool {
+		return !m.Date().UTC().Before(starts)
+	}
+}
+
+// withHeaders accepts the messages having all the given headers. A header with
+// a non empty value should also match it as a regular expression.
+func withHeaders(headers map[string]string) filterFunc {
+	if len(headers) == 0 {
+		return keep
+	}
+	fs := make([]filterFunc, 0, len(headers))
+	for k, v := range headers {
+		var (
+			name = k
+			re   *regexp.Regexp
+		)
+		if v != "" {
+			re = regexp.MustCompile(v)
+		}
+		fs = append(fs, func(m mbox.Message) bool {
+			str := m.Get(name)
+			if str == "" {
+				return false
+			}
+			return re == nil || re.MatchString(str)
+		})
+	}
+	return withFilter(fs...)
+}
+
 func withAttachment(attach bool) filterFunc {
 	return func(m mbox.Message) bool {
 		return !attach || m.HasAttachments()
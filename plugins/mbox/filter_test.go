@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/busoc/prospect"
+	"github.com/midbel/mbox"
+)
+
+func TestWithFromList(t *testing.T) {
+	var (
+		alice = "alice@example.com"
+		bob   = "bob@example.com"
+		carol = "carol@example.com"
+	)
+	data := []struct {
+		List []string
+		Want []string
+	}{
+		{List: []string{alice, bob}, Want: []string{alice, bob}},
+		{List: []string{"!" + bob}, Want: []string{alice, carol}},
+		{List: []string{"!" + bob, "!" + carol}, Want: []string{alice}},
+		{List: []string{"~example.com", "!" + bob}, Want: []string{alice, carol}},
+		{List: []string{alice, "!" + alice}},
+	}
+	for _, d := range data {
+		var (
+			accept = withFromList("", d.List)
+			got    []string
+		)
+		for _, from := range []string{alice, bob, carol} {
+			if accept(messageFrom(t, from)) {
+				got = append(got, from)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(d.Want, ",") {
+			t.Errorf("%s: senders mismatched! want %s, got %s", d.List, d.Want, got)
+		}
+	}
+}
+
+func messageFrom(t *testing.T, from string) mbox.Message {
+	t.Helper()
+	str := "From " + from + " Mon Jan  4 10:00:00 2021\nFrom: " + from + "\nTo: receiver@example.com\nSubject: test\n\nbody\n"
+	msg, err := mbox.ReadMessage(bufio.NewReader(strings.NewReader(str)))
+	if err != nil {
+		t.Fatalf("fail to read message: %s", err)
+	}
+	return msg
+}
+
+func TestWithWithin(t *testing.T) {
+	var (
+		now    = time.Now()
+		inside = datedMessage(t, now.Add(-time.Hour))
+		old    = datedMessage(t, now.Add(-48*time.Hour))
+	)
+	data := []struct {
+		Within time.Duration
+		Want   []bool
+	}{
+		{Want: []bool{true, true}},
+		{Within: 24 * time.Hour, Want: []bool{true, false}},
+		{Within: 72 * time.Hour, Want: []bool{true, true}},
+		{Within: time.Minute, Want: []bool{false, false}},
+	}
+	for _, d := range data {
+		h := handler{Predicate: predicate{Within: prospect.Duration{Duration: d.Within}}}
+		for i, msg := range []mbox.Message{inside, old} {
+			if got := h.Accept(msg); got != d.Want[i] {
+				t.Errorf("%s: message #%d: want %t, got %t", d.Within, i+1, d.Want[i], got)
+			}
+		}
+	}
+
+	const config = "[mail.predicate]\nwithin = \"24h\"\n[[mail.file]]\ncontent-type = [\"text/csv\"]\n"
+	m, err := newModule(t, messageText(attachment{Name: "data.csv", Mime: "text/csv", Body: "a,b\n1,2\n"}), "", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Process(); !errors.Is(err, prospect.ErrDone) {
+		t.Errorf("configured within: message of 2021 should be discarded, got %v", err)
+	}
+}
+
+func datedMessage(t *testing.T, when time.Time) mbox.Message {
+	t.Helper()
+	str := "From sender@example.com Mon Jan  4 10:00:00 2021\nFrom: sender@example.com\nDate: " + when.Format(time.RFC1123Z) + "\nSubject: test\n\nbody\n"
+	msg, err := mbox.ReadMessage(bufio.NewReader(strings.NewReader(str)))
+	if err != nil {
+		t.Fatalf("fail to read message: %s", err)
+	}
+	return msg
+}
+
+func TestWithHeaders(t *testing.T) {
+	var msgs []mbox.Message
+	for _, hdr := range []string{
+		"X-Mailer: ops-reporter 1.2\nList-Id: <ops.example.com>\n",
+		"X-Mailer: Thunderbird\n",
+		"",
+	} {
+		str := "From sender@example.com Mon Jan  4 10:00:00 2021\nFrom: sender@example.com\n" + hdr + "Subject: test\n\nbody\n"
+		msg, err := mbox.ReadMessage(bufio.NewReader(strings.NewReader(str)))
+		if err != nil {
+			t.Fatalf("fail to read message: %s", err)
+		}
+		msgs = append(msgs, msg)
+	}
+	data := []struct {
+		Headers map[string]string
+		Want    []bool
+	}{
+		{Want: []bool{true, true, true}},
+		{Headers: map[string]string{"X-Mailer": ""}, Want: []bool{true, true, false}},
+		{Headers: map[string]string{"x-mailer": "^ops-reporter"}, Want: []bool{true, false, false}},
+		{Headers: map[string]string{"X-Mailer": "", "List-Id": "ops"}, Want: []bool{true, false, false}},
+		{Headers: map[string]string{"X-Mailer": "Outlook"}, Want: []bool{false, false, false}},
+		{Headers: map[string]string{"X-Spam-Flag": ""}, Want: []bool{false, false, false}},
+	}
+	for _, d := range data {
+		accept := withHeaders(d.Headers)
+		for i, msg := range msgs {
+			if got := accept(msg); got != d.Want[i] {
+				t.Errorf("%v: message #%d: want %t, got %t", d.Headers, i+1, d.Want[i], got)
+			}
+		}
+	}
+
+	const config = "[mail.predicate.headers]\nX-Mailer = \"^ops\"\n[[mail.file]]\ncontent-type = [\"text/csv\"]\n"
+	input := messageText(attachment{Name: "data.csv", Mime: "text/csv", Body: "a,b\n1,2\n"})
+	for _, str := range []string{input, strings.Replace(input, "Subject: test\n", "X-Mailer: ops-reporter\nSubject: test\n", 1)} {
+		m, err := newModule(t, str, "", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = m.Process()
+		if want := strings.Contains(str, "X-Mailer"); want != (err == nil) {
+			t.Errorf("configured headers: unexpected result %v (header: %t)", err, want)
+		}
+	}
+}
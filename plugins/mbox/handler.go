@@ -2,8 +2,13 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"mime"
+	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/busoc/prospect"
@@ -19,12 +24,116 @@ type predicate struct {
 
 	Starts time.Time `toml:"dtstart"`
 	Ends   time.Time `toml:"dtend"`
+	Within prospect.Duration
+
+	// Headers gives the headers that the messages should have. If a value
+	// is not empty, it is a regular expression that the value of the header
+	// should match.
+	Headers map[string]string `toml:"headers"`
+
+	FromFile string `toml:"from-file"`
+	ToFile   string `toml:"to-file"`
+
+	senders    []string
+	recipients []string
+}
+
+// load reads the lists of senders and recipients given by from-file and
+// to-file. Relative files are taken from dir. The inline from and to are kept
+// in the lists.
+func (p *predicate) load(dir string) error {
+	var err error
+	if p.senders, err = readList(dir, p.FromFile, p.From); err != nil {
+		return fmt.Errorf("from-file: %w", err)
+	}
+	if p.recipients, err = readList(dir, p.ToFile, p.To); err != nil {
+		return fmt.Errorf("to-file: %w", err)
+	}
+	return nil
+}
+
+// readList returns the non empty lines of file that are not comments (lines
+// starting with #) after inline.
+func readList(dir, file, inline string) ([]string, error) {
+	if file == "" {
+		return nil, nil
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(dir, file)
+	}
+	buf, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var list []string
+	if inline != "" {
+		list = append(list, inline)
+	}
+	for _, line := range strings.Split(string(buf), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		list = append(list, line)
+	}
+	return list, nil
 }
 
 type include struct {
 	Types   []string `toml:"content-type"`
 	Pattern string
 	Role    string
+	Rename  prospect.Pattern
+	Type    string
+	Level   level
+	MinSize prospect.Size `toml:"min-size"`
+	From    string
+	Explode bool          `toml:"explode"`
+	Depth   int           `toml:"explode-depth"`
+	Limit   prospect.Size `toml:"explode-limit"`
+}
+
+// level is a level of processing that can be left unset.
+type level struct {
+	Value int
+	IsSet bool
+}
+
+func (v *level) Set(str string) error {
+	n, err := strconv.Atoi(str)
+	if err != nil {
+		return err
+	}
+	v.Value, v.IsSet = n, true
+	return nil
+}
+
+// rename computes the name of the attachment from the rename pattern of the
+// include. The extension of the original file is kept if the pattern gives
+// none.
+func (i include) rename(cfg prospect.Config, msg mbox.Message, mime, file string) string {
+	if i.Rename.Resolver == nil {
+		return file
+	}
+	d := prospect.Data{
+		File:    file,
+		Mime:    mime,
+		Type:    i.Role,
+		Mission: cfg.Mission,
+		Version: cfg.Version,
+		Batch:   cfg.Batch(),
+		AcqTime: msg.Date(),
+		ModTime: msg.Date(),
+		MsgTime: msg.Date(),
+	}
+	str := i.Rename.Resolve(d)
+	if str == "" {
+		return file
+	}
+	if filepath.Ext(str) == "" {
+		str += filepath.Ext(file)
+	}
+	return str
 }
 
 type part struct {
@@ -33,11 +142,25 @@ type part struct {
 }
 
 type item struct {
-	Mime string
-	File string
-	Meta string
-	Role string
+	Mime  string
+	File  string
+	Meta  string
+	Role  string
+	Type  string
+	Level level
+	// Explode is the number of levels of nested zip files to extract. The
+	// part is kept as is if it is zero.
+	Explode int
+	// Limit is the maximum number of bytes extracted from the zip file.
+	Limit int64
+	// MinSize is the size below which the decoded part is discarded once it
+	// has been written.
+	MinSize int64
 	mbox.Part
+
+	size      int64
+	integrity prospect.Integrity
+	err       error
 }
 
 type handler struct {
@@ -45,11 +168,49 @@ type handler struct {
 	Type     string
 	Maildir  string
 	Metadata string
+	Layout   prospect.Pattern
+	Inline   bool `toml:"include-inline"`
 
 	Predicate predicate `toml:"predicate"`
 	Includes  []include `toml:"file"`
 
 	filter filterFunc
+	cfg    prospect.Config
+}
+
+// validate checks that h can select at least one part of a message. Unknown
+// options are already rejected when the configuration is decoded.
+func (h handler) validate() error {
+	if len(h.Includes) == 0 {
+		return fmt.Errorf("no file section defined")
+	}
+	p := h.Predicate
+	if p.Within.Duration != 0 && (!p.Starts.IsZero() || !p.Ends.IsZero()) {
+		return fmt.Errorf("within can not be used with dtstart and dtend")
+	}
+	if p.Within.Duration < 0 {
+		return fmt.Errorf("within should be positive")
+	}
+	for k, v := range p.Headers {
+		if _, err := regexp.Compile(v); err != nil {
+			return fmt.Errorf("header %s: %w", k, err)
+		}
+	}
+	for i, j := range h.Includes {
+		if len(j.Types) == 0 {
+			return fmt.Errorf("file #%d: content-type should be set", i+1)
+		}
+		if _, err := regexp.Compile(j.Pattern); err != nil {
+			return fmt.Errorf("file #%d: %w", i+1, err)
+		}
+		if j.Depth < 0 {
+			return fmt.Errorf("file #%d: explode-depth should be positive", i+1)
+		}
+		if j.Limit < 0 {
+			return fmt.Errorf("file #%d: explode-limit should be positive", i+1)
+		}
+	}
+	return nil
 }
 
 func (h *handler) Accept(msg mbox.Message) bool {
@@ -61,42 +222,165 @@ func (h *handler) Accept(msg mbox.Message) bool {
 
 func (h *handler) items(msg mbox.Message) []item {
 	var (
-		p     = msg.Part(h.Metadata)
-		meta  = p.Text()
-		parts []item
+		p      = msg.Part(h.Metadata)
+		meta   = p.Text()
+		parts  []item
+		seen   = make(map[string]int)
+		used   = make(map[int]bool)
+		chosen = make(map[string]string)
 	)
 	for _, i := range h.Includes {
+		if !withFrom(i.From)(msg) {
+			continue
+		}
 		var (
-			mt string
-			pt mbox.Part
+			mt   string
+			list []int
 		)
 		for _, a := range i.Types {
-			pt, mt = msg.Part(a), a
-			if pt.Len() > 0 {
+			if list, mt = h.parts(msg, a, i.Pattern, used, chosen), a; len(list) > 0 {
 				break
 			}
 		}
-		if pt.Len() == 0 {
+		for _, x := range list {
+			used[x] = true
+
+			pt := msg.Parts[x]
+			file := filename(pt)
+			if file == "" {
+				file = fmt.Sprintf("%s%s.eml", h.Prefix, msg.Date().Format("20060102_150405"))
+			}
+			if i.Rename.Resolver != nil {
+				file = i.rename(h.cfg, msg, mt, file)
+			}
+			dir, err := h.layout(msg, mt, file)
+			if err != nil {
+				h.cfg.Log().Error("attachment skipped", "file", file, "message-id", msg.Get(hdrMessageId), "error", err)
+				continue
+			}
+			file = uniqueName(seen, filepath.Join(h.Maildir, dir, file))
+
+			j := item{
+				Mime:    mt,
+				File:    file,
+				Meta:    string(meta),
+				Part:    pt,
+				Role:    i.Role,
+				Type:    i.Type,
+				Level:   i.Level,
+				MinSize: int64(i.MinSize),
+			}
+			if i.Explode && isZip(mt, file) {
+				if j.Explode = i.Depth; j.Explode == 0 {
+					j.Explode = 1
+				}
+				if j.Limit = int64(i.Limit); j.Limit == 0 {
+					j.Limit = defaultExplodeLimit
+				}
+			}
+			parts = append(parts, j)
+		}
+	}
+	return parts
+}
+
+// filename gives the name of p decoded from its RFC 2047 encoded form. The
+// headers are parsed again since encoded words contain characters that are
+// not expected by mbox. Only the last element of the name is kept so that it
+// can not escape the maildir.
+func filename(p mbox.Part) string {
+	var file string
+	switch dispo, ps, err := mime.ParseMediaType(p.Get(hdrDisposition)); {
+	case err != nil:
+		file = p.Filename()
+	case dispo != "attachment" && dispo != "inline":
+		return ""
+	default:
+		file = ps["filename"]
+		if file != "" {
+			break
+		}
+		if _, ps, err := mime.ParseMediaType(p.Get(hdrType)); err == nil {
+			file = ps["name"]
+		}
+	}
+	var dec mime.WordDecoder
+	if str, err := dec.DecodeHeader(file); err == nil {
+		file = str
+	}
+	file = filepath.Base(strings.ReplaceAll(file, "\\", "/"))
+	if file == "." || file == ".." || file == "/" {
+		file = ""
+	}
+	return file
+}
+
+// parts gives the indexes of the parts of msg having the given content type
+// and a name matching pattern. The parts already used by another include are
+// discarded as well as, unless they are explicitly included, the inline parts
+// (logos, signatures,...) and the representations of a multipart/alternative
+// body other than the first one selected, recorded in chosen.
+func (h *handler) parts(msg mbox.Message, mt, pattern string, used map[int]bool, chosen map[string]string) []int {
+	if mt == "" {
+		return nil
+	}
+	var list []int
+	for x, p := range msg.Parts {
+		if used[x] || p.Len() == 0 || !strings.HasPrefix(p.Get("content-type"), mt) {
+			continue
+		}
+		if !h.Inline && p.IsInline() {
 			continue
 		}
-		match, _ := regexp.MatchString(i.Pattern, pt.Filename())
-		if i.Pattern != "" && !match {
+		if match, _ := regexp.MatchString(pattern, filename(p)); pattern != "" && !match {
 			continue
 		}
-		file := pt.Filename()
-		if file == "" {
-			file = fmt.Sprintf("%s%s.eml", h.Prefix, msg.Date().Format("20060102_150405"))
+		if body, repr := alternativeOf(p); body != "" && !h.Inline {
+			if r, ok := chosen[body]; ok && r != repr {
+				continue
+			}
+			chosen[body] = repr
 		}
-		file = filepath.Join(h.Maildir, file)
+		list = append(list, x)
+	}
+	return list
+}
 
-		j := item{
-			Mime: mt,
-			File: file,
-			Meta: string(meta),
-			Part: pt,
-			Role: i.Role,
+// layout gives the directory, relative to the maildir, where an attachment
+// should be written.
+func (h *handler) layout(msg mbox.Message, mime, file string) (string, error) {
+	if h.Layout.IsEmpty() {
+		return "", nil
+	}
+	d := prospect.Data{
+		File:    file,
+		Mime:    mime,
+		Type:    h.Type,
+		Mission: h.cfg.Mission,
+		Version: h.cfg.Version,
+		Batch:   h.cfg.Batch(),
+		AcqTime: msg.Date(),
+		ModTime: msg.Date(),
+		MsgTime: msg.Date(),
+	}
+	return h.Layout.ResolveErr(d)
+}
+
+// uniqueName appends an index to file when it has already been given to
+// another attachment of the same message or when it already exists.
+func uniqueName(seen map[string]int, file string) string {
+	n, ok := seen[file]
+	seen[file]++
+	if !ok {
+		if _, err := os.Stat(file); err != nil {
+			return file
 		}
-		parts = append(parts, j)
+		n++
 	}
-	return parts
+	var (
+		ext  = filepath.Ext(file)
+		stem = strings.TrimSuffix(file, ext)
+		str  = fmt.Sprintf("%s_%d%s", stem, n, ext)
+	)
+	return uniqueName(seen, str)
 }
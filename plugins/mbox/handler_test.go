@@ -0,0 +1,646 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/busoc/prospect"
+	"github.com/midbel/mbox"
+)
+
+// attachment describes a part of a test message.
+type attachment struct {
+	Name   string
+	Mime   string
+	Body   string
+	Inline bool
+}
+
+// makeMessage builds a multipart message with the given attachments, their
+// body being base64 encoded.
+func makeMessage(t *testing.T, as ...attachment) mbox.Message {
+	t.Helper()
+	msg, err := readMessage(bufio.NewReader(strings.NewReader(messageText(as...))))
+	if err != nil {
+		t.Fatalf("fail to read message: %s", err)
+	}
+	return msg
+}
+
+// messageText gives the message built by makeMessage in the form found in a
+// mbox file.
+func messageText(as ...attachment) string {
+	var buf strings.Builder
+	buf.WriteString("From sender@example.com Mon Jan  4 10:00:00 2021\n")
+	buf.WriteString("From: sender@example.com\n")
+	buf.WriteString("To: receiver@example.com\n")
+	buf.WriteString("Subject: test\n")
+	buf.WriteString("Date: Mon, 04 Jan 2021 10:00:00 +0000\n")
+	buf.WriteString("Message-Id: <1@example.com>\n")
+	buf.WriteString("MIME-Version: 1.0\n")
+	buf.WriteString("Content-Type: multipart/mixed; boundary=\"XXX\"\n")
+	buf.WriteString("\n")
+	for _, a := range as {
+		dispo := "attachment"
+		if a.Inline {
+			dispo = "inline"
+		}
+		buf.WriteString("--XXX\n")
+		buf.WriteString("Content-Type: " + a.Mime + "; name=\"" + a.Name + "\"\n")
+		buf.WriteString("Content-Disposition: " + dispo + "; filename=\"" + a.Name + "\"\n")
+		buf.WriteString("Content-Transfer-Encoding: base64\n")
+		buf.WriteString("\n")
+		buf.WriteString(encodeBase64(a.Body) + "\n")
+	}
+	buf.WriteString("--XXX--\n")
+	return buf.String()
+}
+
+func encodeBase64(str string) string {
+	return base64.StdEncoding.EncodeToString([]byte(str))
+}
+
+func TestHandlerItems(t *testing.T) {
+	msg := makeMessage(t,
+		attachment{Name: "data.csv", Mime: "text/csv", Body: "a,b\n1,2\n"},
+		attachment{Name: "data.csv", Mime: "text/csv", Body: "c,d\n3,4\n"},
+		attachment{Name: "image.png", Mime: "image/png", Body: "png"},
+	)
+	data := []struct {
+		Name     string
+		Includes []include
+		Want     []string
+	}{
+		{
+			Name:     "duplicate names",
+			Includes: []include{{Types: []string{"text/csv"}}},
+			Want:     []string{"data.csv", "data_1.csv"},
+		},
+		{
+			Name: "same type in two includes",
+			Includes: []include{
+				{Types: []string{"text/csv"}},
+				{Types: []string{"text/csv"}},
+			},
+			Want: []string{"data.csv", "data_1.csv"},
+		},
+		{
+			Name: "all types",
+			Includes: []include{
+				{Types: []string{"image/png"}},
+				{Types: []string{"text/csv"}},
+			},
+			Want: []string{"image.png", "data.csv", "data_1.csv"},
+		},
+		{
+			Name:     "first type found",
+			Includes: []include{{Types: []string{"application/pdf", "image/png", "text/csv"}}},
+			Want:     []string{"image.png"},
+		},
+	}
+	for _, d := range data {
+		var (
+			dir = t.TempDir()
+			h   = handler{
+				Maildir:  dir,
+				Includes: d.Includes,
+			}
+			got []string
+		)
+		for _, i := range h.items(msg) {
+			rel, _ := filepath.Rel(dir, i.File)
+			got = append(got, rel)
+		}
+		if strings.Join(got, ",") != strings.Join(d.Want, ",") {
+			t.Errorf("%s: files mismatched! want %s, got %s", d.Name, d.Want, got)
+		}
+	}
+}
+
+func TestProcessMessageDuplicateNames(t *testing.T) {
+	msg := makeMessage(t,
+		attachment{Name: "data.csv", Mime: "text/csv", Body: "a,b\n1,2\n"},
+		attachment{Name: "data.csv", Mime: "text/csv", Body: "c,d\n3,4\n"},
+	)
+	var (
+		dir = t.TempDir()
+		h   = handler{
+			Maildir:  dir,
+			Includes: []include{{Types: []string{"text/csv"}}},
+		}
+		m = module{
+			digest:  prospect.Config{}.NewDigester(),
+			threads: make(threads),
+		}
+	)
+	parts := m.processMessage(h, msg)
+	if len(parts) != 2 {
+		t.Fatalf("expected 2 attachments, got %d", len(parts))
+	}
+	want := map[string]string{
+		filepath.Join(dir, "data.csv"):   "a,b\n1,2\n",
+		filepath.Join(dir, "data_1.csv"): "c,d\n3,4\n",
+	}
+	for _, p := range parts {
+		if p.Err != nil {
+			t.Errorf("%s: unexpected error: %s", p.Info.File, p.Err)
+			continue
+		}
+		body, ok := want[p.Info.File]
+		if !ok {
+			t.Errorf("%s: unexpected file", p.Info.File)
+			continue
+		}
+		buf, err := ioutil.ReadFile(p.Info.File)
+		if err != nil || string(buf) != body {
+			t.Errorf("%s: content mismatched! want %q, got %q (%v)", p.Info.File, body, buf, err)
+		}
+		var links []string
+		for _, k := range p.Info.Links {
+			links = append(links, k.File)
+		}
+		sort.Strings(links)
+		for f := range want {
+			if f == p.Info.File {
+				continue
+			}
+			if x := sort.SearchStrings(links, f); x >= len(links) || links[x] != f {
+				t.Errorf("%s: missing link to %s (%s)", p.Info.File, f, links)
+			}
+		}
+		if sum := sha256.Sum256([]byte(body)); string(p.Info.Integrity.Value) != string(sum[:]) {
+			t.Errorf("%s: digest mismatched", p.Info.File)
+		}
+	}
+}
+
+func TestProcessMessageHashPrefix(t *testing.T) {
+	data := []struct {
+		Body    string
+		Partial bool
+	}{
+		{Body: "short"},
+		{Body: "exactly."},
+		{Body: "longer than the prefix", Partial: true},
+	}
+	for _, d := range data {
+		var (
+			cfg = prospect.Config{HashPrefix: 8}
+			msg = makeMessage(t, attachment{Name: "data.csv", Mime: "text/csv", Body: d.Body})
+			h   = handler{
+				Maildir:  t.TempDir(),
+				Includes: []include{{Types: []string{"text/csv"}}},
+			}
+			m = module{
+				cfg:     cfg,
+				digest:  cfg.NewDigester(),
+				threads: make(threads),
+			}
+		)
+		parts := m.processMessage(h, msg)
+		if len(parts) != 1 || parts[0].Err != nil {
+			t.Errorf("%q: expected 1 attachment without error, got %+v", d.Body, parts)
+			continue
+		}
+		info := parts[0].Info
+		if info.Integrity.IsPartial() != d.Partial {
+			t.Errorf("%q: partial mismatched! want %t, got %t", d.Body, d.Partial, info.Integrity.IsPartial())
+		}
+		if info.Size != int64(len(d.Body)) {
+			t.Errorf("%q: size mismatched! want %d, got %d", d.Body, len(d.Body), info.Size)
+		}
+		want, _ := cfg.Digest(strings.NewReader(d.Body))
+		if info.Integrity.String() != want.String() {
+			t.Errorf("%q: digest mismatched! want %s, got %s", d.Body, want, info.Integrity)
+		}
+	}
+}
+
+func TestReceivedDate(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip(err)
+	}
+	data := []struct {
+		Received string
+		Zone     *time.Location
+		Want     time.Time
+	}{
+		{
+			Received: "from mx.example.com; Mon, 04 Jan 2021 10:00:00 +0100",
+			Zone:     tokyo,
+			Want:     time.Date(2021, 1, 4, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			Received: "from mx.example.com; Mon, 4 Jan 2021 10:00:00 +0100 (CET)",
+			Want:     time.Date(2021, 1, 4, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			Received: "from mx.example.com; Mon, 04 Jan 2021 02:00:00",
+			Zone:     tokyo,
+			Want:     time.Date(2021, 1, 3, 17, 0, 0, 0, time.UTC),
+		},
+		{
+			Received: "from mx.example.com",
+		},
+	}
+	for _, d := range data {
+		str := "From sender@example.com Mon Jan  4 10:00:00 2021\nReceived: " + d.Received + "\nSubject: test\n\nbody\n"
+		msg, err := mbox.ReadMessage(bufio.NewReader(strings.NewReader(str)))
+		if err != nil {
+			t.Fatalf("fail to read message: %s", err)
+		}
+		m := module{cfg: prospect.Config{Timezone: prospect.Location{Location: d.Zone}}}
+		if got := m.receivedDate(msg); !got.Equal(d.Want) {
+			t.Errorf("%s: times mismatched! want %s, got %s", d.Received, d.Want, got)
+		}
+	}
+}
+
+func TestProcessMessageMinSize(t *testing.T) {
+	msg := makeMessage(t,
+		attachment{Name: "keep.csv", Mime: "text/csv", Body: "a,b\n1,2\n"},
+		attachment{Name: "small.csv", Mime: "text/csv", Body: "a\n"},
+		attachment{Name: "other.csv", Mime: "text/csv", Body: "a,b,c,d,e,f\n"},
+	)
+	data := []struct {
+		Name    string
+		Include include
+		Want    []string
+	}{
+		{
+			Name:    "no minimum",
+			Include: include{Types: []string{"text/csv"}},
+			Want:    []string{"keep.csv", "small.csv", "other.csv"},
+		},
+		{
+			Name:    "minimum",
+			Include: include{Types: []string{"text/csv"}, MinSize: 5},
+			Want:    []string{"keep.csv", "other.csv"},
+		},
+		{
+			Name:    "minimum and pattern",
+			Include: include{Types: []string{"text/csv"}, Pattern: "^(keep|small)", MinSize: 5},
+			Want:    []string{"keep.csv"},
+		},
+	}
+	for _, d := range data {
+		var (
+			dir = t.TempDir()
+			h   = handler{
+				Maildir:  dir,
+				Includes: []include{d.Include},
+			}
+			m = module{
+				digest:  prospect.Config{}.NewDigester(),
+				threads: make(threads),
+			}
+			got []string
+		)
+		for _, p := range m.processMessage(h, msg) {
+			if p.Err != nil {
+				t.Errorf("%s: %s: unexpected error: %s", d.Name, p.Info.File, p.Err)
+			}
+			got = append(got, filepath.Base(p.Info.File))
+			for _, k := range p.Info.Links {
+				if _, err := os.Stat(k.File); err != nil {
+					t.Errorf("%s: %s: link to a file not written: %s", d.Name, p.Info.File, k.File)
+				}
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(d.Want, ",") {
+			t.Errorf("%s: files mismatched! want %s, got %s", d.Name, d.Want, got)
+		}
+		files, _ := filepath.Glob(filepath.Join(dir, "*"))
+		if len(files) != len(d.Want) {
+			t.Errorf("%s: files written mismatched! want %d, got %d (%s)", d.Name, len(d.Want), len(files), files)
+		}
+	}
+}
+
+func TestIncludeRename(t *testing.T) {
+	msg := makeMessage(t, attachment{Name: "photo.jpg", Mime: "image/jpeg", Body: "jpg"})
+	data := []struct {
+		Rename string
+		Role   string
+		Want   string
+	}{
+		{Want: "photo.jpg"},
+		{Rename: "{type}_{year}{doy}", Role: "image", Want: "Image_2021004.jpg"},
+		{Rename: "{mime}_{year}.dat", Want: "Jpeg_2021.dat"},
+		{Rename: "{meta:run?}", Want: "photo.jpg"},
+	}
+	for _, d := range data {
+		i := include{
+			Types: []string{"image/jpeg"},
+			Role:  d.Role,
+		}
+		if d.Rename != "" {
+			p, err := prospect.NewPattern(d.Rename)
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", d.Rename, err)
+				continue
+			}
+			i.Rename = p
+		}
+		var (
+			dir = t.TempDir()
+			h   = handler{
+				Maildir:  dir,
+				Includes: []include{i},
+			}
+			got []string
+		)
+		for _, j := range h.items(msg) {
+			rel, _ := filepath.Rel(dir, j.File)
+			got = append(got, rel)
+		}
+		if len(got) != 1 || got[0] != d.Want {
+			t.Errorf("%s: files mismatched! want %s, got %s", d.Rename, d.Want, got)
+		}
+	}
+
+	const config = "[[mail.file]]\ncontent-type = [\"image/jpeg\"]\nrename = \"{year}_{doy}\"\n"
+	m, err := newModule(t, messageText(attachment{Name: "photo.jpg", Mime: "image/jpeg", Body: "jpg"}), "", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := m.Process()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := filepath.Base(i.File); got != "2021_004.jpg" {
+		t.Errorf("configured rename: files mismatched! want 2021_004.jpg, got %s", got)
+	}
+}
+
+func TestHandlerLayout(t *testing.T) {
+	msg := makeMessage(t,
+		attachment{Name: "data.csv", Mime: "text/csv", Body: "a,b\n1,2\n"},
+		attachment{Name: "image.png", Mime: "image/png", Body: "png"},
+	)
+	data := []struct {
+		Layout string
+		Want   []string
+	}{
+		{Want: []string{"data.csv", "image.png"}},
+		{Layout: "{year}/{doy}", Want: []string{"2021/004/data.csv", "2021/004/image.png"}},
+		{Layout: "{mime}", Want: []string{"Csv/data.csv", "Png/image.png"}},
+		{Layout: "{msgdate:year}_{msgdate:month}", Want: []string{"2021_01/data.csv", "2021_01/image.png"}},
+		{Layout: "{year}/{meta:run}", Want: nil},
+	}
+	for _, d := range data {
+		var (
+			dir = t.TempDir()
+			h   = handler{
+				Maildir: dir,
+				Includes: []include{
+					{Types: []string{"text/csv"}},
+					{Types: []string{"image/png"}},
+				},
+			}
+			got []string
+		)
+		if d.Layout != "" {
+			p, err := prospect.NewPattern(d.Layout)
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", d.Layout, err)
+				continue
+			}
+			h.Layout = p
+		}
+		for _, i := range h.items(msg) {
+			rel, _ := filepath.Rel(dir, i.File)
+			got = append(got, filepath.ToSlash(rel))
+		}
+		if strings.Join(got, ",") != strings.Join(d.Want, ",") {
+			t.Errorf("%s: files mismatched! want %s, got %s", d.Layout, d.Want, got)
+		}
+	}
+
+	const config = "layout = \"{year}/{doy}\"\n[[mail.file]]\ncontent-type = [\"text/csv\"]\n"
+	m, err := newModule(t, messageText(attachment{Name: "data.csv", Mime: "text/csv", Body: "a,b\n1,2\n"}), "keep-files = true", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := m.Process()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join("2021", "004", "data.csv"); !strings.HasSuffix(i.File, want) {
+		t.Errorf("configured layout: files mismatched! want %s, got %s", want, i.File)
+	}
+	if _, err := os.Stat(i.File); err != nil {
+		t.Errorf("configured layout: file not written: %s", err)
+	}
+}
+
+func TestHandlerInline(t *testing.T) {
+	msg := makeMessage(t,
+		attachment{Name: "logo.png", Mime: "image/png", Body: "logo", Inline: true},
+		attachment{Name: "report.pdf", Mime: "application/pdf", Body: "pdf"},
+		attachment{Name: "chart.png", Mime: "image/png", Body: "chart"},
+	)
+	data := []struct {
+		Inline bool
+		Want   []string
+	}{
+		{Want: []string{"chart.png", "report.pdf"}},
+		{Inline: true, Want: []string{"logo.png", "chart.png", "report.pdf"}},
+	}
+	for _, d := range data {
+		var (
+			dir = t.TempDir()
+			h   = handler{
+				Maildir: dir,
+				Inline:  d.Inline,
+				Includes: []include{
+					{Types: []string{"image/png"}},
+					{Types: []string{"application/pdf"}},
+				},
+			}
+			got []string
+		)
+		for _, i := range h.items(msg) {
+			got = append(got, filepath.Base(i.File))
+		}
+		if strings.Join(got, ",") != strings.Join(d.Want, ",") {
+			t.Errorf("inline %t: files mismatched! want %s, got %s", d.Inline, d.Want, got)
+		}
+	}
+
+	var (
+		input = messageText(
+			attachment{Name: "logo.png", Mime: "image/png", Body: "logo", Inline: true},
+			attachment{Name: "chart.png", Mime: "image/png", Body: "chart"},
+		)
+		config = "include-inline = true\n[[mail.file]]\ncontent-type = [\"image/png\"]\n"
+	)
+	m, err := newModule(t, input, "", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.queue) != 2 {
+		t.Errorf("configured include-inline: expected 2 files, got %d", len(m.queue))
+	}
+}
+
+func TestFilename(t *testing.T) {
+	data := []struct {
+		Disposition string
+		Type        string
+		Want        string
+	}{
+		{Disposition: "attachment; filename=\"data.csv\"", Want: "data.csv"},
+		{Disposition: "attachment; filename=\"=?UTF-8?Q?donn=C3=A9es.csv?=\"", Want: "données.csv"},
+		{Disposition: "attachment; filename=\"=?UTF-8?B?ZG9ubsOpZXMuY3N2?=\"", Want: "données.csv"},
+		{Disposition: "inline; filename=\"logo.png\"", Want: "logo.png"},
+		{Disposition: "attachment", Type: "text/csv; name=\"=?ISO-8859-1?Q?r=E9sum=E9.csv?=\"", Want: "résumé.csv"},
+		{Disposition: "attachment; filename=\"../../etc/passwd\"", Want: "passwd"},
+		{Disposition: "attachment; filename=\"C:\\\\temp\\\\data.csv\"", Want: "data.csv"},
+		{Disposition: "attachment; filename=\"..\"", Want: ""},
+		{Disposition: "form-data; name=\"data\"", Want: ""},
+	}
+	for _, d := range data {
+		p := mbox.Part{Header: make(mbox.Header)}
+		p.Set(hdrDisposition, d.Disposition)
+		if d.Type != "" {
+			p.Set(hdrType, d.Type)
+		}
+		if got := filename(p); got != d.Want {
+			t.Errorf("%s: names mismatched! want %q, got %q", d.Disposition, d.Want, got)
+		}
+	}
+
+	msg := makeMessage(t,
+		attachment{Name: "=?UTF-8?Q?donn=C3=A9es.csv?=", Mime: "text/csv", Body: "a,b\n1,2\n"},
+		attachment{Name: "=?UTF-8?Q?r=C3=A9sum=C3=A9.csv?=", Mime: "text/csv", Body: "c,d\n3,4\n"},
+	)
+	var (
+		dir = t.TempDir()
+		h   = handler{
+			Maildir:  dir,
+			Includes: []include{{Types: []string{"text/csv"}, Pattern: "^donnée"}},
+		}
+		got []string
+	)
+	for _, i := range h.items(msg) {
+		got = append(got, filepath.Base(i.File))
+	}
+	if len(got) != 1 || got[0] != "données.csv" {
+		t.Errorf("files mismatched! want données.csv, got %s", got)
+	}
+}
+
+func TestHandlerValidate(t *testing.T) {
+	var (
+		csv  = include{Types: []string{"text/csv"}}
+		hour = prospect.Duration{Duration: time.Hour}
+	)
+	data := []struct {
+		Name    string
+		Handler handler
+		Invalid bool
+	}{
+		{
+			Name:    "valid",
+			Handler: handler{Includes: []include{csv}},
+		},
+		{
+			Name:    "within",
+			Handler: handler{Includes: []include{csv}, Predicate: predicate{Within: hour}},
+		},
+		{
+			Name:    "no file section",
+			Handler: handler{},
+			Invalid: true,
+		},
+		{
+			Name:    "within and dtstart",
+			Handler: handler{Includes: []include{csv}, Predicate: predicate{Within: hour, Starts: time.Now()}},
+			Invalid: true,
+		},
+		{
+			Name:    "negative within",
+			Handler: handler{Includes: []include{csv}, Predicate: predicate{Within: prospect.Duration{Duration: -time.Hour}}},
+			Invalid: true,
+		},
+		{
+			Name:    "invalid header",
+			Handler: handler{Includes: []include{csv}, Predicate: predicate{Headers: map[string]string{"X-Mailer": "("}}},
+			Invalid: true,
+		},
+		{
+			Name:    "no content type",
+			Handler: handler{Includes: []include{csv, {Pattern: "csv$"}}},
+			Invalid: true,
+		},
+		{
+			Name:    "invalid pattern",
+			Handler: handler{Includes: []include{{Types: csv.Types, Pattern: "["}}},
+			Invalid: true,
+		},
+		{
+			Name:    "negative depth",
+			Handler: handler{Includes: []include{{Types: csv.Types, Depth: -1}}},
+			Invalid: true,
+		},
+		{
+			Name:    "negative limit",
+			Handler: handler{Includes: []include{{Types: csv.Types, Limit: -1}}},
+			Invalid: true,
+		},
+	}
+	for _, d := range data {
+		err := d.Handler.validate()
+		if d.Invalid != (err != nil) {
+			t.Errorf("%s: unexpected result: %v", d.Name, err)
+		}
+	}
+}
+
+func TestIncludeFrom(t *testing.T) {
+	var (
+		ops   = messageText(attachment{Name: "ops.csv", Mime: "text/csv", Body: "a,b\n1,2\n"})
+		other = messageText(attachment{Name: "other.csv", Mime: "text/csv", Body: "c,d\n3,4\n"})
+	)
+	ops = strings.Replace(ops, "From: sender@example.com", "From: ops@example.com", 1)
+	data := []struct {
+		From string
+		Want []string
+	}{
+		{Want: []string{"ops.csv", "other.csv"}},
+		{From: "ops@example.com", Want: []string{"ops.csv"}},
+		{From: "!ops@example.com", Want: []string{"other.csv"}},
+		{From: "~example.com", Want: []string{"ops.csv", "other.csv"}},
+		{From: "admin@example.com"},
+	}
+	for _, d := range data {
+		config := fmt.Sprintf("[[mail.file]]\ncontent-type = [\"text/csv\"]\nfrom = %q\n", d.From)
+		m, err := newModule(t, ops+other, "keep-files = true", config)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.From, err)
+			continue
+		}
+		var got []string
+		for {
+			i, err := m.Process()
+			if err != nil {
+				break
+			}
+			got = append(got, filepath.Base(i.File))
+		}
+		if strings.Join(got, ",") != strings.Join(d.Want, ",") {
+			t.Errorf("%s: files mismatched! want %s, got %s", d.From, d.Want, got)
+		}
+	}
+}
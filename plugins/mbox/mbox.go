@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"errors"
 	"fmt"
-	"hash"
 	"io"
+	"mime/quotedprintable"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/busoc/prospect"
 	"github.com/midbel/mbox"
@@ -17,25 +23,102 @@ const (
 	mailDesc    = "mail.description"
 )
 
+const (
+	dateSkip     = "skip"
+	dateReceived = "received"
+	dateDefault  = "default"
+
+	reasonNoDate   = "missing date"
+	reasonTooSmall = "too small"
+)
+
+const (
+	orderMessage = "message"
+	orderName    = "filename"
+	orderSize    = "size"
+)
+
+const (
+	hdrDate        = "Date"
+	hdrReceived    = "Received"
+	hdrEncoding    = "Content-Transfer-Encoding"
+	hdrType        = "Content-Type"
+	hdrDisposition = "Content-Disposition"
+	encBase64      = "base64"
+	encQuoted      = "quoted-printable"
+)
+
 type module struct {
 	cfg prospect.Config
 
 	inner  *reader
-	digest hash.Hash
+	digest *prospect.Digester
 
 	keep     bool
+	extract  bool
+	order    string
 	handlers []handler
-	queue    <-chan part
+	queue    []part
+	clean    string
+
+	missing string
+	dtdef   time.Time
+	undated int
+
+	linked  bool
+	threads threads
+
+	progress func(done, total int64)
+}
+
+func init() {
+	prospect.Register("mail", New)
 }
 
 func New(cfg prospect.Config) (prospect.Module, error) {
 	c := struct {
 		Keep     bool      `toml:"keep-files"`
+		Extract  bool      `toml:"extract-metadata"`
+		Missing  string    `toml:"missing-date"`
+		Default  time.Time `toml:"default-date"`
+		Linked   bool      `toml:"link-threads"`
+		Order    string    `toml:"attachment-order"`
 		Handlers []handler `toml:"mail"`
 	}{}
 	if err := toml.DecodeFile(cfg.Config, &c); err != nil {
 		return nil, err
 	}
+	switch c.Missing = strings.ToLower(c.Missing); c.Missing {
+	case "":
+		c.Missing = dateSkip
+	case dateSkip, dateReceived:
+	case dateDefault:
+		if c.Default.IsZero() {
+			return nil, fmt.Errorf("default-date should be set")
+		}
+	default:
+		return nil, fmt.Errorf("%s: unsupported value for missing-date", c.Missing)
+	}
+
+	if len(c.Handlers) == 0 {
+		return nil, fmt.Errorf("no mail section defined")
+	}
+	for i, h := range c.Handlers {
+		if err := h.validate(); err != nil {
+			return nil, fmt.Errorf("mail #%d: %w", i+1, err)
+		}
+		if err := c.Handlers[i].Predicate.load(filepath.Dir(cfg.Config)); err != nil {
+			return nil, fmt.Errorf("mail #%d: %w", i+1, err)
+		}
+		c.Handlers[i].cfg = cfg
+	}
+	switch c.Order = strings.ToLower(c.Order); c.Order {
+	case "":
+		c.Order = orderMessage
+	case orderMessage, orderName, orderSize:
+	default:
+		return nil, fmt.Errorf("%s: unsupported value for attachment-order", c.Order)
+	}
 
 	inner, err := readMessages(cfg.Location)
 	if err != nil {
@@ -45,11 +128,22 @@ func New(cfg prospect.Config) (prospect.Module, error) {
 	m := module{
 		inner:    inner,
 		cfg:      cfg,
-		digest:   cfg.Hash(),
+		digest:   cfg.NewDigester(),
 		handlers: c.Handlers,
 		keep:     c.Keep,
+		extract:  c.Extract,
+		order:    c.Order,
+		missing:  c.Missing,
+		dtdef:    c.Default,
+		linked:   c.Linked,
+		threads:  make(threads),
 	}
-	return &m, m.nextMessage()
+	// no message selected is not an error: Process reports it with ErrDone
+	err = m.nextMessage()
+	if err != nil && !errors.Is(err, prospect.ErrSkip) && !errors.Is(err, prospect.ErrDone) {
+		return nil, err
+	}
+	return &m, nil
 }
 
 func (m *module) String() string {
@@ -60,27 +154,64 @@ func (m module) Indexable() bool {
 	return true
 }
 
+// SetProgress registers fn to be called with the number of bytes read and
+// the size of the input every time a message is read.
+func (m *module) SetProgress(fn func(done, total int64)) {
+	m.progress = fn
+}
+
 func (m *module) Process() (prospect.FileInfo, error) {
-	p, ok := <-m.queue
-	if !ok {
-		err := m.nextMessage()
-		if err != nil {
+	for len(m.queue) == 0 {
+		if err := m.nextMessage(); err != nil {
 			return prospect.FileInfo{}, err
 		}
-		return m.Process()
 	}
-	if p.Info.Type == "" {
-		p.Info.Type = m.cfg.Type
+	p := m.queue[0]
+	m.queue = m.queue[1:]
+	return m.update(p.Info), p.Err
+}
+
+// ProcessBatch returns all the attachments of the next message at once. The
+// first error found while writing the attachments is returned with the
+// attachments written successfully.
+func (m *module) ProcessBatch() ([]prospect.FileInfo, error) {
+	for len(m.queue) == 0 {
+		if err := m.nextMessage(); err != nil {
+			return nil, err
+		}
+	}
+	var (
+		infos = make([]prospect.FileInfo, 0, len(m.queue))
+		err   error
+	)
+	for _, p := range m.queue {
+		if p.Err != nil {
+			if err == nil {
+				err = p.Err
+			}
+			continue
+		}
+		infos = append(infos, m.update(p.Info))
+	}
+	m.queue = m.queue[:0]
+	return infos, err
+}
+
+func (m *module) update(info prospect.FileInfo) prospect.FileInfo {
+	if info.Type == "" {
+		info.Type = m.cfg.Type
 	}
-	if p.Info.Type == "" {
-		p.Info.Type = prospect.TypeData
+	if info.Type == "" {
+		info.Type = prospect.TypeData
 	}
-	p.Info.Integrity = m.cfg.Integrity
-	p.Info.Level = m.cfg.Level
-	return p.Info, p.Err
+	return info
 }
 
 func (m *module) nextMessage() error {
+	if m.clean != "" {
+		os.RemoveAll(m.clean)
+		m.clean = ""
+	}
 	var (
 		msg  mbox.Message
 		hdl  handler
@@ -89,12 +220,21 @@ func (m *module) nextMessage() error {
 	)
 	for !done {
 		msg, err = m.inner.nextMessage()
+		if err != nil && err != io.EOF {
+			m.cfg.Log().Error("message not read", "error", err)
+		}
+		if m.progress != nil {
+			m.progress(m.inner.progress())
+		}
 		if err == io.EOF {
 			err = prospect.ErrDone
 		}
 		if err != nil {
 			break
 		}
+		if err = m.checkDate(msg); err != nil {
+			break
+		}
 		for _, hdl = range m.handlers {
 			if done = hdl.Accept(msg); done {
 				break
@@ -103,69 +243,184 @@ func (m *module) nextMessage() error {
 	}
 	if err == nil {
 		m.queue = m.processMessage(hdl, msg)
+		if !m.keep {
+			m.clean = hdl.Maildir
+		}
 	}
 	return err
 }
 
-func (m *module) processMessage(hdl handler, msg mbox.Message) <-chan part {
-	queue := make(chan part)
-	go func() {
-		defer func() {
-			close(queue)
-			if !m.keep {
-				os.RemoveAll(hdl.Maildir)
-			}
-		}()
-		parts := hdl.items(msg)
-		for _, pt := range parts {
-			info := prospect.FileInfo{
-				File:    pt.File,
-				Type:    hdl.Type,
-				Mime:    pt.Mime,
-				AcqTime: msg.Date(),
-				ModTime: msg.Date(),
-			}
-			info.Parameters = []prospect.Parameter{
-				prospect.MakeParameter(mailSubject, msg.Subject()),
-				prospect.MakeParameter(prospect.FileSize, fmt.Sprintf("%d", pt.Len())),
-			}
-			for _, p := range parts {
-				if p.File == pt.File {
-					continue
-				}
-				k := prospect.Link{
-					File: filepath.Join(hdl.Maildir, p.File),
-					Role: p.Role,
-				}
-				info.Links = append(info.Links, k)
-			}
-			if len(pt.Meta) > 0 {
-				info.Parameters = append(info.Parameters, prospect.MakeParameter(mailDesc, pt.Meta))
-			}
-			err := os.MkdirAll(hdl.Maildir, 0755)
-			if err == nil {
-				err = m.writeFile(pt.File, pt.Part)
-				info.Sum = fmt.Sprintf("%x", m.digest.Sum(nil))
+// checkDate gives a date to the messages without a Date header according to
+// the missing-date option or skips them.
+func (m *module) checkDate(msg mbox.Message) error {
+	if !msg.Date().IsZero() {
+		return nil
+	}
+	var when time.Time
+	switch m.missing {
+	case dateReceived:
+		when = m.receivedDate(msg)
+	case dateDefault:
+		when = m.dtdef
+	}
+	if when.IsZero() {
+		m.undated++
+		m.cfg.Log().Warn("message skipped", "reason", reasonNoDate, "message-id", msg.Get(hdrMessageId), "subject", msg.Subject())
+		return prospect.Skip(reasonNoDate)
+	}
+	msg.Set(hdrDate, when.Format(time.RFC1123Z))
+	return nil
+}
+
+// receivedDate gives the date found after the last semicolon of the Received
+// header.
+func (m *module) receivedDate(msg mbox.Message) time.Time {
+	var (
+		str = msg.Get(hdrReceived)
+		ix  = strings.LastIndexByte(str, ';')
+	)
+	if ix < 0 {
+		return time.Time{}
+	}
+	str = strings.TrimSpace(str[ix+1:])
+	when, err := m.cfg.ParseTimeAny(str, time.RFC1123Z, "Mon, _2 Jan 2006 15:04:05 -0700 (MST)", "Mon, _2 Jan 2006 15:04:05")
+	if err != nil {
+		return time.Time{}
+	}
+	return when
+}
+
+func (m *module) processMessage(hdl handler, msg mbox.Message) []part {
+	var (
+		parts = m.writeItems(msg, sortItems(hdl.items(msg), m.order))
+		queue = make([]part, 0, len(parts))
+		refs  []prospect.Link
+	)
+	if m.linked {
+		refs = m.threads.links(msg)
+		defer m.threads.register(msg, parts)
+	}
+	for _, pt := range parts {
+		info := prospect.FileInfo{
+			File:    pt.File,
+			Type:    hdl.Type,
+			Mime:    pt.Mime,
+			Level:   m.cfg.Level,
+			AcqTime: msg.Date(),
+			ModTime: msg.Date(),
+			MsgTime: msg.Date(),
+		}
+		if pt.Type != "" {
+			info.Type = pt.Type
+		}
+		if pt.Level.IsSet {
+			info.Level = pt.Level.Value
+		}
+		info.Parameters = []prospect.Parameter{
+			prospect.MakeParameter(mailSubject, msg.Subject()),
+		}
+		info.Parameters = append(info.Parameters, threadParameters(msg)...)
+		info.Links = append(info.Links, refs...)
+		for _, p := range parts {
+			if p.File == pt.File {
+				continue
 			}
-			queue <- part{
-				Info: info,
-				Err:  err,
+			k := prospect.Link{
+				File: p.File,
+				Role: p.Role,
 			}
-			m.digest.Reset()
+			info.Links = append(info.Links, k)
+		}
+		if len(pt.Meta) > 0 {
+			info.Parameters = append(info.Parameters, prospect.MakeParameter(mailDesc, pt.Meta))
+		}
+		err := pt.err
+		if err == nil && pt.Explode > 0 {
+			limit := pt.Limit
+			queue = append(queue, m.explode(info, pt.File, "", pt.Explode, &limit)...)
+			continue
 		}
-	}()
+		if err == nil {
+			info.Size = pt.size
+			info.Integrity = pt.integrity
+			info.Parameters = append(info.Parameters, prospect.MakeParameter(prospect.FileSize, info.Size))
+		}
+		if err == nil && m.extract {
+			ps := extractMetadata(pt.Mime, pt.File)
+			info.Parameters = append(info.Parameters, ps...)
+		}
+		queue = append(queue, part{
+			Info: info,
+			Err:  err,
+		})
+	}
 	return queue
 }
 
-func (m *module) writeFile(file string, p mbox.Part) error {
+// writeItems writes the attachments of msg to their files. The attachments
+// smaller than their minimum size, known once they are decoded, are removed.
+// The attachments that can not be written are kept with their error.
+func (m *module) writeItems(msg mbox.Message, items []item) []item {
+	list := items[:0]
+	for _, pt := range items {
+		pt.err = os.MkdirAll(filepath.Dir(pt.File), 0755)
+		if pt.err == nil {
+			pt.size, pt.err = m.writeFile(pt.File, pt.Part)
+			pt.integrity = m.digest.Integrity()
+		}
+		m.digest.Reset()
+		if pt.err != nil {
+			m.cfg.Log().Error("attachment not written", "file", pt.File, "message-id", msg.Get(hdrMessageId), "error", pt.err)
+		} else if pt.MinSize > 0 && pt.size < pt.MinSize {
+			m.cfg.Log().Info("attachment skipped", "reason", reasonTooSmall, "file", pt.File, "message-id", msg.Get(hdrMessageId))
+			os.Remove(pt.File)
+			continue
+		}
+		list = append(list, pt)
+	}
+	return list
+}
+
+// sortItems orders the attachments of a message so that they, and the links
+// between them, are always given in the same order.
+func sortItems(items []item, order string) []item {
+	var less func(i, j int) bool
+	switch order {
+	case orderName:
+		less = func(i, j int) bool {
+			return filepath.Base(items[i].File) < filepath.Base(items[j].File)
+		}
+	case orderSize:
+		less = func(i, j int) bool {
+			return items[i].Len() < items[j].Len()
+		}
+	default:
+		return items
+	}
+	sort.SliceStable(items, less)
+	return items
+}
 
+// writeFile decodes the body of p while writing it to file and to the digest.
+// The raw body of p is already in memory but no decoded copy of it is made.
+func (m *module) writeFile(file string, p mbox.Part) (int64, error) {
 	w, err := os.Create(file)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer w.Close()
 
-	ws := io.MultiWriter(w, m.digest)
-	_, err = ws.Write(p.Bytes())
-	return err
+	return io.Copy(io.MultiWriter(w, m.digest), decodePart(p))
+}
+
+func decodePart(p mbox.Part) io.Reader {
+	r := bytes.NewReader(p.Body)
+	switch strings.ToLower(p.Get(hdrEncoding)) {
+	case encBase64:
+		return base64.NewDecoder(base64.StdEncoding, r)
+	case encQuoted:
+		return quotedprintable.NewReader(r)
+	default:
+		return r
+	}
 }
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/busoc/prospect"
+	"github.com/midbel/mbox"
+)
+
+func TestWriteFile(t *testing.T) {
+	content := strings.Repeat("a,b,c\n1,2,3\n", 1000)
+	data := []struct {
+		Encoding string
+		Body     string
+		Want     string
+	}{
+		{Encoding: "base64", Body: encodeBase64(content), Want: content},
+		{Encoding: "BASE64", Body: encodeBase64("x"), Want: "x"},
+		{Encoding: "quoted-printable", Body: "caf=C3=A9 =\r\ncr=C3=A8me", Want: "café crème"},
+		{Encoding: "7bit", Body: "plain text", Want: "plain text"},
+		{Body: "plain text", Want: "plain text"},
+	}
+	for _, d := range data {
+		var (
+			cfg  = prospect.Config{Encoding: prospect.EncodingBase64}
+			m    = module{cfg: cfg, digest: cfg.NewDigester()}
+			file = filepath.Join(t.TempDir(), "file.csv")
+			p    = mbox.Part{Header: make(mbox.Header), Body: []byte(d.Body)}
+		)
+		if d.Encoding != "" {
+			p.Set(hdrEncoding, d.Encoding)
+		}
+		n, err := m.writeFile(file, p)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Encoding, err)
+			continue
+		}
+		if n != int64(len(d.Want)) {
+			t.Errorf("%s: size mismatched! want %d, got %d", d.Encoding, len(d.Want), n)
+		}
+		buf, _ := ioutil.ReadFile(file)
+		if string(buf) != d.Want {
+			t.Errorf("%s: content mismatched! want %q, got %q", d.Encoding, d.Want, buf)
+		}
+		want, _ := cfg.Digest(strings.NewReader(d.Want))
+		if got := m.digest.Integrity(); got.String() != want.String() {
+			t.Errorf("%s: digest mismatched! want %s, got %s", d.Encoding, want, got)
+		}
+	}
+	m := module{digest: prospect.Config{}.NewDigester()}
+	if _, err := m.writeFile(filepath.Join(t.TempDir(), "missing", "file.csv"), mbox.Part{}); err == nil {
+		t.Errorf("writing to a missing directory should fail")
+	}
+}
+
+// newModule creates a mail module reading the given mbox. options are the top
+// level options of the configuration and mail the options of its only mail
+// section whose maildir is created by newModule.
+func newModule(t *testing.T, mbox, options, mail string) (*module, error) {
+	t.Helper()
+	var (
+		dir    = t.TempDir()
+		file   = filepath.Join(dir, "mail.mbox")
+		config = filepath.Join(dir, "config.toml")
+		buf    strings.Builder
+	)
+	if err := ioutil.WriteFile(file, []byte(mbox), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(&buf, "%s\n[[mail]]\nmaildir = %q\n%s\n", options, filepath.Join(dir, "maildir"), mail)
+	if err := ioutil.WriteFile(config, []byte(buf.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(prospect.Config{Config: config, Location: file})
+	if err != nil {
+		return nil, err
+	}
+	return m.(*module), nil
+}
+
+func TestSetProgress(t *testing.T) {
+	const csv = "[[mail.file]]\ncontent-type = [\"text/csv\"]\n"
+	var (
+		msg   = messageText(attachment{Name: "data.csv", Mime: "text/csv", Body: "a,b\n1,2\n"})
+		input = strings.Repeat(msg, 3)
+	)
+	m, err := newModule(t, input, "keep-files = true", csv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := prospect.Module(m).(prospect.ProgressModule); !ok {
+		t.Fatalf("mail module should be a ProgressModule")
+	}
+	var (
+		calls int
+		last  int64
+	)
+	m.SetProgress(func(done, total int64) {
+		calls++
+		if done < last || done > total {
+			t.Errorf("progress mismatched! done: %d (previous: %d), total: %d", done, last, total)
+		}
+		if total != int64(len(input)) {
+			t.Errorf("total mismatched! want %d, got %d", len(input), total)
+		}
+		last = done
+	})
+	var files int
+	for {
+		_, err := m.Process()
+		if err != nil {
+			break
+		}
+		files++
+	}
+	if files != 3 {
+		t.Errorf("expected 3 files, got %d", files)
+	}
+	// the first message is read by New, before the progress is set
+	if calls != 3 {
+		t.Errorf("progress should be reported for the 2 messages and the end of the input, got %d calls", calls)
+	}
+	if last != int64(len(input)) {
+		t.Errorf("all the input should be read! want %d, got %d", len(input), last)
+	}
+}
+
+func TestMissingDate(t *testing.T) {
+	const csv = "[[mail.file]]\ncontent-type = [\"text/csv\"]\n"
+	var (
+		msg        = messageText(attachment{Name: "data.csv", Mime: "text/csv", Body: "a,b\n1,2\n"})
+		date       = "Date: Mon, 04 Jan 2021 10:00:00 +0000\n"
+		undated    = strings.Replace(msg, date, "", 1)
+		recvd      = strings.Replace(msg, date, "Received: from mx.example.com; Tue, 05 Jan 2021 08:00:00 +0000\n", 1)
+		noreceived = strings.Replace(msg, date, "Received: from mx.example.com\n", 1)
+	)
+	data := []struct {
+		Options string
+		Mbox    string
+		Want    time.Time
+		Invalid bool
+	}{
+		{Mbox: undated},
+		{Options: "missing-date = \"skip\"", Mbox: recvd},
+		{Options: "missing-date = \"received\"", Mbox: recvd, Want: time.Date(2021, 1, 5, 8, 0, 0, 0, time.UTC)},
+		{Options: "missing-date = \"received\"", Mbox: noreceived},
+		{Options: "missing-date = \"default\"\ndefault-date = 2021-02-01T00:00:00Z", Mbox: undated, Want: time.Date(2021, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{Options: "missing-date = \"default\"", Mbox: undated, Invalid: true},
+		{Options: "missing-date = \"now\"", Mbox: undated, Invalid: true},
+		{Options: "missing-date = \"skip\"", Mbox: msg, Want: time.Date(2021, 1, 4, 10, 0, 0, 0, time.UTC)},
+	}
+	for _, d := range data {
+		m, err := newModule(t, d.Mbox, d.Options, csv)
+		if d.Invalid {
+			if err == nil {
+				t.Errorf("%q: expected an error", d.Options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", d.Options, err)
+			continue
+		}
+		i, err := m.Process()
+		if d.Want.IsZero() {
+			if !errors.Is(err, prospect.ErrDone) {
+				t.Errorf("%q: message should be skipped, got %v", d.Options, err)
+			}
+			if m.undated != 1 {
+				t.Errorf("%q: skipped messages mismatched! want 1, got %d", d.Options, m.undated)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", d.Options, err)
+			continue
+		}
+		if !i.AcqTime.Equal(d.Want) || !i.MsgTime.Equal(d.Want) {
+			t.Errorf("%q: times mismatched! want %s, got %s/%s", d.Options, d.Want, i.AcqTime, i.MsgTime)
+		}
+	}
+}
+
+func TestAttachmentOrder(t *testing.T) {
+	const csv = "[[mail.file]]\ncontent-type = [\"text/csv\"]\n"
+	input := messageText(
+		attachment{Name: "b.csv", Mime: "text/csv", Body: strings.Repeat("b", 30)},
+		attachment{Name: "c.csv", Mime: "text/csv", Body: strings.Repeat("c", 10)},
+		attachment{Name: "a.csv", Mime: "text/csv", Body: strings.Repeat("a", 20)},
+	)
+	data := []struct {
+		Options string
+		Want    []string
+		Invalid bool
+	}{
+		{Want: []string{"b.csv", "c.csv", "a.csv"}},
+		{Options: "attachment-order = \"message\"", Want: []string{"b.csv", "c.csv", "a.csv"}},
+		{Options: "attachment-order = \"filename\"", Want: []string{"a.csv", "b.csv", "c.csv"}},
+		{Options: "attachment-order = \"SIZE\"", Want: []string{"c.csv", "a.csv", "b.csv"}},
+		{Options: "attachment-order = \"date\"", Invalid: true},
+	}
+	for _, d := range data {
+		m, err := newModule(t, input, d.Options, csv)
+		if d.Invalid {
+			if err == nil {
+				t.Errorf("%q: expected an error", d.Options)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", d.Options, err)
+			continue
+		}
+		var got []string
+		for {
+			i, err := m.Process()
+			if err != nil {
+				break
+			}
+			got = append(got, filepath.Base(i.File))
+			var links []string
+			for _, k := range i.Links {
+				links = append(links, filepath.Base(k.File))
+			}
+			var want []string
+			for _, f := range d.Want {
+				if f != filepath.Base(i.File) {
+					want = append(want, f)
+				}
+			}
+			if strings.Join(links, ",") != strings.Join(want, ",") {
+				t.Errorf("%q: %s: links mismatched! want %s, got %s", d.Options, i.File, want, links)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(d.Want, ",") {
+			t.Errorf("%q: files mismatched! want %s, got %s", d.Options, d.Want, got)
+		}
+	}
+}
+
+func TestNewInvalid(t *testing.T) {
+	input := messageText(attachment{Name: "data.csv", Mime: "text/csv", Body: "a,b\n1,2\n"})
+	data := []struct {
+		Options string
+		Mail    string
+	}{
+		{Mail: ""},
+		{Mail: "[[mail.file]]\npattern = \"csv$\"\n"},
+		{Mail: "[[mail.file]]\ncontent-type = [\"text/csv\"]\nunknown = true\n"},
+		{Options: "unknown = true", Mail: "[[mail.file]]\ncontent-type = [\"text/csv\"]\n"},
+	}
+	for _, d := range data {
+		if _, err := newModule(t, input, d.Options, d.Mail); err == nil {
+			t.Errorf("%q/%q: expected an error", d.Options, d.Mail)
+		}
+	}
+}
+
+func TestIncludeOverrides(t *testing.T) {
+	const config = `type = "mail"
+
+[[mail.file]]
+content-type = ["application/pdf"]
+type = "report"
+level = 2
+
+[[mail.file]]
+content-type = ["text/csv"]
+type = "dataset"
+
+[[mail.file]]
+content-type = ["image/png"]
+`
+	input := messageText(
+		attachment{Name: "report.pdf", Mime: "application/pdf", Body: "pdf"},
+		attachment{Name: "data.csv", Mime: "text/csv", Body: "a,b\n1,2\n"},
+		attachment{Name: "image.png", Mime: "image/png", Body: "png"},
+	)
+	want := map[string]struct {
+		Type  string
+		Level int
+	}{
+		"report.pdf": {Type: "report", Level: 2},
+		"data.csv":   {Type: "dataset"},
+		"image.png":  {Type: "mail"},
+	}
+	m, err := newModule(t, input, "", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		i, err := m.Process()
+		if err != nil {
+			break
+		}
+		name := filepath.Base(i.File)
+		w, ok := want[name]
+		if !ok {
+			t.Errorf("%s: unexpected file", name)
+			continue
+		}
+		if i.Type != w.Type || i.Level != w.Level {
+			t.Errorf("%s: type/level mismatched! want %s/%d, got %s/%d", name, w.Type, w.Level, i.Type, i.Level)
+		}
+		delete(want, name)
+	}
+	if len(want) > 0 {
+		t.Errorf("missing files %v", want)
+	}
+}
@@ -2,21 +2,44 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
 	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
+	"github.com/busoc/prospect"
 	"github.com/midbel/glob"
 	"github.com/midbel/mbox"
 )
 
+const stdin = "-"
+
 type reader struct {
 	source *glob.Glob
+	files  []string
 
-	inner  *bufio.Reader
+	inner *bufio.Reader
+	// peek reads the current file itself: its first bytes tell if it is
+	// compressed.
+	peek   *bufio.Reader
 	closer io.Closer
+
+	done  int64
+	total int64
+	sized bool
+	gzip  bool
 }
 
 func readMessages(location string) (*reader, error) {
+	if location == "" || location == stdin {
+		return readStream(os.Stdin), nil
+	}
+	if i, err := os.Stat(location); err == nil && i.IsDir() {
+		return readMaildir(location)
+	}
 	src, err := glob.New(location)
 	if err != nil {
 		return nil, err
@@ -27,33 +50,167 @@ func readMessages(location string) (*reader, error) {
 	return &r, r.reset()
 }
 
+// readStream reads messages from a single, possibly non seekable, stream like
+// stdin. Such a reader can not be reset: it reports io.EOF once the stream is
+// consumed.
+func readStream(rs io.Reader) *reader {
+	var r reader
+	r.inner = bufio.NewReader(&counter{Reader: rs, n: &r.done})
+	return &r
+}
+
+// fromLine is written before each message of a maildir that, contrary to a
+// mbox, does not start with a From line.
+const fromLine = "From MAILER-DAEMON\n"
+
+// readMaildir reads the messages found in the cur and new directories of a
+// maildir. Messages are read in the order of their names, ie the order of
+// their delivery.
+func readMaildir(dir string) (*reader, error) {
+	var (
+		files []string
+		total int64
+	)
+	for _, sub := range []string{"cur", "new"} {
+		es, err := os.ReadDir(filepath.Join(dir, sub))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, e := range es {
+			if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			if i, err := e.Info(); err == nil {
+				total += i.Size()
+			}
+			files = append(files, filepath.Join(dir, sub, e.Name()))
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return filepath.Base(files[i]) < filepath.Base(files[j])
+	})
+	r := reader{
+		files: files,
+		total: total,
+		sized: true,
+	}
+	return &r, r.reset()
+}
+
+// nextMessage gives the next message of the current file or of the following
+// ones. io.EOF is reported again once all the files have been read.
 func (r *reader) nextMessage() (mbox.Message, error) {
-	msg, err := mbox.ReadMessage(r.inner)
-	if err != nil {
-		if err == io.EOF {
-			err = r.reset()
+	for {
+		if r.inner == nil {
+			return mbox.Message{}, io.EOF
+		}
+		msg, err := readMessage(r.inner)
+		if err != io.EOF {
+			return msg, err
+		}
+		if err = r.reset(); err != nil {
+			return msg, err
 		}
-		return msg, err
 	}
-	return msg, err
 }
 
 func (r *reader) reset() error {
 	if r.closer != nil {
 		r.closer.Close()
 	}
-	file := r.source.Glob()
+	file := r.nextFile()
 	if file == "" {
+		// the last file is closed: it can not be read anymore
+		r.inner, r.peek, r.closer = nil, nil, nil
 		return io.EOF
 	}
 	f, err := os.Open(file)
 	if err != nil {
 		return err
 	}
-	if r.inner == nil {
-		r.inner = bufio.NewReader(f)
-	} else {
-		r.inner.Reset(f)
+	if i, err := f.Stat(); err == nil && !r.sized {
+		r.total += i.Size()
+	}
+	r.peek = bufio.NewReader(&counter{Reader: f, n: &r.done})
+	r.inner, r.closer = r.peek, f
+	if r.gzip = filepath.Ext(file) == prospect.ExtGZ || isGzip(r.peek); r.gzip {
+		z, err := gzip.NewReader(r.peek)
+		if err != nil {
+			f.Close()
+			r.inner, r.peek, r.closer = nil, nil, nil
+			return err
+		}
+		r.inner, r.closer = bufio.NewReader(z), gzipCloser{Reader: z, file: f}
+	}
+	if r.source == nil {
+		r.inner = bufio.NewReader(io.MultiReader(strings.NewReader(fromLine), r.inner))
 	}
 	return nil
 }
+
+// gzipMagic starts any gzip stream.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// isGzip reports whether the next bytes of rs are the gzip magic.
+func isGzip(rs *bufio.Reader) bool {
+	magic, _ := rs.Peek(len(gzipMagic))
+	return bytes.Equal(magic, gzipMagic)
+}
+
+// gzipCloser closes the gzip reader of a file and the file itself.
+type gzipCloser struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g gzipCloser) Close() error {
+	err := g.Reader.Close()
+	if e := g.file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func (r *reader) nextFile() string {
+	if r.source != nil {
+		return r.source.Glob()
+	}
+	if len(r.files) == 0 {
+		return ""
+	}
+	file := r.files[0]
+	r.files = r.files[1:]
+	return file
+}
+
+// progress gives the number of bytes of messages already read and the size of
+// all the files to be read. With a glob, the total only includes the files
+// opened so far and it is always zero when reading stdin. The buffered bytes
+// of a decompressed file can not be taken into account.
+func (r *reader) progress() (int64, int64) {
+	done := r.done
+	if r.peek != nil {
+		done -= int64(r.peek.Buffered())
+	}
+	if r.inner != nil && r.inner != r.peek && !r.gzip {
+		done -= int64(r.inner.Buffered())
+	}
+	if done < 0 {
+		done = 0
+	}
+	return done, r.total
+}
+
+type counter struct {
+	io.Reader
+	n *int64
+}
+
+func (c *counter) Read(b []byte) (int, error) {
+	n, err := c.Reader.Read(b)
+	*c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/busoc/prospect"
+)
+
+func TestReadStream(t *testing.T) {
+	var (
+		msg   = messageText(attachment{Name: "data.csv", Mime: "text/csv", Body: "a,b\n1,2\n"})
+		input = strings.Repeat(msg, 3)
+	)
+	data := []struct {
+		Name string
+		Size int
+	}{
+		{Name: "whole input", Size: len(input)},
+		{Name: "small writes", Size: 7},
+	}
+	for _, d := range data {
+		pr, pw := io.Pipe()
+		go func(size int) {
+			for str := input; len(str) > 0; {
+				if size > len(str) {
+					size = len(str)
+				}
+				pw.Write([]byte(str[:size]))
+				str = str[size:]
+			}
+			pw.Close()
+		}(d.Size)
+
+		var (
+			r     = readStream(pr)
+			count int
+		)
+		for {
+			msg, err := r.nextMessage()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", d.Name, err)
+				break
+			}
+			if len(msg.Parts) == 0 {
+				t.Errorf("%s: message #%d without parts", d.Name, count+1)
+			}
+			count++
+		}
+		if count != 3 {
+			t.Errorf("%s: expected 3 messages, got %d", d.Name, count)
+		}
+		if done, total := r.progress(); done != int64(len(input)) || total != 0 {
+			t.Errorf("%s: progress mismatched! want %d/0, got %d/%d", d.Name, len(input), done, total)
+		}
+		if _, err := r.nextMessage(); err != io.EOF {
+			t.Errorf("%s: expected %v once the stream is consumed, got %v", d.Name, io.EOF, err)
+		}
+	}
+}
+
+func TestReadStdin(t *testing.T) {
+	input := messageText(attachment{Name: "data.csv", Mime: "text/csv", Body: "a,b\n1,2\n"})
+	for _, location := range []string{"", stdin} {
+		pr, pw, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			pw.WriteString(input)
+			pw.Close()
+		}()
+		old := os.Stdin
+		os.Stdin = pr
+		r, err := readMessages(location)
+		os.Stdin = old
+
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", location, err)
+			pr.Close()
+			continue
+		}
+		if _, err := r.nextMessage(); err != nil {
+			t.Errorf("%q: unexpected error: %s", location, err)
+		}
+		if _, err := r.nextMessage(); err != io.EOF {
+			t.Errorf("%q: expected %v, got %v", location, io.EOF, err)
+		}
+		pr.Close()
+	}
+}
+
+func TestReadMaildir(t *testing.T) {
+	dir := t.TempDir()
+	files := []struct {
+		Name    string
+		Subject string
+	}{
+		{Name: "new/1610000002.M2.host", Subject: "second"},
+		{Name: "cur/1610000001.M1.host:2,S", Subject: "first"},
+		{Name: "new/1610000003.M3.host", Subject: "third"},
+		{Name: "tmp/1610000000.M0.host", Subject: "in delivery"},
+		{Name: "cur/.hidden", Subject: "hidden"},
+	}
+	var total int64
+	for _, f := range files {
+		var (
+			file = filepath.Join(dir, f.Name)
+			msg  = messageText(attachment{Name: "data.csv", Mime: "text/csv", Body: "a,b\n1,2\n"})
+		)
+		// messages of a maildir do not start with a From line
+		msg = msg[strings.IndexByte(msg, '\n')+1:]
+		msg = strings.Replace(msg, "Subject: test", "Subject: "+f.Subject, 1)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte(msg), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if sub := filepath.Base(filepath.Dir(file)); sub != "tmp" && !strings.HasPrefix(filepath.Base(file), ".") {
+			total += int64(len(msg))
+		}
+	}
+	r, err := readMessages(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var got []string
+	for {
+		msg, err := r.nextMessage()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(msg.Parts) == 0 {
+			t.Errorf("%s: message without parts", msg.Subject())
+		}
+		got = append(got, msg.Subject())
+	}
+	if want := "first,second,third"; strings.Join(got, ",") != want {
+		t.Errorf("messages mismatched! want %s, got %s", want, got)
+	}
+	if _, n := r.progress(); n != total {
+		t.Errorf("total mismatched! want %d, got %d", total, n)
+	}
+
+	config := filepath.Join(t.TempDir(), "config.toml")
+	str := "[[mail]]\nmaildir = " + strconv.Quote(t.TempDir()) + "\n[mail.predicate]\nsubject = \"^(first|third)$\"\n[[mail.file]]\ncontent-type = [\"text/csv\"]\n"
+	if err := ioutil.WriteFile(config, []byte(str), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mod, err := New(prospect.Config{Config: config, Location: dir})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var count int
+	for {
+		if _, err := mod.Process(); err != nil {
+			break
+		}
+		count++
+	}
+	if count != 2 {
+		t.Errorf("module: expected 2 files, got %d", count)
+	}
+}
+
+func TestReadGzip(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		plain = strings.Replace(messageText(attachment{Name: "data.csv", Mime: "text/csv", Body: "a,b\n1,2\n"}), "Subject: test", "Subject: plain", 1)
+		compr = strings.Replace(messageText(attachment{Name: "data.csv", Mime: "text/csv", Body: "c,d\n3,4\n"}), "Subject: test", "Subject: compressed", 1)
+	)
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.mbox"), []byte(plain), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	z := gzip.NewWriter(&buf)
+	z.Write([]byte(compr + compr))
+	z.Close()
+	if err := ioutil.WriteFile(filepath.Join(dir, "b.mbox.gz"), buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// a compressed file without its extension is found by its magic
+	var magic bytes.Buffer
+	z = gzip.NewWriter(&magic)
+	z.Write([]byte(strings.Replace(compr, "Subject: compressed", "Subject: magic", 1)))
+	z.Close()
+	if err := ioutil.WriteFile(filepath.Join(dir, "c.mbox"), magic.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := readMessages(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var got []string
+	for {
+		msg, err := r.nextMessage()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		got = append(got, msg.Subject())
+	}
+	if _, err := r.nextMessage(); err != io.EOF {
+		t.Errorf("expected %v once all the files are read, got %v", io.EOF, err)
+	}
+	sort.Strings(got)
+	if want := "compressed,compressed,magic,plain"; strings.Join(got, ",") != want {
+		t.Errorf("messages mismatched! want %s, got %s", want, got)
+	}
+	size := int64(len(plain) + buf.Len() + magic.Len())
+	if done, total := r.progress(); done != total || total != size {
+		t.Errorf("progress mismatched! want %d, got %d/%d", size, done, total)
+	}
+
+	file := filepath.Join(t.TempDir(), "broken.mbox.gz")
+	if err := ioutil.WriteFile(file, []byte(plain), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readMessages(file); err == nil {
+		t.Errorf("%s: expected an error", file)
+	}
+}
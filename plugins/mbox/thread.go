@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/busoc/prospect"
+	"github.com/midbel/mbox"
+)
+
+const (
+	mailMessageId = "mail.message-id"
+	mailInReplyTo = "mail.in-reply-to"
+	mailReference = "mail.reference.%d"
+
+	hdrMessageId  = "Message-Id"
+	hdrInReplyTo  = "In-Reply-To"
+	hdrReferences = "References"
+
+	roleThread = "thread"
+)
+
+// threads keeps, for each message id seen during a run, the links to the
+// files extracted from the message.
+type threads map[string][]prospect.Link
+
+func (t threads) register(msg mbox.Message, parts []item) {
+	ids := messageIds(msg.Get(hdrMessageId))
+	if len(ids) == 0 {
+		return
+	}
+	for _, p := range parts {
+		k := prospect.Link{
+			File: p.File,
+			Role: roleThread,
+		}
+		t[ids[0]] = append(t[ids[0]], k)
+	}
+}
+
+func (t threads) links(msg mbox.Message) []prospect.Link {
+	var ks []prospect.Link
+	for _, id := range references(msg) {
+		ks = append(ks, t[id]...)
+	}
+	return ks
+}
+
+func threadParameters(msg mbox.Message) []prospect.Parameter {
+	var ps []prospect.Parameter
+	if ids := messageIds(msg.Get(hdrMessageId)); len(ids) > 0 {
+		ps = append(ps, prospect.MakeParameter(mailMessageId, ids[0]))
+	}
+	if ids := messageIds(msg.Get(hdrInReplyTo)); len(ids) > 0 {
+		ps = append(ps, prospect.MakeParameter(mailInReplyTo, ids[0]))
+	}
+	for i, id := range messageIds(msg.Get(hdrReferences)) {
+		ps = append(ps, prospect.MakeParameter(fmt.Sprintf(mailReference, i+1), id))
+	}
+	return ps
+}
+
+// references gives the ids of the messages referenced by msg without
+// duplicates.
+func references(msg mbox.Message) []string {
+	var (
+		ids  = messageIds(msg.Get(hdrReferences))
+		list []string
+		seen = make(map[string]struct{})
+	)
+	ids = append(ids, messageIds(msg.Get(hdrInReplyTo))...)
+	for _, id := range ids {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		list = append(list, id)
+	}
+	return list
+}
+
+// messageIds extracts the ids enclosed in angle brackets from str.
+func messageIds(str string) []string {
+	var ids []string
+	for {
+		x := strings.IndexByte(str, '<')
+		if x < 0 {
+			break
+		}
+		str = str[x+1:]
+		x = strings.IndexByte(str, '>')
+		if x < 0 {
+			break
+		}
+		if id := strings.TrimSpace(str[:x]); id != "" {
+			ids = append(ids, id)
+		}
+		str = str[x+1:]
+	}
+	return ids
+}
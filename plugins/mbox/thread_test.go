@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/busoc/prospect"
+)
+
+func TestMessageIds(t *testing.T) {
+	data := []struct {
+		Header string
+		Want   []string
+	}{
+		{Header: ""},
+		{Header: "1@example.com"},
+		{Header: "<1@example.com>", Want: []string{"1@example.com"}},
+		{Header: " <1@example.com>\n\t<2@example.com> ", Want: []string{"1@example.com", "2@example.com"}},
+		{Header: "<1@example.com> <> < 2@example.com >", Want: []string{"1@example.com", "2@example.com"}},
+		{Header: "<1@example.com> <2@example.com", Want: []string{"1@example.com"}},
+	}
+	for _, d := range data {
+		got := messageIds(d.Header)
+		if strings.Join(got, ",") != strings.Join(d.Want, ",") {
+			t.Errorf("%q: ids mismatched! want %s, got %s", d.Header, d.Want, got)
+		}
+	}
+}
+
+func TestThreads(t *testing.T) {
+	const csv = "[[mail.file]]\ncontent-type = [\"text/csv\"]\n"
+	var (
+		first  = messageText(attachment{Name: "first.csv", Mime: "text/csv", Body: "a,b\n1,2\n"})
+		second = strings.Replace(
+			messageText(attachment{Name: "second.csv", Mime: "text/csv", Body: "c,d\n3,4\n"}),
+			"Message-Id: <1@example.com>\n",
+			"Message-Id: <2@example.com>\nIn-Reply-To: <1@example.com>\nReferences: <0@example.com> <1@example.com>\n",
+			1,
+		)
+	)
+	data := []struct {
+		Options string
+		Links   bool
+	}{
+		{Options: "keep-files = true"},
+		{Options: "keep-files = true\nlink-threads = true", Links: true},
+	}
+	for _, d := range data {
+		m, err := newModule(t, first+second, d.Options, csv)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", d.Options, err)
+			continue
+		}
+		var infos []prospect.FileInfo
+		for {
+			i, err := m.Process()
+			if err != nil {
+				break
+			}
+			infos = append(infos, i)
+		}
+		if len(infos) != 2 {
+			t.Errorf("%q: expected 2 files, got %d", d.Options, len(infos))
+			continue
+		}
+		want := map[string]string{
+			mailMessageId:      "2@example.com",
+			mailInReplyTo:      "1@example.com",
+			"mail.reference.1": "0@example.com",
+			"mail.reference.2": "1@example.com",
+		}
+		for _, p := range infos[1].Parameters {
+			if v, ok := want[p.Name]; ok {
+				if v != p.Value {
+					t.Errorf("%q: %s: values mismatched! want %s, got %s", d.Options, p.Name, v, p.Value)
+				}
+				delete(want, p.Name)
+			}
+		}
+		if len(want) > 0 {
+			t.Errorf("%q: missing parameters %v", d.Options, want)
+		}
+		if len(infos[0].Links) != 0 {
+			t.Errorf("%q: first message should not be linked, got %v", d.Options, infos[0].Links)
+		}
+		ks := infos[1].Links
+		if !d.Links {
+			if len(ks) != 0 {
+				t.Errorf("%q: unexpected links %v", d.Options, ks)
+			}
+			continue
+		}
+		if len(ks) != 1 || ks[0].File != infos[0].File || ks[0].Role != roleThread {
+			t.Errorf("%q: links mismatched! want %s (%s), got %v", d.Options, infos[0].File, roleThread, ks)
+		}
+	}
+}
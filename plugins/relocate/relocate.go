@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/busoc/prospect"
+	"github.com/midbel/toml"
+)
+
+const (
+	relocateFrom = "relocate.from"
+	relocateTo   = "relocate.to"
+
+	reasonUnchanged = "location unchanged"
+)
+
+// module reads the records of a manifest and gives, for each of them, the
+// location computed with the new pattern. No file is moved: the records only
+// describe the moves to perform.
+type module struct {
+	cfg     prospect.Config
+	pattern prospect.Pattern
+	ctx     prospect.Context
+
+	reader *prospect.ManifestReader
+	closer io.Closer
+}
+
+func init() {
+	prospect.Register("relocate", New)
+}
+
+func New(cfg prospect.Config) (prospect.Module, error) {
+	c := struct {
+		Pattern prospect.Pattern `toml:"pattern"`
+		prospect.Context
+	}{}
+	if err := toml.DecodeFile(cfg.Config, &c); err != nil {
+		return nil, err
+	}
+	if c.Pattern.IsEmpty() {
+		return nil, fmt.Errorf("pattern should be set")
+	}
+	r, err := prospect.OpenFile(cfg.Location)
+	if err != nil {
+		return nil, err
+	}
+	mr, err := prospect.NewManifestReader(r, cfg.Fields)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	m := module{
+		cfg:     cfg,
+		pattern: c.Pattern,
+		ctx:     c.Context,
+		reader:  mr,
+		closer:  r,
+	}
+	return &m, nil
+}
+
+func (m *module) String() string {
+	return "relocate"
+}
+
+// Process gives the record of the next file of the manifest with its new
+// location (the directory given by the pattern followed by the base name of the
+// file) as File and its current location as Origin. The files whose
+// location does not change are skipped.
+func (m *module) Process() (prospect.FileInfo, error) {
+	fi, err := m.reader.Read()
+	if err != nil {
+		m.closer.Close()
+		if errors.Is(err, io.EOF) {
+			err = prospect.ErrDone
+		}
+		return prospect.FileInfo{}, err
+	}
+	d := m.ctx.Update(prospect.DataFromFileInfo(fi))
+	dir, err := m.pattern.ResolveErr(d)
+	if err != nil {
+		return prospect.FileInfo{}, fmt.Errorf("%s: %w", fi.File, err)
+	}
+	file := filepath.Join(dir, filepath.Base(fi.File))
+	if file == fi.File {
+		return prospect.FileInfo{}, prospect.Skip(reasonUnchanged)
+	}
+	fi.Origin, fi.File = fi.File, file
+	fi.Parameters = append(fi.Parameters,
+		prospect.MakeParameter(relocateFrom, fi.Origin),
+		prospect.MakeParameter(relocateTo, fi.File),
+	)
+	return fi, nil
+}
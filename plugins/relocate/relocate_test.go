@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/busoc/prospect"
+)
+
+func TestProcess(t *testing.T) {
+	when := time.Date(2021, 5, 7, 10, 0, 0, 0, time.UTC)
+	data := []struct {
+		Info prospect.FileInfo
+		Want string
+		Err  error
+	}{
+		{
+			Info: prospect.FileInfo{File: "/old/file.csv", Type: "data", AcqTime: when},
+			Want: "Src/Data/2021/file.csv",
+		},
+		{
+			Info: prospect.FileInfo{File: "Src/Image/2021/file.png", Type: "image", AcqTime: when},
+			Err:  prospect.ErrSkip,
+		},
+		{
+			Info: prospect.FileInfo{File: "/old/file.dat", AcqTime: when},
+			Err:  prospect.ErrEmpty,
+		},
+		{
+			Info: prospect.FileInfo{File: "/old/image.png", Type: "image", AcqTime: when},
+			Want: "Src/Image/2021/image.png",
+		},
+	}
+	var (
+		dir      = t.TempDir()
+		manifest = filepath.Join(dir, "manifest.json")
+		config   = filepath.Join(dir, "relocate.toml")
+		names    = map[string]string{prospect.FieldFile: "path"}
+	)
+	w, err := os.Create(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mw, _ := prospect.NewManifestWriter(w, names)
+	for _, d := range data {
+		mw.Write(d.Info)
+	}
+	w.Close()
+	if err := ioutil.WriteFile(config, []byte("pattern = \"{source}/{type}/{year}\"\nsource = \"src\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(prospect.Config{Config: config, Location: manifest, Fields: names})
+	if err != nil {
+		t.Fatalf("fail to create module: %s", err)
+	}
+	for _, d := range data {
+		fi, err := m.Process()
+		if d.Err != nil {
+			if !errors.Is(err, d.Err) {
+				t.Errorf("%s: expected error %v, got %v", d.Info.File, d.Err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Info.File, err)
+			continue
+		}
+		if fi.File != d.Want || fi.Origin != d.Info.File {
+			t.Errorf("%s: locations mismatched! want %s, got %s (origin: %s)", d.Info.File, d.Want, fi.File, fi.Origin)
+		}
+		params := make(map[string]string)
+		for _, p := range fi.Parameters {
+			params[p.Name] = p.Value
+		}
+		if params[relocateFrom] != d.Info.File || params[relocateTo] != d.Want {
+			t.Errorf("%s: parameters mismatched! got %v", d.Info.File, params)
+		}
+	}
+	if _, err := m.Process(); !errors.Is(err, prospect.ErrDone) {
+		t.Errorf("expected end of manifest, got %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "manifest.json")
+	if err := ioutil.WriteFile(manifest, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	data := []struct {
+		Config   string
+		Location string
+		Fields   map[string]string
+		Invalid  bool
+	}{
+		{Config: "pattern = \"{type}\"\n", Location: manifest},
+		{Config: "", Location: manifest, Invalid: true},
+		{Config: "pattern = \"{type}\"\n", Location: filepath.Join(dir, "missing.json"), Invalid: true},
+		{Config: "pattern = \"{type}\"\n", Location: manifest, Fields: map[string]string{"unknown": "x"}, Invalid: true},
+	}
+	for _, d := range data {
+		config := filepath.Join(t.TempDir(), "relocate.toml")
+		if err := ioutil.WriteFile(config, []byte(d.Config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		_, err := New(prospect.Config{Config: config, Location: d.Location, Fields: d.Fields})
+		if d.Invalid != (err != nil) {
+			t.Errorf("%q: unexpected result: %v", d.Config, err)
+		}
+	}
+}
+
+func TestProcessModel(t *testing.T) {
+	var (
+		when = time.Date(2021, 5, 7, 10, 0, 0, 0, time.UTC)
+		sent = time.Date(2020, 12, 31, 23, 0, 0, 0, time.UTC)
+	)
+	data := []struct {
+		Info prospect.FileInfo
+		Want string
+		Err  error
+	}{
+		{
+			Info: prospect.FileInfo{File: "/old/file.csv", Model: "fm", AcqTime: when, MsgTime: sent},
+			Want: "Fm/2020/file.csv",
+		},
+		{
+			Info: prospect.FileInfo{File: "/old/other.csv", Model: "em", Origin: "/incoming/other.csv", AcqTime: when, MsgTime: sent},
+			Want: "Em/2020/other.csv",
+		},
+		{
+			Info: prospect.FileInfo{File: "/old/file.dat", AcqTime: when, MsgTime: sent},
+			Err:  prospect.ErrEmpty,
+		},
+	}
+	var (
+		dir      = t.TempDir()
+		manifest = filepath.Join(dir, "manifest.json")
+		config   = filepath.Join(dir, "relocate.toml")
+		names    = map[string]string{prospect.FieldModel: "instrument"}
+	)
+	w, err := os.Create(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mw, _ := prospect.NewManifestWriter(w, names)
+	for _, d := range data {
+		mw.Write(d.Info)
+	}
+	w.Close()
+	if err := ioutil.WriteFile(config, []byte("pattern = \"{model}/{msgdate:year}\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := New(prospect.Config{Config: config, Location: manifest, Fields: names})
+	if err != nil {
+		t.Fatalf("fail to create module: %s", err)
+	}
+	for _, d := range data {
+		fi, err := m.Process()
+		if d.Err != nil {
+			if !errors.Is(err, d.Err) {
+				t.Errorf("%s: expected error %v, got %v", d.Info.File, d.Err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Info.File, err)
+			continue
+		}
+		if fi.File != d.Want || fi.Model != d.Info.Model || !fi.MsgTime.Equal(sent) {
+			t.Errorf("%s: records mismatched! want %s, got %+v", d.Info.File, d.Want, fi)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/busoc/prospect"
+	"github.com/midbel/toml"
+)
+
+type file struct {
+	Path string
+	os.FileInfo
+}
+
+// literal is the value of an option kept as is so that a time without zone
+// information can be parsed in the configured time zone.
+type literal string
+
+func (i *literal) Set(str string) error {
+	*i = literal(str)
+	return nil
+}
+
+type module struct {
+	cfg prospect.Config
+
+	files     []file
+	watermark time.Time
+	sniff     bool
+}
+
+func init() {
+	prospect.Register("walk", New)
+}
+
+func New(cfg prospect.Config) (prospect.Module, error) {
+	c := struct {
+		Since literal `toml:"since"`
+		Sniff bool    `toml:"sniff-mime"`
+	}{}
+	if err := toml.DecodeFile(cfg.Config, &c); err != nil {
+		return nil, err
+	}
+	m := module{
+		cfg:   cfg,
+		sniff: c.Sniff,
+	}
+	var err error
+	if c.Since != "" {
+		if m.watermark, err = cfg.ParseTimeAny(string(c.Since)); err != nil {
+			return nil, fmt.Errorf("since: %w", err)
+		}
+	}
+	if m.files, err = listFiles(cfg.Location, m.watermark); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (m *module) String() string {
+	return "walk"
+}
+
+// Watermark gives the latest modification time of the files already returned
+// by Process or the since option if none has been returned yet.
+func (m *module) Watermark() time.Time {
+	return m.watermark
+}
+
+func (m *module) Process() (prospect.FileInfo, error) {
+	if len(m.files) == 0 {
+		return prospect.FileInfo{}, prospect.ErrDone
+	}
+	f := m.files[0]
+	m.files = m.files[1:]
+
+	mt := mime.TypeByExtension(filepath.Ext(f.Path))
+	sum, sniffed, err := m.digest(f.Path, mt == "" && m.sniff)
+	if err != nil {
+		return prospect.FileInfo{}, err
+	}
+	if mt == "" {
+		mt = sniffed
+	}
+	if ix := strings.IndexByte(mt, ';'); ix >= 0 {
+		mt = mt[:ix]
+	}
+	info := prospect.FileInfo{
+		File:      f.Path,
+		Type:      m.cfg.Type,
+		Mime:      mt,
+		Level:     m.cfg.Level,
+		Size:      f.Size(),
+		Integrity: sum,
+		AcqTime:   f.ModTime().UTC(),
+		ModTime:   f.ModTime().UTC(),
+	}
+	if info.Origin, err = filepath.Abs(f.Path); err != nil {
+		return prospect.FileInfo{}, err
+	}
+	if info.Type == "" {
+		info.Type = prospect.TypeData
+	}
+	info.Parameters = []prospect.Parameter{
+		prospect.MakeParameter(prospect.FileSize, f.Size()),
+	}
+	if f.ModTime().After(m.watermark) {
+		m.watermark = f.ModTime()
+	}
+	return info, nil
+}
+
+// digest computes the digest of file. Only its beginning is used if the
+// hash-prefix option is set. If sniff is set, the mime type of the content of
+// file is also detected.
+func (m *module) digest(file string, sniff bool) (prospect.Integrity, string, error) {
+	r, err := os.Open(file)
+	if err != nil {
+		return prospect.Integrity{}, "", err
+	}
+	defer r.Close()
+
+	var (
+		rs = bufio.NewReader(r)
+		mt string
+	)
+	if sniff {
+		buf, _ := rs.Peek(sniffLen)
+		mt = http.DetectContentType(buf)
+	}
+	sum, err := m.cfg.Digest(rs)
+	return sum, mt, err
+}
+
+// sniffLen is the number of bytes used to detect the mime type of a file.
+const sniffLen = 512
+
+// listFiles gives the regular files found under dir that have been modified
+// after since. All the files are kept if since is the zero time. The files are
+// sorted by modification time so that the watermark never gets past a file
+// not yet processed.
+func listFiles(dir string, since time.Time) ([]file, error) {
+	var fs []file
+	err := filepath.Walk(dir, func(path string, i os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !i.Mode().IsRegular() {
+			return nil
+		}
+		if !since.IsZero() && !i.ModTime().After(since) {
+			return nil
+		}
+		fs = append(fs, file{Path: path, FileInfo: i})
+		return nil
+	})
+	sort.SliceStable(fs, func(i, j int) bool {
+		return fs[i].ModTime().Before(fs[j].ModTime())
+	})
+	return fs, err
+}
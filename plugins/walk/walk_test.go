@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/busoc/prospect"
+)
+
+func TestNewSince(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip(err)
+	}
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, "data.txt"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	data := []struct {
+		Config string
+		Zone   *time.Location
+		Want   time.Time
+	}{
+		{Config: ""},
+		{Config: "since = 2021-01-04T02:00:00Z\n", Zone: tokyo, Want: time.Date(2021, 1, 4, 2, 0, 0, 0, time.UTC)},
+		{Config: "since = 2021-01-04T02:00:00\n", Want: time.Date(2021, 1, 4, 2, 0, 0, 0, time.UTC)},
+		{Config: "since = 2021-01-04T02:00:00\n", Zone: tokyo, Want: time.Date(2021, 1, 3, 17, 0, 0, 0, time.UTC)},
+		{Config: "since = \"2021-01-04 02:00:00\"\n", Zone: tokyo, Want: time.Date(2021, 1, 3, 17, 0, 0, 0, time.UTC)},
+	}
+	for _, d := range data {
+		file := filepath.Join(t.TempDir(), "walk.toml")
+		if err := ioutil.WriteFile(file, []byte(d.Config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg := prospect.Config{
+			Location: dir,
+			Config:   file,
+			Timezone: prospect.Location{Location: d.Zone},
+		}
+		mod, err := New(cfg)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", d.Config, err)
+			continue
+		}
+		if got := mod.(*module).Watermark(); !got.Equal(d.Want) {
+			t.Errorf("%q: times mismatched! want %s, got %s", d.Config, d.Want, got)
+		}
+	}
+}
+
+func TestProcess(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		base = time.Date(2021, 1, 4, 10, 0, 0, 0, time.UTC)
+	)
+	files := []struct {
+		Name    string
+		ModTime time.Time
+	}{
+		{Name: "old.txt", ModTime: base.Add(-time.Hour)},
+		{Name: "new.csv", ModTime: base.Add(time.Hour)},
+		{Name: "sub/newer.txt", ModTime: base.Add(2 * time.Hour)},
+	}
+	for _, f := range files {
+		file := filepath.Join(dir, f.Name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, f.ModTime, f.ModTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := []struct {
+		Config string
+		Want   []string
+		Last   time.Time
+	}{
+		{
+			Want: []string{"old.txt", "new.csv", "sub/newer.txt"},
+			Last: base.Add(2 * time.Hour),
+		},
+		{
+			Config: "since = 2021-01-04T10:00:00Z\n",
+			Want:   []string{"new.csv", "sub/newer.txt"},
+			Last:   base.Add(2 * time.Hour),
+		},
+		{
+			Config: "since = 2021-01-04T11:00:00Z\n",
+			Want:   []string{"sub/newer.txt"},
+			Last:   base.Add(2 * time.Hour),
+		},
+		{
+			Config: "since = 2021-01-04T12:00:00Z\n",
+			Last:   base.Add(2 * time.Hour),
+		},
+	}
+	for _, d := range data {
+		file := filepath.Join(t.TempDir(), "walk.toml")
+		if err := ioutil.WriteFile(file, []byte(d.Config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mod, err := New(prospect.Config{Location: dir, Config: file})
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", d.Config, err)
+			continue
+		}
+		var got []string
+		for {
+			i, err := mod.Process()
+			if errors.Is(err, prospect.ErrDone) {
+				break
+			}
+			if err != nil {
+				t.Errorf("%q: unexpected error: %s", d.Config, err)
+				break
+			}
+			rel, _ := filepath.Rel(dir, i.File)
+			got = append(got, filepath.ToSlash(rel))
+			if i.Type != prospect.TypeData || i.Size != int64(len("content")) || i.Integrity.IsZero() {
+				t.Errorf("%q: %s: unexpected info %+v", d.Config, rel, i)
+			}
+			if w := mod.(prospect.WatermarkModule).Watermark(); w.Before(i.ModTime) {
+				t.Errorf("%q: %s: watermark %s before the modification time %s", d.Config, rel, w, i.ModTime)
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(d.Want, ",") {
+			t.Errorf("%q: files mismatched! want %s, got %s", d.Config, d.Want, got)
+		}
+		if got := mod.(prospect.WatermarkModule).Watermark(); !got.Equal(d.Last) {
+			t.Errorf("%q: watermark mismatched! want %s, got %s", d.Config, d.Last, got)
+		}
+	}
+}
+
+func TestProcessMime(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		png = "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"
+	)
+	files := []struct {
+		Name string
+		Data string
+	}{
+		{Name: "image", Data: png},
+		{Name: "image.png", Data: png},
+		{Name: "notes.txt", Data: "content"},
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, f.Name), []byte(f.Data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data := []struct {
+		Config string
+		Want   map[string]string
+	}{
+		{
+			Want: map[string]string{"image": "", "image.png": "image/png", "notes.txt": "text/plain"},
+		},
+		{
+			Config: "sniff-mime = true\n",
+			Want:   map[string]string{"image": "image/png", "image.png": "image/png", "notes.txt": "text/plain"},
+		},
+	}
+	for _, d := range data {
+		file := filepath.Join(t.TempDir(), "walk.toml")
+		if err := ioutil.WriteFile(file, []byte(d.Config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mod, err := New(prospect.Config{Location: dir, Config: file})
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", d.Config, err)
+			continue
+		}
+		for {
+			i, err := mod.Process()
+			if errors.Is(err, prospect.ErrDone) {
+				break
+			}
+			if err != nil {
+				t.Errorf("%q: unexpected error: %s", d.Config, err)
+				break
+			}
+			name := filepath.Base(i.File)
+			if want := d.Want[name]; i.Mime != want {
+				t.Errorf("%q: %s: mime types mismatched! want %q, got %q", d.Config, name, want, i.Mime)
+			}
+		}
+	}
+}
+
+func TestProcessOrder(t *testing.T) {
+	var (
+		dir  = t.TempDir()
+		base = time.Date(2021, 1, 4, 10, 0, 0, 0, time.UTC)
+	)
+	files := []struct {
+		Name    string
+		ModTime time.Time
+	}{
+		{Name: "a.txt", ModTime: base.Add(3 * time.Hour)},
+		{Name: "b.txt", ModTime: base.Add(time.Hour)},
+		{Name: "sub/c.txt", ModTime: base},
+		{Name: "z.txt", ModTime: base.Add(2 * time.Hour)},
+	}
+	for _, f := range files {
+		file := filepath.Join(dir, f.Name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, []byte("content"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, f.ModTime, f.ModTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a run stopped after two files, then resumed from its watermark, has to
+	// give all the files
+	var (
+		got  []string
+		last time.Time
+	)
+	for _, n := range []int{2, -1} {
+		var config string
+		if !last.IsZero() {
+			config = "since = " + last.Format(time.RFC3339) + "\n"
+		}
+		file := filepath.Join(t.TempDir(), "walk.toml")
+		if err := ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mod, err := New(prospect.Config{Location: dir, Config: file})
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %s", config, err)
+		}
+		for ; n != 0; n-- {
+			i, err := mod.Process()
+			if errors.Is(err, prospect.ErrDone) {
+				break
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			rel, _ := filepath.Rel(dir, i.File)
+			got = append(got, filepath.ToSlash(rel))
+		}
+		last = mod.(prospect.WatermarkModule).Watermark()
+	}
+	if want := "sub/c.txt,b.txt,z.txt,a.txt"; strings.Join(got, ",") != want {
+		t.Errorf("files mismatched! want %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/busoc/prospect"
+	"github.com/midbel/toml"
+)
+
+const (
+	windowCount    = "window.count"
+	windowDuration = "window.duration"
+
+	reasonLate = "late event"
+
+	mimeNDJSON = "application/x-ndjson"
+)
+
+type bucket struct {
+	Starts time.Time
+	Count  int
+}
+
+type module struct {
+	cfg prospect.Config
+
+	field  string
+	window time.Duration
+	grace  time.Duration
+
+	scan   *bufio.Scanner
+	closer io.Closer
+	done   bool
+
+	buckets map[int64]*bucket
+	ready   []bucket
+	latest  time.Time
+	closed  time.Time
+}
+
+func init() {
+	prospect.Register("window", New)
+}
+
+func New(cfg prospect.Config) (prospect.Module, error) {
+	c := struct {
+		Field  string            `toml:"time-field"`
+		Window prospect.Duration `toml:"window"`
+		Grace  prospect.Duration `toml:"grace"`
+	}{}
+	if err := toml.DecodeFile(cfg.Config, &c); err != nil {
+		return nil, err
+	}
+	if c.Window.Duration <= 0 {
+		return nil, fmt.Errorf("window: duration should be greater than 0")
+	}
+	if c.Field == "" {
+		c.Field = "time"
+	}
+	r, err := prospect.OpenFile(cfg.Location)
+	if err != nil {
+		return nil, err
+	}
+	m := module{
+		cfg:     cfg,
+		field:   c.Field,
+		window:  c.Window.Duration,
+		grace:   c.Grace.Duration,
+		scan:    bufio.NewScanner(r),
+		closer:  r,
+		buckets: make(map[int64]*bucket),
+	}
+	return &m, nil
+}
+
+func (m *module) String() string {
+	return "window"
+}
+
+func (m *module) Process() (prospect.FileInfo, error) {
+	for len(m.ready) == 0 {
+		if m.done {
+			return prospect.FileInfo{}, prospect.ErrDone
+		}
+		if err := m.nextEvent(); err != nil {
+			return prospect.FileInfo{}, err
+		}
+	}
+	b := m.ready[0]
+	m.ready = m.ready[1:]
+
+	info := prospect.FileInfo{
+		File:    fmt.Sprintf("%s_%s", filepath.Base(m.cfg.Location), b.Starts.Format("20060102_150405")),
+		Type:    m.cfg.Type,
+		Mime:    mimeNDJSON,
+		Level:   m.cfg.Level,
+		AcqTime: b.Starts,
+		ModTime: b.Starts.Add(m.window),
+	}
+	if info.Type == "" {
+		info.Type = prospect.TypeData
+	}
+	info.Parameters = []prospect.Parameter{
+		prospect.MakeParameter(windowCount, b.Count),
+		prospect.MakeParameter(windowDuration, m.window),
+	}
+	return info, nil
+}
+
+// nextEvent reads the next event of the stream and moves to the ready list the
+// windows that can not receive events anymore, ie windows that ended before
+// the latest event time minus the grace period.
+func (m *module) nextEvent() error {
+	if !m.scan.Scan() {
+		m.done = true
+		m.closer.Close()
+		m.flush(time.Time{})
+		return m.scan.Err()
+	}
+	line := m.scan.Bytes()
+	if len(strings.TrimSpace(string(line))) == 0 {
+		return nil
+	}
+	when, err := m.parseTime(line)
+	if err != nil {
+		return err
+	}
+	starts := when.Truncate(m.window)
+	if !m.closed.IsZero() && starts.Before(m.closed) {
+		// the window of the event has already been emitted
+		m.cfg.Log().Warn("event skipped", "reason", reasonLate, "time", when, "closed", m.closed)
+		return prospect.Skip(reasonLate)
+	}
+	b, ok := m.buckets[starts.Unix()]
+	if !ok {
+		b = &bucket{Starts: starts}
+		m.buckets[starts.Unix()] = b
+	}
+	b.Count++
+	if when.After(m.latest) {
+		m.latest = when
+		m.flush(m.latest.Add(-m.grace))
+	}
+	return nil
+}
+
+// flush moves to the ready list all the windows ending before limit. If limit
+// is the zero time, all the remaining windows are flushed.
+func (m *module) flush(limit time.Time) {
+	var list []bucket
+	for k, b := range m.buckets {
+		ends := b.Starts.Add(m.window)
+		if !limit.IsZero() && ends.After(limit) {
+			continue
+		}
+		list = append(list, *b)
+		delete(m.buckets, k)
+		if ends.After(m.closed) {
+			m.closed = ends
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Starts.Before(list[j].Starts)
+	})
+	m.ready = append(m.ready, list...)
+}
+
+func (m *module) parseTime(line []byte) (time.Time, error) {
+	var (
+		event map[string]interface{}
+		when  time.Time
+	)
+	if err := json.Unmarshal(line, &event); err != nil {
+		return when, err
+	}
+	switch v := event[m.field].(type) {
+	case string:
+		return m.cfg.ParseTimeAny(v)
+	case float64:
+		return time.Unix(int64(v), 0).UTC(), nil
+	default:
+		return when, fmt.Errorf("%s: missing or invalid time field", m.field)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/busoc/prospect"
+)
+
+func TestParseTime(t *testing.T) {
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip(err)
+	}
+	data := []struct {
+		Zone *time.Location
+		Line string
+		Want time.Time
+	}{
+		{
+			Line: `{"time": "2021-01-04T02:00:00Z"}`,
+			Want: time.Date(2021, 1, 4, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			Line: `{"time": "2021-01-04T02:00:00"}`,
+			Want: time.Date(2021, 1, 4, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			Zone: tokyo,
+			Line: `{"time": "2021-01-04T02:00:00"}`,
+			Want: time.Date(2021, 1, 3, 17, 0, 0, 0, time.UTC),
+		},
+		{
+			Zone: tokyo,
+			Line: `{"time": "2021-01-04T02:00:00Z"}`,
+			Want: time.Date(2021, 1, 4, 2, 0, 0, 0, time.UTC),
+		},
+		{
+			Zone: tokyo,
+			Line: `{"time": 1609725600}`,
+			Want: time.Date(2021, 1, 4, 2, 0, 0, 0, time.UTC),
+		},
+	}
+	for _, d := range data {
+		m := module{
+			cfg:   prospect.Config{Timezone: prospect.Location{Location: d.Zone}},
+			field: "time",
+		}
+		got, err := m.parseTime([]byte(d.Line))
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", d.Line, err)
+			continue
+		}
+		if !got.Equal(d.Want) {
+			t.Errorf("%s: times mismatched! want %s, got %s", d.Line, d.Want, got)
+		}
+	}
+}
+
+func TestProcessLateEvents(t *testing.T) {
+	const events = `{"time": "2021-01-04T10:00:10Z"}
+{"time": "2021-01-04T10:00:20Z"}
+{"time": "2021-01-04T10:01:10Z"}
+{"time": "2021-01-04T10:00:30Z"}
+{"time": "2021-01-04T10:02:10Z"}
+{"time": "2021-01-04T10:00:40Z"}
+`
+	var (
+		dir    = t.TempDir()
+		stream = filepath.Join(dir, "events.ndjson")
+		config = filepath.Join(dir, "window.toml")
+	)
+	if err := ioutil.WriteFile(stream, []byte(events), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(config, []byte("window = \"1m\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mod, err := New(prospect.Config{Location: stream, Config: config})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		r      = prospect.NewRunner(prospect.Config{})
+		counts []string
+	)
+	err = r.Run(mod, func(fi prospect.FileInfo) error {
+		for _, p := range fi.Parameters {
+			if p.Name == windowCount {
+				counts = append(counts, p.Value)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := strings.Join(counts, ","); got != "2,1,1" {
+		t.Errorf("counts mismatched! want 2,1,1, got %s", got)
+	}
+	if r.Skipped() != 2 || r.Summary.Skipped[reasonLate] != 2 {
+		t.Errorf("late events should be skipped! want 2, got %d (%v)", r.Skipped(), r.Summary.Skipped)
+	}
+}
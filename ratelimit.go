@@ -0,0 +1,54 @@
+package prospect
+
+import (
+	"github.com/juju/ratelimit"
+)
+
+// RateLimit limits the number of calls per second to the Process (or
+// ProcessBatch) method of a module. Burst is the number of calls that can be
+// made at once before being slowed down (default to 1).
+type RateLimit struct {
+	Rate  float64
+	Burst int64
+}
+
+// Limit gives a Module whose calls to Process block until they are allowed by
+// r. m is returned as is if r has no rate. The returned Module is a
+// BatchModule if m is one.
+func (r RateLimit) Limit(m Module) Module {
+	if r.Rate <= 0 {
+		return m
+	}
+	burst := r.Burst
+	if burst <= 0 {
+		burst = 1
+	}
+	lm := limited{
+		Module: m,
+		bucket: ratelimit.NewBucketWithRate(r.Rate, burst),
+	}
+	if b, ok := m.(BatchModule); ok {
+		return limitedBatch{limited: lm, batch: b}
+	}
+	return lm
+}
+
+type limited struct {
+	Module
+	bucket *ratelimit.Bucket
+}
+
+func (m limited) Process() (FileInfo, error) {
+	m.bucket.Wait(1)
+	return m.Module.Process()
+}
+
+type limitedBatch struct {
+	limited
+	batch BatchModule
+}
+
+func (m limitedBatch) ProcessBatch() ([]FileInfo, error) {
+	m.bucket.Wait(1)
+	return m.batch.ProcessBatch()
+}
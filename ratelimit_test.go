@@ -0,0 +1,54 @@
+package prospect
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	data := []struct {
+		Limit RateLimit
+		Batch bool
+		Calls int
+		Min   time.Duration
+	}{
+		{Limit: RateLimit{}, Calls: 10},
+		{Limit: RateLimit{Rate: -1}, Calls: 10},
+		{Limit: RateLimit{Rate: 50}, Calls: 6, Min: 90 * time.Millisecond},
+		{Limit: RateLimit{Rate: 50}, Batch: true, Calls: 6, Min: 90 * time.Millisecond},
+		{Limit: RateLimit{Rate: 50, Burst: 6}, Calls: 6},
+	}
+	for _, d := range data {
+		var (
+			results = make([]result, d.Calls)
+			s       = &script{results: results}
+			m       = d.Limit.Limit(s)
+		)
+		if _, ok := m.(*script); ok != (d.Limit.Rate <= 0) {
+			t.Errorf("%+v: module should only be wrapped with a rate", d.Limit)
+		}
+		b, ok := m.(BatchModule)
+		if !ok {
+			t.Errorf("%+v: module should still be a BatchModule", d.Limit)
+			continue
+		}
+		now := time.Now()
+		for i := 0; i < d.Calls; i++ {
+			if d.Batch {
+				b.ProcessBatch()
+			} else {
+				m.Process()
+			}
+		}
+		if elapsed := time.Since(now); elapsed < d.Min || (d.Min == 0 && elapsed > 50*time.Millisecond) {
+			t.Errorf("%+v: %d calls took %s (min: %s)", d.Limit, d.Calls, elapsed, d.Min)
+		}
+		if len(s.results) != 0 {
+			t.Errorf("%+v: calls should be given to the module (%d left)", d.Limit, len(s.results))
+		}
+	}
+	m := RateLimit{Rate: 50}.Limit(single{s: &script{}})
+	if _, ok := m.(BatchModule); ok {
+		t.Errorf("module should not become a BatchModule")
+	}
+}
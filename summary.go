@@ -0,0 +1,57 @@
+package prospect
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+const reasonUnknown = "unknown"
+
+// Summary tallies the results returned by successive calls to Module.Process.
+type Summary struct {
+	Processed int            `json:"processed"`
+	Skipped   map[string]int `json:"skipped"`
+	Errors    int            `json:"errors"`
+	Bytes     int64          `json:"bytes"`
+	Types     map[string]int `json:"types"`
+	Levels    map[int]int    `json:"levels"`
+}
+
+func NewSummary() *Summary {
+	return &Summary{
+		Skipped: make(map[string]int),
+		Types:   make(map[string]int),
+		Levels:  make(map[int]int),
+	}
+}
+
+func (s *Summary) Update(fi FileInfo, err error) {
+	if err != nil {
+		s.updateError(err)
+		return
+	}
+	s.Processed++
+	s.Bytes += fi.Size
+	s.Types[fi.Type]++
+	s.Levels[fi.Level]++
+}
+
+func (s *Summary) updateError(err error) {
+	var skip SkipError
+	switch {
+	case errors.Is(err, ErrDone):
+	case errors.As(err, &skip):
+		s.Skipped[skip.Reason]++
+	case errors.Is(err, ErrSkip):
+		s.Skipped[reasonUnknown]++
+	default:
+		s.Errors++
+	}
+}
+
+func (s *Summary) WriteSummary(w io.Writer) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "\t")
+	return e.Encode(s)
+}
@@ -51,6 +51,56 @@ func FormatDurationISO(d time.Duration) string {
 	return string(str)
 }
 
+// Duration is a time.Duration that can be decoded from a string such as "15m"
+// in a configuration file.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) Set(str string) error {
+	v, err := time.ParseDuration(str)
+	if err == nil {
+		d.Duration = v
+	}
+	return err
+}
+
+// Location is a time zone that can be decoded from its name (eg:
+// Europe/Brussels) in a configuration file.
+type Location struct {
+	*time.Location
+}
+
+func (v *Location) Set(str string) error {
+	loc, err := time.LoadLocation(str)
+	if err == nil {
+		v.Location = loc
+	}
+	return err
+}
+
+// TimeLayouts are the layouts tried by Config.ParseTimeAny: RFC3339 and the
+// same without zone information.
+var TimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02",
+}
+
+// ParseTime parses str with the given layout. If str has no zone information,
+// the time is taken in loc (UTC if loc is nil). The time is given in UTC.
+func ParseTime(layout, str string, loc *time.Location) (time.Time, error) {
+	if loc == nil {
+		loc = time.UTC
+	}
+	when, err := time.ParseInLocation(layout, str, loc)
+	if err != nil {
+		return when, err
+	}
+	return when.UTC(), nil
+}
+
 const (
 	TimeFormatRT       = "rt"
 	TimeFormatHDKLong  = "hadock"
@@ -0,0 +1,40 @@
+package prospect
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/midbel/toml"
+)
+
+func TestConfigParseTime(t *testing.T) {
+	data := []struct {
+		Config string
+		Time   string
+		Want   string
+	}{
+		{Time: "2021-01-04 02:00:00", Want: "2021-01-04T02:00:00Z"},
+		{Config: "assume-timezone = \"Asia/Tokyo\"\n", Time: "2021-01-04 02:00:00", Want: "2021-01-03T17:00:00Z"},
+		{Config: "assume-timezone = \"America/New_York\"\n", Time: "2021-01-04T22:00:00", Want: "2021-01-05T03:00:00Z"},
+		{Config: "assume-timezone = \"Asia/Tokyo\"\n", Time: "2021-01-04T02:00:00+01:00", Want: "2021-01-04T01:00:00Z"},
+		{Config: "assume-timezone = \"Asia/Tokyo\"\n", Time: "2021-01-04", Want: "2021-01-03T15:00:00Z"},
+	}
+	for _, d := range data {
+		var c Config
+		if err := toml.Decode(strings.NewReader(d.Config), &c); err != nil {
+			t.Errorf("%q: fail to decode configuration: %s", d.Config, err)
+			continue
+		}
+		when, err := c.ParseTimeAny(d.Time)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %s", d.Time, err)
+			continue
+		}
+		if got := when.Format("2006-01-02T15:04:05Z07:00"); got != d.Want {
+			t.Errorf("%q (%q): times mismatched! want %s, got %s", d.Time, d.Config, d.Want, got)
+		}
+	}
+	if _, err := (Config{}).ParseTimeAny("04/01/2021"); err == nil {
+		t.Errorf("expected an error for an unknown layout")
+	}
+}